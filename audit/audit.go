@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// Log records what happened to the shares (created, files added or removed,
+// receivers connected, transfers completed or failed, deleted) in the store
+type Log struct {
+	store mongoclient.Store
+	// use the client ip of X-Forwarded-For as the peer of the http requests
+	trustProxy bool
+	// how long the events are kept
+	retention time.Duration
+}
+
+func NewLog(store mongoclient.Store, trustProxy bool, retention time.Duration) *Log {
+	return &Log{
+		store:      store,
+		trustProxy: trustProxy,
+		retention:  retention,
+	}
+}
+
+// Record saves the event. A failure is only logged, the audited action
+// already happened
+func (l *Log) Record(event schema.AuditEventSchema) {
+	event.ExpireAt = event.At.Add(l.retention)
+	if err := l.store.AddAuditEvent(event); err != nil {
+		fmt.Printf("audit %v err: %v\n", event.Type, err)
+	}
+}
+
+// RecordRequest saves the event with the client of req as the peer
+func (l *Log) RecordRequest(req *http.Request, event schema.AuditEventSchema) {
+	event.Peer.Network, event.Peer.Local = handler.IpInfo(handler.ClientIp(req, l.trustProxy))
+	l.Record(event)
+}
+
+func (l *Log) Events(filesId string) ([]schema.AuditEventSchema, error) {
+	return l.store.GetAuditEvents(filesId)
+}
@@ -0,0 +1,31 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRecordRetention(t *testing.T) {
+	store := mongoclient.NewMemoryStore()
+	defer store.Close()
+	l := NewLog(store, false, time.Hour)
+
+	filesId := primitive.NewObjectID()
+	event := schema.NewAuditEventSchema(filesId, schema.AuditShareCreated)
+	l.Record(event)
+
+	events, err := l.Events(filesId.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%v events, want 1", len(events))
+	}
+	if want := event.At.Add(time.Hour); !events[0].ExpireAt.Equal(want) {
+		t.Errorf("expires at %v, want %v", events[0].ExpireAt, want)
+	}
+}
@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// export formats of the events
+const (
+	FormatJson  string = "json"
+	FormatJsonl string = "jsonl"
+	FormatCsv   string = "csv"
+)
+
+var ContentTypes = map[string]string{
+	FormatJson:  "application/json",
+	FormatJsonl: "application/jsonl",
+	FormatCsv:   "text/csv",
+}
+
+var csvHeader = []string{"id", "filesId", "type", "at", "signalingId", "peerName", "peerNetwork", "peerLocal", "files", "detail"}
+
+// Write writes the events in format (FormatJson, FormatJsonl or FormatCsv)
+func Write(w io.Writer, format string, events []schema.AuditEventSchema) error {
+	switch format {
+	case FormatJson:
+		return json.NewEncoder(w).Encode(events)
+	case FormatJsonl:
+		return writeJsonl(w, events)
+	case FormatCsv:
+		return writeCsv(w, events)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// one event per line
+func writeJsonl(w io.Writer, events []schema.AuditEventSchema) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the files are separated by "|"
+func writeCsv(w io.Writer, events []schema.AuditEventSchema) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		record := []string{
+			event.ID.Hex(),
+			event.FilesId.Hex(),
+			event.Type,
+			event.At.UTC().Format(time.RFC3339Nano),
+			event.SignalingId,
+			csvText(event.Peer.Name),
+			event.Peer.Network,
+			strconv.FormatBool(event.Peer.Local),
+			csvText(strings.Join(event.Files, "|")),
+			csvText(event.Detail),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// the names are chosen by the clients, a spreadsheet must not run them as
+// formulas
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
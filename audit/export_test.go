@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// go test ./audit -update rewrites the golden files
+var update = flag.Bool("update", false, "update the golden files")
+
+func testEvents(t *testing.T) []schema.AuditEventSchema {
+	t.Helper()
+
+	objId := func(hex string) primitive.ObjectID {
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	filesId := objId("6650a1b2c3d4e5f601234567")
+	at := time.Date(2024, 5, 24, 10, 30, 0, 0, time.UTC)
+
+	return []schema.AuditEventSchema{
+		{
+			ID:      objId("6650a1b2c3d4e5f601234568"),
+			FilesId: filesId,
+			Type:    schema.AuditShareCreated,
+			At:      at,
+			Peer:    schema.AuditPeer{Network: "203.0.113.0/24"},
+			Files:   []string{"a.txt", "src/main.go"},
+		},
+		{
+			ID:          objId("6650a1b2c3d4e5f601234569"),
+			FilesId:     filesId,
+			Type:        schema.AuditReceiverConnected,
+			At:          at.Add(time.Minute),
+			SignalingId: "6650a1b2c3d4e5f60123456a",
+			// chosen by the receiver, it must not run as a formula
+			Peer: schema.AuditPeer{Name: "=HYPERLINK(\"http://x\")", Network: "192.168.1.0/24", Local: true},
+		},
+		{
+			ID:          objId("6650a1b2c3d4e5f60123456b"),
+			FilesId:     filesId,
+			Type:        schema.AuditIntegrityMismatch,
+			At:          at.Add(90 * time.Second),
+			SignalingId: "6650a1b2c3d4e5f60123456a",
+			Files:       []string{"-rf, \"quoted\".txt"},
+			Detail:      "chunks 0,3",
+		},
+		{
+			ID:      objId("6650a1b2c3d4e5f60123456c"),
+			FilesId: filesId,
+			Type:    schema.AuditShareDeleted,
+			At:      at.Add(time.Hour),
+			Detail:  "@sum(1)",
+		},
+	}
+}
+
+func TestWrite(t *testing.T) {
+	events := testEvents(t)
+
+	for _, format := range []string{FormatJson, FormatJsonl, FormatCsv} {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Write(&out, format, events); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "events."+format)
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("got:\n%s\nwant:\n%s", out.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatJson, "[]\n"},
+		{FormatJsonl, ""},
+		{FormatCsv, "id,filesId,type,at,signalingId,peerName,peerNetwork,peerLocal,files,detail\n"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := Write(&out, tt.format, []schema.AuditEventSchema{}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.format, out.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Error("written")
+	}
+}
+
+func TestCsvText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"bob", "bob"},
+		{"a=b", "a=b"},
+		{"=1+1", "'=1+1"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@sum(1)", "'@sum(1)"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+	}
+
+	for _, tt := range tests {
+		if got := csvText(tt.value); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package bus
+
+import "fmt"
+
+// Bus is a publish/subscribe channel between the backend instances
+type Bus interface {
+	Publish(topic string, payload []byte) error
+	// cb is called with every payload published to topic until unsubscribe is
+	// called, including the ones published right after Subscribe returns
+	Subscribe(topic string, cb func(payload []byte)) (unsubscribe func(), err error)
+	// drops every subscription
+	Close() error
+}
+
+// Open returns the bus for the backend name ("memory" or "redis").
+// addr is the redis address, ignored by the memory bus
+func Open(backend string, addr string) (Bus, error) {
+	switch backend {
+	case "memory":
+		return NewMemoryBus(), nil
+	case "redis":
+		return ConnectRedis(addr)
+	default:
+		return nil, fmt.Errorf("unknown bus backend %q", backend)
+	}
+}
@@ -0,0 +1,62 @@
+package bus
+
+import "sync"
+
+// MemoryBus only reaches the subscribers of this instance
+type MemoryBus struct {
+	mu     sync.RWMutex
+	nextId int
+	subs   map[string]map[int]func(payload []byte)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subs: map[string]map[int]func(payload []byte){},
+	}
+}
+
+// the callbacks are called before returning, in the caller goroutine
+func (b *MemoryBus) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	cbs := make([]func(payload []byte), 0, len(b.subs[topic]))
+	for _, cb := range b.subs[topic] {
+		cbs = append(cbs, cb)
+	}
+	b.mu.RUnlock()
+
+	for _, cb := range cbs {
+		cb(payload)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs = map[string]map[int]func(payload []byte){}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(topic string, cb func(payload []byte)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextId
+	b.nextId++
+
+	if b.subs[topic] == nil {
+		b.subs[topic] = map[int]func(payload []byte){}
+	}
+	b.subs[topic][id] = cb
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs[topic], id)
+		if len(b.subs[topic]) == 0 {
+			delete(b.subs, topic)
+		}
+	}, nil
+}
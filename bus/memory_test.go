@@ -0,0 +1,81 @@
+package bus
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMemoryBus(t *testing.T) {
+	tests := []struct {
+		name string
+		// topics of the subscribers, in order
+		subscribe []string
+		// indexes of the subscribers that unsubscribe before the publish
+		unsubscribe []int
+		publish     string
+		// indexes of the subscribers that receive the payload
+		want []int
+	}{
+		{"one subscriber", []string{"a"}, nil, "a", []int{0}},
+		{"other topic", []string{"a"}, nil, "b", nil},
+		{"every subscriber of the topic", []string{"a", "b", "a"}, nil, "a", []int{0, 2}},
+		{"unsubscribed", []string{"a", "a"}, []int{0}, "a", []int{1}},
+		{"unsubscribed twice", []string{"a", "a"}, []int{0, 0}, "a", []int{1}},
+		{"every subscriber unsubscribed", []string{"a", "a"}, []int{0, 1}, "a", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBus()
+
+			var got []int
+			var unsubscribes []func()
+			for i, topic := range tt.subscribe {
+				unsubscribe, err := b.Subscribe(topic, func(payload []byte) {
+					if string(payload) != "payload" {
+						t.Errorf("subscriber %v got %q", i, payload)
+					}
+					got = append(got, i)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				unsubscribes = append(unsubscribes, unsubscribe)
+			}
+			for _, i := range tt.unsubscribe {
+				unsubscribes[i]()
+			}
+
+			if err := b.Publish(tt.publish, []byte("payload")); err != nil {
+				t.Fatal(err)
+			}
+
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			unsubscribed := map[int]bool{}
+			for _, i := range tt.unsubscribe {
+				unsubscribed[i] = true
+			}
+			if len(unsubscribed) == len(tt.subscribe) && len(b.subs) != 0 {
+				t.Errorf("topics left: %v", b.subs)
+			}
+		})
+	}
+}
+
+func TestMemoryBusClose(t *testing.T) {
+	b := NewMemoryBus()
+
+	called := false
+	if _, err := b.Subscribe("a", func(payload []byte) { called = true }); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	b.Publish("a", nil)
+
+	if called {
+		t.Error("subscriber called after Close")
+	}
+}
@@ -0,0 +1,184 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const RedisDefaultAddr string = "localhost:6379"
+
+// wait for redis to confirm a subscription
+const redisSubscribeTimeout = time.Second * 10
+
+// RedisBus uses redis pub/sub, so a message published by any instance
+// reaches the subscribers of every instance connected to the same redis.
+// All the subscriptions of the instance share one redis connection
+type RedisBus struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	topics *topics
+	local  *MemoryBus
+
+	mu sync.Mutex
+	// closed when redis confirms the subscription of the topic
+	confirmed map[string]chan struct{}
+}
+
+func ConnectRedis(addr string) (*RedisBus, error) {
+	if addr == "" {
+		addr = RedisDefaultAddr
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping to redis failed: %v", err)
+	}
+
+	pubsub := client.Subscribe(context.Background())
+	b := &RedisBus{
+		client:    client,
+		pubsub:    pubsub,
+		local:     NewMemoryBus(),
+		confirmed: map[string]chan struct{}{},
+	}
+	b.topics = newTopics(
+		b.subscribe,
+		func(topic string) error { return pubsub.Unsubscribe(context.TODO(), topic) },
+	)
+	go b.receive()
+
+	fmt.Println("Connected to Redis (" + addr + ")")
+	return b, nil
+}
+
+func (b *RedisBus) Publish(topic string, payload []byte) error {
+	return b.client.Publish(context.TODO(), topic, payload).Err()
+}
+
+// Subscribe returns once redis confirmed the subscription, the messages
+// published after it are received
+func (b *RedisBus) Subscribe(topic string, cb func(payload []byte)) (func(), error) {
+	if err := b.topics.add(topic); err != nil {
+		return nil, err
+	}
+
+	unsubscribe, _ := b.local.Subscribe(topic, cb)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			b.topics.remove(topic)
+		})
+	}, nil
+}
+
+func (b *RedisBus) Close() error {
+	b.pubsub.Close()
+	b.local.Close()
+	return b.client.Close()
+}
+
+// subscribes to topic in redis. PubSub.Subscribe only sends the command, it
+// waits for the confirmation that receive gets
+func (b *RedisBus) subscribe(topic string) error {
+	confirmed := make(chan struct{})
+	b.mu.Lock()
+	b.confirmed[topic] = confirmed
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.confirmed, topic)
+		b.mu.Unlock()
+	}()
+
+	if err := b.pubsub.Subscribe(context.TODO(), topic); err != nil {
+		return err
+	}
+
+	select {
+	case <-confirmed:
+		return nil
+	case <-time.After(redisSubscribeTimeout):
+		// not counted by topics, it must not stay subscribed
+		b.pubsub.Unsubscribe(context.TODO(), topic)
+		return fmt.Errorf("redis subscribe %v: not confirmed after %v", topic, redisSubscribeTimeout)
+	}
+}
+
+// dispatches the redis messages to the local subscribers, in order, and the
+// subscription confirmations to subscribe
+func (b *RedisBus) receive() {
+	for msg := range b.pubsub.ChannelWithSubscriptions() {
+		switch msg := msg.(type) {
+		case *redis.Message:
+			b.local.Publish(msg.Channel, []byte(msg.Payload))
+		case *redis.Subscription:
+			if msg.Kind != "subscribe" {
+				continue
+			}
+			b.mu.Lock()
+			if confirmed, ok := b.confirmed[msg.Channel]; ok {
+				close(confirmed)
+				delete(b.confirmed, msg.Channel)
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// counts the subscriptions of every topic, the redis subscription is only
+// added by the first one and removed by the last one. Both happen with mu
+// held, so they reach redis in the same order as the counts change
+type topics struct {
+	mu          sync.Mutex
+	refs        map[string]int
+	subscribe   func(topic string) error
+	unsubscribe func(topic string) error
+}
+
+func newTopics(subscribe func(topic string) error, unsubscribe func(topic string) error) *topics {
+	return &topics{
+		refs:        map[string]int{},
+		subscribe:   subscribe,
+		unsubscribe: unsubscribe,
+	}
+}
+
+func (t *topics) add(topic string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs[topic] == 0 {
+		if err := t.subscribe(topic); err != nil {
+			return err
+		}
+	}
+	t.refs[topic]++
+	return nil
+}
+
+func (t *topics) remove(topic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refs[topic]--
+	if t.refs[topic] > 0 {
+		return
+	}
+	delete(t.refs, topic)
+	if err := t.unsubscribe(topic); err != nil {
+		fmt.Printf("redis unsubscribe err: %v\n", err)
+	}
+}
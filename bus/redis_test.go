@@ -0,0 +1,308 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// stands in for the redis subscriptions, recording the calls in order
+type fakePubSub struct {
+	mu    sync.Mutex
+	calls []string
+	// returned by the next subscribe
+	err error
+}
+
+func (f *fakePubSub) topics() *topics {
+	return newTopics(
+		func(topic string) error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if err := f.err; err != nil {
+				f.err = nil
+				return err
+			}
+			f.calls = append(f.calls, "subscribe "+topic)
+			return nil
+		},
+		func(topic string) error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.calls = append(f.calls, "unsubscribe "+topic)
+			return nil
+		},
+	)
+}
+
+func TestTopics(t *testing.T) {
+	type step struct {
+		add   bool
+		topic string
+	}
+	add := func(topic string) step { return step{true, topic} }
+	remove := func(topic string) step { return step{false, topic} }
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  []string
+	}{
+		{
+			"first and last",
+			[]step{add("a"), add("a"), remove("a"), remove("a")},
+			[]string{"subscribe a", "unsubscribe a"},
+		},
+		{
+			"subscribed again",
+			[]step{add("a"), remove("a"), add("a")},
+			[]string{"subscribe a", "unsubscribe a", "subscribe a"},
+		},
+		{
+			"topics counted apart",
+			[]step{add("a"), add("b"), remove("a"), add("b"), remove("b")},
+			[]string{"subscribe a", "subscribe b", "unsubscribe a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f fakePubSub
+			topics := f.topics()
+
+			for _, s := range tt.steps {
+				if s.add {
+					if err := topics.add(s.topic); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					topics.remove(s.topic)
+				}
+			}
+
+			if !slices.Equal(f.calls, tt.want) {
+				t.Errorf("got %v, want %v", f.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicsSubscribeError(t *testing.T) {
+	f := fakePubSub{err: errors.New("redis down")}
+	topics := f.topics()
+
+	if err := topics.add("a"); err == nil {
+		t.Fatal("expected the subscribe error")
+	}
+	// not counted, the next one subscribes
+	if err := topics.add("a"); err != nil {
+		t.Fatal(err)
+	}
+	topics.remove("a")
+
+	want := []string{"subscribe a", "unsubscribe a"}
+	if !slices.Equal(f.calls, want) {
+		t.Errorf("got %v, want %v", f.calls, want)
+	}
+}
+
+// the redis calls of a topic alternate whatever the order of the
+// subscriptions, and it ends unsubscribed
+func TestTopicsConcurrent(t *testing.T) {
+	var f fakePubSub
+	topics := f.topics()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			topic := fmt.Sprint(i % 3)
+			for range 100 {
+				if err := topics.add(topic); err != nil {
+					t.Error(err)
+					return
+				}
+				topics.remove(topic)
+			}
+		}()
+	}
+	wg.Wait()
+
+	subscribed := map[string]bool{}
+	for _, call := range f.calls {
+		var action, topic string
+		fmt.Sscan(call, &action, &topic)
+		if subscribed[topic] == (action == "subscribe") {
+			t.Fatalf("%v while subscribed is %v", call, subscribed[topic])
+		}
+		subscribed[topic] = action == "subscribe"
+	}
+	for topic, ok := range subscribed {
+		if ok {
+			t.Errorf("%v still subscribed", topic)
+		}
+	}
+	if len(topics.refs) != 0 {
+		t.Errorf("refs left: %v", topics.refs)
+	}
+}
+
+// a redis bus of a new miniredis and a function that connects other
+// instances to it
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, func() *RedisBus) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	return mr, func() *RedisBus {
+		b, err := ConnectRedis(mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return b
+	}
+}
+
+// waits until redis has n subscriptions of topic, the unsubscribe commands
+// aren't acknowledged
+func waitSubscribers(t *testing.T, mr *miniredis.Miniredis, topic string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for mr.PubSubNumSub(topic)[topic] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v has %v subscribers, want %v", topic, mr.PubSubNumSub(topic)[topic], n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receivePayloads(t *testing.T, payloads <-chan string, n int) []string {
+	t.Helper()
+
+	var got []string
+	for len(got) < n {
+		select {
+		case payload := <-payloads:
+			got = append(got, payload)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v of %v: %v", len(got), n, got)
+		}
+	}
+	select {
+	case payload := <-payloads:
+		t.Fatalf("unexpected %q after %v", payload, got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return got
+}
+
+// the messages published by any instance reach the subscribers of every
+// instance, in order
+func TestRedisBusInstances(t *testing.T) {
+	mr, connect := newTestRedis(t)
+	a, b := connect(), connect()
+
+	payloadsA := make(chan string, 100)
+	payloadsB := make(chan string, 100)
+	for _, sub := range []struct {
+		bus      *RedisBus
+		payloads chan string
+	}{{a, payloadsA}, {b, payloadsB}} {
+		if _, err := sub.bus.Subscribe("files", func(payload []byte) { sub.payloads <- string(payload) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSubscribers(t, mr, "files", 2)
+
+	var want []string
+	for i := range 10 {
+		payload := fmt.Sprint(i)
+		publisher := a
+		if i%2 == 1 {
+			publisher = b
+		}
+		if err := publisher.Publish("files", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, payload)
+	}
+	if err := a.Publish("other", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, payloads := range map[string]chan string{"a": payloadsA, "b": payloadsB} {
+		if got := receivePayloads(t, payloads, len(want)); !slices.Equal(got, want) {
+			t.Errorf("%v received %v, want %v", name, got, want)
+		}
+	}
+}
+
+// the topic stays subscribed in redis until the last subscriber of the
+// instance unsubscribes
+func TestRedisBusUnsubscribe(t *testing.T) {
+	mr, connect := newTestRedis(t)
+	b := connect()
+
+	first := make(chan string, 10)
+	second := make(chan string, 10)
+	unsubscribeFirst, err := b.Subscribe("files", func(payload []byte) { first <- string(payload) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsubscribeSecond, err := b.Subscribe("files", func(payload []byte) { second <- string(payload) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, mr, "files", 1)
+
+	unsubscribeFirst()
+	// twice is a no-op, the second subscriber keeps the topic
+	unsubscribeFirst()
+	waitSubscribers(t, mr, "files", 1)
+
+	if err := b.Publish("files", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	receivePayloads(t, second, 1)
+	receivePayloads(t, first, 0)
+
+	unsubscribeSecond()
+	waitSubscribers(t, mr, "files", 0)
+}
+
+// a message published right after Subscribe returns is received
+func TestRedisBusSubscribeConfirmed(t *testing.T) {
+	_, connect := newTestRedis(t)
+	a, b := connect(), connect()
+
+	for i := range 20 {
+		topic := fmt.Sprint("files", i)
+		payloads := make(chan string, 1)
+		unsubscribe, err := a.Subscribe(topic, func(payload []byte) { payloads <- string(payload) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(topic, []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+		receivePayloads(t, payloads, 1)
+		unsubscribe()
+	}
+}
+
+func TestRedisBusConnectError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+
+	if _, err := ConnectRedis(addr); err == nil {
+		t.Error("connected to a closed redis")
+	}
+}
@@ -0,0 +1,481 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of the environment variables, the rest is the flag name in upper
+// case with '_' instead of '-' (store-dsn -> WEBRTC_STORE_DSN)
+const EnvPrefix string = "WEBRTC_"
+
+// Config of the server. Every value is loaded from the defaults, then the
+// yaml or toml file (-config), then the environment variables and then the
+// flags, each one overriding the previous
+type Config struct {
+	Addr string `yaml:"addr" toml:"addr"`
+	// how long the shutdown waits for the websockets to be closed
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	Cors            CorsConfig    `yaml:"cors" toml:"cors"`
+	Store           StoreConfig   `yaml:"store" toml:"store"`
+	// lifetime of a share that doesn't request one, the requested ones (and
+	// the extensions) must be between FilesMinTtl and FilesMaxTtl
+	FilesTtl    time.Duration `yaml:"filesTtl" toml:"filesTtl"`
+	FilesMinTtl time.Duration `yaml:"filesMinTtl" toml:"filesMinTtl"`
+	FilesMaxTtl time.Duration `yaml:"filesMaxTtl" toml:"filesMaxTtl"`
+	// how long a share is kept after its host websocket is lost, 0 deletes it right away
+	HostGrace time.Duration `yaml:"hostGrace" toml:"hostGrace"`
+	// how long the audit events and the completions are kept, they outlive
+	// the share
+	Retention time.Duration   `yaml:"retention" toml:"retention"`
+	Signaling SignalingConfig `yaml:"signaling" toml:"signaling"`
+	Websocket WebsocketConfig `yaml:"websocket" toml:"websocket"`
+	FileRelay FileRelayConfig `yaml:"fileRelay" toml:"fileRelay"`
+	Ice       IceConfig       `yaml:"ice" toml:"ice"`
+	Tokens    TokensConfig    `yaml:"tokens" toml:"tokens"`
+	RateLimit RateLimitConfig `yaml:"rateLimit" toml:"rateLimit"`
+	Lockout   LockoutConfig   `yaml:"lockout" toml:"lockout"`
+	// bearer token of /api/stats, the route is disabled if empty
+	StatsToken string `yaml:"statsToken" toml:"statsToken"`
+}
+
+type CorsConfig struct {
+	AllowedOrigins   []string `yaml:"allowedOrigins" toml:"allowedOrigins"`
+	AllowedMethods   []string `yaml:"allowedMethods" toml:"allowedMethods"`
+	AllowedHeaders   []string `yaml:"allowedHeaders" toml:"allowedHeaders"`
+	AllowCredentials bool     `yaml:"allowCredentials" toml:"allowCredentials"`
+}
+
+type StoreConfig struct {
+	Backend string `yaml:"backend" toml:"backend"`
+	// sqlite database file or postgres connection string
+	Dsn   string      `yaml:"dsn" toml:"dsn"`
+	Mongo MongoConfig `yaml:"mongo" toml:"mongo"`
+}
+
+type MongoConfig struct {
+	Uri        string `yaml:"uri" toml:"uri"`
+	Database   string `yaml:"database" toml:"database"`
+	ReplicaSet string `yaml:"replicaSet" toml:"replicaSet"`
+}
+
+type SignalingConfig struct {
+	Relay   string `yaml:"relay" toml:"relay"`
+	Bus     string `yaml:"bus" toml:"bus"`
+	BusAddr string `yaml:"busAddr" toml:"busAddr"`
+}
+
+// the keepalive of the websockets, 0 disables each one
+type WebsocketConfig struct {
+	// how often a heartbeat is sent to the clients
+	PingInterval time.Duration `yaml:"pingInterval" toml:"pingInterval"`
+	// a websocket that doesn't send anything (a heartbeat included) for this
+	// long is closed
+	IdleTimeout  time.Duration `yaml:"idleTimeout" toml:"idleTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+}
+
+// the websocket relay of the transfers whose p2p connection failed
+type FileRelayConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// bytes per second shared by the relayed transfers of a share (in this
+	// instance), 0 doesn't limit them
+	Bandwidth int64 `yaml:"bandwidth" toml:"bandwidth"`
+	// bytes the host can send before the receiver acknowledges them
+	Window int64 `yaml:"window" toml:"window"`
+	// longest binary message
+	MaxFrame int64 `yaml:"maxFrame" toml:"maxFrame"`
+}
+
+// the ice servers returned to the clients, the TURN ones with credentials of
+// the TURN REST API
+type IceConfig struct {
+	StunUrls []string `yaml:"stunUrls" toml:"stunUrls"`
+	TurnUrls []string `yaml:"turnUrls" toml:"turnUrls"`
+	// static-auth-secret of coturn (use-auth-secret)
+	TurnSecret string `yaml:"turnSecret" toml:"turnSecret"`
+	// lifetime of the TURN credentials
+	TurnTtl time.Duration `yaml:"turnTtl" toml:"turnTtl"`
+}
+
+type TokensConfig struct {
+	// base64, random if empty
+	Key string        `yaml:"key" toml:"key"`
+	Ttl time.Duration `yaml:"ttl" toml:"ttl"`
+	// of the tokens with only the audit permission, they outlive the share
+	AuditTtl time.Duration `yaml:"auditTtl" toml:"auditTtl"`
+}
+
+type RateLimitConfig struct {
+	Limits string `yaml:"limits" toml:"limits"`
+	// same format as Limits, counted per share instead of per client ip
+	ShareLimits string `yaml:"shareLimits" toml:"shareLimits"`
+	Backend     string `yaml:"backend" toml:"backend"`
+	Addr        string `yaml:"addr" toml:"addr"`
+	TrustProxy  bool   `yaml:"trustProxy" toml:"trustProxy"`
+}
+
+type LockoutConfig struct {
+	// memory (per instance) or redis (the one of rateLimit, shared)
+	Backend     string        `yaml:"backend" toml:"backend"`
+	Failures    int           `yaml:"failures" toml:"failures"`
+	Duration    time.Duration `yaml:"duration" toml:"duration"`
+	MaxDuration time.Duration `yaml:"maxDuration" toml:"maxDuration"`
+}
+
+func Default() Config {
+	return Config{
+		Addr:            "0.0.0.0:8900",
+		ShutdownTimeout: time.Second * 15,
+		Cors: CorsConfig{
+			AllowedOrigins:   []string{"*"},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"*"},
+			AllowCredentials: true,
+		},
+		Store: StoreConfig{
+			Backend: "mongo",
+			Mongo: MongoConfig{
+				Uri:        "mongodb://mongo:27017",
+				Database:   "webrtc-filetransfer",
+				ReplicaSet: "rs0",
+			},
+		},
+		FilesTtl:    time.Hour * 24,
+		FilesMinTtl: time.Minute * 5,
+		FilesMaxTtl: time.Hour * 24 * 7,
+		HostGrace:   time.Second * 30,
+		Retention:   30 * 24 * time.Hour,
+		Signaling: SignalingConfig{
+			Relay:   "store",
+			Bus:     "memory",
+			BusAddr: "localhost:6379",
+		},
+		Websocket: WebsocketConfig{
+			PingInterval: time.Second * 20,
+			IdleTimeout:  time.Minute,
+			WriteTimeout: time.Second * 10,
+		},
+		FileRelay: FileRelayConfig{
+			Bandwidth: 4 << 20,
+			Window:    1 << 20,
+			MaxFrame:  64 << 10,
+		},
+		Ice: IceConfig{
+			StunUrls: []string{"stun:stun.l.google.com:19302"},
+			TurnUrls: []string{},
+			TurnTtl:  time.Hour * 12,
+		},
+		Tokens: TokensConfig{
+			Ttl:      time.Hour,
+			AuditTtl: 30 * 24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Limits:      "files/new=10/1m,signaling/new=30/1m,token/new=10/1m,*=300/1m",
+			ShareLimits: "signaling/new=60/1m,token/new=30/1m",
+			Backend:     "memory",
+			Addr:        "localhost:6379",
+		},
+		Lockout: LockoutConfig{
+			Backend:     "memory",
+			Failures:    5,
+			Duration:    time.Minute,
+			MaxDuration: time.Hour,
+		},
+	}
+}
+
+// Load returns the config of the command line args (without the program
+// name). printConfig is true if -print-config was passed
+func Load(args []string) (cfg *Config, printConfig bool, err error) {
+	cfg = &Config{}
+	*cfg = Default()
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := fs.String("config", "", "yaml or toml config file (env "+EnvPrefix+"CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the loaded config and exit")
+	cfg.bindFlags(fs)
+
+	// the first parse only reads -config, the flags are parsed again at the
+	// end so they override the file and the environment
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	*cfg = Default()
+
+	if *path == "" {
+		*path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, false, fmt.Errorf("config file %v: %v", *path, err)
+		}
+	}
+
+	if err := loadEnv(fs); err != nil {
+		return nil, false, err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	return cfg, printConfig, cfg.Validate()
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long the shutdown waits for the websockets to be closed")
+
+	fs.Var((*listValue)(&c.Cors.AllowedOrigins), "cors-origins", "comma separated origins allowed by CORS")
+	fs.Var((*listValue)(&c.Cors.AllowedMethods), "cors-methods", "comma separated methods allowed by CORS")
+	fs.Var((*listValue)(&c.Cors.AllowedHeaders), "cors-headers", "comma separated headers allowed by CORS")
+	fs.BoolVar(&c.Cors.AllowCredentials, "cors-credentials", c.Cors.AllowCredentials, "allow credentials in CORS requests")
+
+	fs.StringVar(&c.Store.Backend, "store", c.Store.Backend, "storage backend: mongo, sqlite, postgres or memory")
+	fs.StringVar(&c.Store.Dsn, "store-dsn", c.Store.Dsn, "sqlite database file or postgres connection string")
+	fs.StringVar(&c.Store.Mongo.Uri, "mongo-uri", c.Store.Mongo.Uri, "mongodb connection uri")
+	fs.StringVar(&c.Store.Mongo.Database, "mongo-db", c.Store.Mongo.Database, "mongodb database name")
+	fs.StringVar(&c.Store.Mongo.ReplicaSet, "mongo-replica-set", c.Store.Mongo.ReplicaSet, "mongodb replica set (needed by the change streams)")
+	fs.DurationVar(&c.FilesTtl, "files-ttl", c.FilesTtl, "lifetime of the shared files")
+	fs.DurationVar(&c.FilesMinTtl, "files-min-ttl", c.FilesMinTtl, "shortest lifetime a share can request")
+	fs.DurationVar(&c.FilesMaxTtl, "files-max-ttl", c.FilesMaxTtl, "longest lifetime a share can request or be extended to")
+	fs.DurationVar(&c.HostGrace, "host-grace", c.HostGrace, "how long a share is kept for its host to resume after losing the websocket (0 deletes it right away)")
+	fs.DurationVar(&c.Retention, "retention", c.Retention, "how long the audit events and the completions are kept")
+
+	fs.StringVar(&c.Signaling.Relay, "signaling", c.Signaling.Relay, "signaling relay: store (change streams) or hub (through the bus)")
+	fs.StringVar(&c.Signaling.Bus, "bus", c.Signaling.Bus, "bus used by the hub relay: memory (single instance) or redis")
+	fs.StringVar(&c.Signaling.BusAddr, "bus-addr", c.Signaling.BusAddr, "redis address of the bus")
+
+	fs.DurationVar(&c.Websocket.PingInterval, "ws-ping-interval", c.Websocket.PingInterval, "how often a heartbeat is sent to the websockets (0 disables it)")
+	fs.DurationVar(&c.Websocket.IdleTimeout, "ws-idle-timeout", c.Websocket.IdleTimeout, "websockets that don't send anything for this long are closed (0 disables it)")
+	fs.DurationVar(&c.Websocket.WriteTimeout, "ws-write-timeout", c.Websocket.WriteTimeout, "longest write of a websocket message (0 disables it)")
+
+	fs.BoolVar(&c.FileRelay.Enabled, "file-relay", c.FileRelay.Enabled, "relay the transfers through the backend when the p2p connection fails. Both websockets of a relay must reach the same instance: run one, or route /api/ws/relay by signalingId")
+	fs.Int64Var(&c.FileRelay.Bandwidth, "file-relay-bandwidth", c.FileRelay.Bandwidth, "bytes per second of the relayed transfers of a share (0 is unlimited)")
+	fs.Int64Var(&c.FileRelay.Window, "file-relay-window", c.FileRelay.Window, "bytes the host can relay before the receiver acknowledges them")
+	fs.Int64Var(&c.FileRelay.MaxFrame, "file-relay-max-frame", c.FileRelay.MaxFrame, "longest binary message of the relay")
+
+	fs.Var((*listValue)(&c.Ice.StunUrls), "ice-stun", "comma separated stun: or stuns: urls returned to the clients")
+	fs.Var((*listValue)(&c.Ice.TurnUrls), "ice-turn", "comma separated turn: or turns: urls returned to the clients with credentials")
+	fs.StringVar(&c.Ice.TurnSecret, "turn-secret", c.Ice.TurnSecret, "shared secret of the TURN server (coturn static-auth-secret)")
+	fs.DurationVar(&c.Ice.TurnTtl, "turn-ttl", c.Ice.TurnTtl, "lifetime of the TURN credentials")
+
+	fs.StringVar(&c.Tokens.Key, "token-key", c.Tokens.Key, "base64 key that signs the tokens (random if empty, tokens won't survive a restart)")
+	fs.DurationVar(&c.Tokens.Ttl, "token-ttl", c.Tokens.Ttl, "lifetime of the tokens")
+	fs.DurationVar(&c.Tokens.AuditTtl, "token-audit-ttl", c.Tokens.AuditTtl, "lifetime of the audit tokens, which read the audit log after the share is deleted")
+
+	fs.StringVar(&c.RateLimit.Limits, "rate-limits", c.RateLimit.Limits, "requests per client ip and route, as <route>=<burst>/<interval>; * applies to the other routes")
+	fs.StringVar(&c.RateLimit.ShareLimits, "share-rate-limits", c.RateLimit.ShareLimits, "requests per share and route from all the client ips, same format as -rate-limits")
+	fs.StringVar(&c.RateLimit.Backend, "rate-limit-backend", c.RateLimit.Backend, "where the rate limits are counted: memory (per instance) or redis (shared)")
+	fs.StringVar(&c.RateLimit.Addr, "rate-limit-addr", c.RateLimit.Addr, "redis address of the rate limits")
+	fs.BoolVar(&c.RateLimit.TrustProxy, "trust-proxy", c.RateLimit.TrustProxy, "use the client ip of X-Forwarded-For (only behind a reverse proxy)")
+
+	fs.StringVar(&c.Lockout.Backend, "lockout-backend", c.Lockout.Backend, "where the failed password attempts are counted: memory (per instance, n replicas allow n times -lockout-failures) or redis (the one of -rate-limit-addr, shared by the replicas)")
+	fs.IntVar(&c.Lockout.Failures, "lockout-failures", c.Lockout.Failures, "failed password attempts before a share is locked")
+	fs.DurationVar(&c.Lockout.Duration, "lockout-duration", c.Lockout.Duration, "first lock of a share, doubled by every next lock")
+	fs.DurationVar(&c.Lockout.MaxDuration, "lockout-max", c.Lockout.MaxDuration, "longest lock of a share")
+
+	fs.StringVar(&c.StatsToken, "stats-token", c.StatsToken, "bearer token of /api/stats (disabled if empty)")
+}
+
+// the format is chosen by the extension (.yaml, .yml or .toml). Unknown keys
+// are an error, so a typo isn't silently ignored
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+
+	case ".toml":
+		meta, err := toml.NewDecoder(f).Decode(c)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+			return fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+		return nil
+
+	default:
+		return errors.New("unknown format, use .yaml, .yml or .toml")
+	}
+}
+
+// sets every flag that has its environment variable
+func loadEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %v: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(name string, value string, values ...string) {
+		check(slices.Contains(values, value), "%v must be one of %v, got %q", name, strings.Join(values, ", "), value)
+	}
+
+	_, _, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "invalid addr %q: %v", c.Addr, err)
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+	check(len(c.Cors.AllowedOrigins) != 0, "cors.allowedOrigins can't be empty")
+	// unlike the origins and headers, rs/cors doesn't treat it as a wildcard
+	check(!slices.Contains(c.Cors.AllowedMethods, "*"), "cors.allowedMethods can't contain *, list the methods")
+
+	oneOf("store.backend", c.Store.Backend, "mongo", "sqlite", "postgres", "memory")
+	switch c.Store.Backend {
+	case "mongo":
+		check(c.Store.Mongo.Uri != "", "store.mongo.uri is required by the mongo store")
+		check(c.Store.Mongo.Database != "", "store.mongo.database is required by the mongo store")
+	case "postgres":
+		check(c.Store.Dsn != "", "store.dsn is required by the postgres store")
+	}
+	check(c.FilesMinTtl > 0, "filesMinTtl must be positive")
+	check(c.FilesMinTtl <= c.FilesTtl && c.FilesTtl <= c.FilesMaxTtl, "filesTtl must be between filesMinTtl and filesMaxTtl")
+	check(c.HostGrace >= 0, "hostGrace can't be negative")
+	check(c.Retention > 0, "retention must be positive")
+
+	oneOf("signaling.relay", c.Signaling.Relay, "store", "hub")
+	oneOf("signaling.bus", c.Signaling.Bus, "memory", "redis")
+
+	check(c.Websocket.PingInterval >= 0, "websocket.pingInterval can't be negative")
+	check(c.Websocket.IdleTimeout >= 0, "websocket.idleTimeout can't be negative")
+	check(c.Websocket.WriteTimeout >= 0, "websocket.writeTimeout can't be negative")
+	if c.Websocket.IdleTimeout > 0 {
+		// the clients answer the heartbeats, so they aren't idle
+		check(c.Websocket.PingInterval > 0 && c.Websocket.PingInterval < c.Websocket.IdleTimeout,
+			"websocket.pingInterval must be shorter than websocket.idleTimeout")
+	}
+
+	check(c.FileRelay.Bandwidth >= 0, "fileRelay.bandwidth can't be negative")
+	check(c.FileRelay.MaxFrame > 0, "fileRelay.maxFrame must be positive")
+	check(c.FileRelay.Window >= c.FileRelay.MaxFrame, "fileRelay.window can't be smaller than fileRelay.maxFrame")
+	if c.FileRelay.Bandwidth > 0 {
+		// a frame must fit in the bandwidth of one second
+		check(c.FileRelay.Bandwidth >= c.FileRelay.MaxFrame, "fileRelay.bandwidth can't be smaller than fileRelay.maxFrame")
+	}
+	// the two websockets of a relay are paired in memory, they must reach the
+	// same instance. Only a redis bus is known to mean several replicas, the
+	// ones sharing a postgres or mongo store need sticky routing (see -file-relay)
+	check(!c.FileRelay.Enabled || c.Signaling.Bus != "redis", "fileRelay.enabled can't be used with signaling.bus redis, the relay only works within one instance")
+
+	for _, u := range c.Ice.StunUrls {
+		check(strings.HasPrefix(u, "stun:") || strings.HasPrefix(u, "stuns:"), "invalid ice.stunUrls %q, expected stun: or stuns:", u)
+	}
+	for _, u := range c.Ice.TurnUrls {
+		check(strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:"), "invalid ice.turnUrls %q, expected turn: or turns:", u)
+	}
+	check(len(c.Ice.TurnUrls) == 0 || c.Ice.TurnSecret != "", "ice.turnSecret is required by ice.turnUrls")
+	check(c.Ice.TurnTtl > 0, "ice.turnTtl must be positive")
+
+	_, err = base64.StdEncoding.DecodeString(c.Tokens.Key)
+	check(err == nil, "tokens.key is not valid base64: %v", err)
+	check(c.Tokens.Ttl > 0, "tokens.ttl must be positive")
+	check(c.Tokens.AuditTtl > 0, "tokens.auditTtl must be positive")
+	// the audit tokens read the audit log after the share is deleted
+	check(c.Tokens.AuditTtl <= c.Retention, "tokens.auditTtl can't be longer than retention")
+
+	_, err = ParseRateLimits(c.RateLimit.Limits)
+	check(err == nil, "invalid rateLimit.limits: %v", err)
+	_, err = ParseRateLimits(c.RateLimit.ShareLimits)
+	check(err == nil, "invalid rateLimit.shareLimits: %v", err)
+	oneOf("rateLimit.backend", c.RateLimit.Backend, "memory", "redis")
+
+	oneOf("lockout.backend", c.Lockout.Backend, "memory", "redis")
+	check(c.Lockout.Backend != "redis" || c.RateLimit.Backend == "redis", "lockout.backend redis uses the redis of rateLimit.backend, which must be redis too")
+	check(c.Lockout.Failures > 0, "lockout.failures must be positive")
+	check(c.Lockout.Duration > 0, "lockout.duration must be positive")
+	check(c.Lockout.MaxDuration >= c.Lockout.Duration, "lockout.maxDuration can't be shorter than lockout.duration")
+
+	return errors.Join(errs...)
+}
+
+// Print writes the config as yaml, without the secrets
+func (c Config) Print(w io.Writer) error {
+	if c.Tokens.Key != "" {
+		c.Tokens.Key = "<redacted>"
+	}
+	if c.Ice.TurnSecret != "" {
+		c.Ice.TurnSecret = "<redacted>"
+	}
+	if c.StatsToken != "" {
+		c.StatsToken = "<redacted>"
+	}
+	c.Store.Dsn = redactUrl(c.Store.Dsn)
+	c.Store.Mongo.Uri = redactUrl(c.Store.Mongo.Uri)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// hides the password of a connection url, other values are returned as is
+func redactUrl(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// comma separated list flag, every Set replaces the whole list
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate of a token bucket: Burst tokens, refilled at Burst per Interval
+type Rate struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// ParseRate parses "<burst>/<interval>", like "10/1m"
+func ParseRate(s string) (Rate, error) {
+	burstStr, intervalStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected <burst>/<interval>", s)
+	}
+
+	burst, err := strconv.Atoi(burstStr)
+	if err != nil || burst <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate burst %q", burstStr)
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate interval %q", intervalStr)
+	}
+
+	return Rate{Burst: burst, Interval: interval}, nil
+}
+
+// PerToken is the time to refill one token
+func (r Rate) PerToken() time.Duration {
+	return r.Interval / time.Duration(r.Burst)
+}
+
+// RateLimits is the rate of every route, "*" is used by the routes without one
+type RateLimits map[string]Rate
+
+// ParseRateLimits parses "<route>=<rate>,...", like "files/new=10/1m,*=300/1m"
+func ParseRateLimits(s string) (RateLimits, error) {
+	limits := RateLimits{}
+	if s == "" {
+		return limits, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		route, rateStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected <route>=<rate>", entry)
+		}
+
+		rate, err := ParseRate(rateStr)
+		if err != nil {
+			return nil, err
+		}
+		limits[route] = rate
+	}
+
+	return limits, nil
+}
+
+func (l RateLimits) For(route string) (Rate, bool) {
+	if rate, ok := l[route]; ok {
+		return rate, true
+	}
+	rate, ok := l["*"]
+	return rate, ok
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		want  RateLimits
+		valid bool
+	}{
+		{"empty", "", RateLimits{}, true},
+		{"one", "files/new=10/1m", RateLimits{"files/new": {10, time.Minute}}, true},
+		{"several", "files/new=10/1m, *=300/1m", RateLimits{"files/new": {10, time.Minute}, "*": {300, time.Minute}}, true},
+		{"without rate", "files/new", nil, false},
+		{"without interval", "files/new=10", nil, false},
+		{"zero burst", "files/new=0/1m", nil, false},
+		{"negative interval", "files/new=10/-1m", nil, false},
+		{"invalid interval", "files/new=10/x", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRateLimits(tt.s)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitsFor(t *testing.T) {
+	limits := RateLimits{"files/new": {10, time.Minute}, "*": {300, time.Minute}}
+
+	if rate, ok := limits.For("files/new"); !ok || rate.Burst != 10 {
+		t.Errorf("files/new: %v %v", rate, ok)
+	}
+	if rate, ok := limits.For("stats"); !ok || rate.Burst != 300 {
+		t.Errorf("default: %v %v", rate, ok)
+	}
+	if _, ok := (RateLimits{}).For("stats"); ok {
+		t.Error("rate without limits")
+	}
+}
+
+func TestRatePerToken(t *testing.T) {
+	if got := (Rate{Burst: 10, Interval: time.Minute}).PerToken(); got != 6*time.Second {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,161 @@
+package mongoclient
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// update of a signaling doc. u uses the same keys as the mongo change stream
+// projection ("offer", "answer", "offerIce.N", "answerIce.N")
+type signalingChange struct {
+	id      primitive.ObjectID
+	filesId primitive.ObjectID
+	u       map[string]interface{}
+}
+
+type subscriber struct {
+	cb    func(change signalingChange) bool
+	mu    sync.Mutex
+	queue []signalingChange
+	// set by unsubscribe, the queued changes aren't delivered
+	stopped bool
+	wake    chan struct{}
+}
+
+// in-process pub/sub of signaling changes. Every subscriber has its own
+// goroutine and queue, so a slow websocket never blocks the publisher and
+// the changes are delivered in order
+type broadcaster struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+// cb is called for every change until it returns false or ctx is done
+func (b *broadcaster) subscribe(ctx context.Context, cb func(change signalingChange) bool) {
+	sub := &subscriber{
+		cb:   cb,
+		wake: make(chan struct{}, 1),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	if b.subs == nil {
+		b.subs = map[*subscriber]struct{}{}
+	}
+	b.subs[sub] = struct{}{}
+	activeListeners.Add(1)
+
+	go b.run(sub)
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(sub)
+	})
+}
+
+// b.mu must be held. Stops the goroutine of sub, the changes still queued
+// are dropped
+func (b *broadcaster) unsubscribe(sub *subscriber) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+
+	sub.mu.Lock()
+	sub.stopped = true
+	sub.queue = nil
+	sub.mu.Unlock()
+
+	close(sub.wake)
+	activeListeners.Add(-1)
+}
+
+// stops every subscriber
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.unsubscribe(sub)
+	}
+}
+
+func (b *broadcaster) publish(change signalingChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		sub.mu.Lock()
+		sub.queue = append(sub.queue, change)
+		sub.mu.Unlock()
+
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *broadcaster) run(sub *subscriber) {
+	for range sub.wake {
+		for {
+			sub.mu.Lock()
+			if sub.stopped {
+				sub.mu.Unlock()
+				return
+			}
+			if len(sub.queue) == 0 {
+				sub.mu.Unlock()
+				break
+			}
+			change := sub.queue[0]
+			sub.queue = sub.queue[1:]
+			sub.mu.Unlock()
+
+			if !sub.cb(change) {
+				b.mu.Lock()
+				b.unsubscribe(sub)
+				b.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (b *broadcaster) listenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool) error {
+	objId, err := primitive.ObjectIDFromHex(signalingId)
+	if err != nil {
+		return err
+	}
+
+	b.subscribe(ctx, func(change signalingChange) bool {
+		if change.id != objId {
+			return true
+		}
+		return cb(ListenSignalingEvent{U: change.u})
+	})
+	return nil
+}
+
+func (b *broadcaster) listenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool) error {
+	objId, err := primitive.ObjectIDFromHex(url)
+	if err != nil {
+		return err
+	}
+
+	b.subscribe(ctx, func(change signalingChange) bool {
+		if change.filesId != objId {
+			return true
+		}
+		return cb(ListenNewConnsEvent{Id: change.id, U: change.u})
+	})
+	return nil
+}
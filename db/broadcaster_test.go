@@ -0,0 +1,74 @@
+package mongoclient
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBroadcasterUnsubscribeDropsQueued(t *testing.T) {
+	var b broadcaster
+	defer b.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan signalingChange, 10)
+	release := make(chan struct{})
+	b.subscribe(ctx, func(change signalingChange) bool {
+		received <- change
+		<-release
+		return true
+	})
+
+	for i := range 3 {
+		b.publish(signalingChange{u: map[string]interface{}{"n": i}})
+	}
+	// the first change blocks the subscriber with the others queued
+	<-received
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.Lock()
+		n := len(b.subs)
+		b.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not unsubscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	select {
+	case change := <-received:
+		t.Errorf("received %v after unsubscribing", change.u)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBroadcasterOrder(t *testing.T) {
+	var b broadcaster
+	defer b.close()
+
+	received := make(chan int, 100)
+	b.subscribe(context.Background(), func(change signalingChange) bool {
+		received <- change.u["n"].(int)
+		return true
+	})
+
+	for i := range 100 {
+		b.publish(signalingChange{u: map[string]interface{}{"n": i}})
+	}
+	for i := range 100 {
+		select {
+		case n := <-received:
+			if n != i {
+				t.Fatalf("received %v, want %v", n, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("change %v not received", i)
+		}
+	}
+}
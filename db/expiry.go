@@ -0,0 +1,50 @@
+package mongoclient
+
+import (
+	"fmt"
+	"time"
+)
+
+// how often the stores without TTL indexes delete the expired docs
+const sweepInterval time.Duration = time.Minute
+
+// sweeper calls sweep every sweepInterval until stop is called. The expired
+// docs of the stores without TTL indexes (everything but mongo) are deleted
+// by it
+type sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startSweeper(sweep func(now time.Time) error) *sweeper {
+	s := &sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := sweep(now); err != nil {
+					fmt.Printf("sweep expired docs err: %v\n", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// waits for the running sweep
+func (s *sweeper) close() {
+	close(s.stop)
+	<-s.done
+}
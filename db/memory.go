@@ -0,0 +1,567 @@
+package mongoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore keeps every doc in memory, nothing survives a restart.
+// Useful for development and tests without a MongoDB replica set
+type MemoryStore struct {
+	mu        sync.RWMutex
+	files     map[primitive.ObjectID]*schema.FilesSchema
+	signaling map[primitive.ObjectID]*schema.SignalingSchema
+	revoked   map[string]time.Time
+	// by id
+	completions map[string]schema.CompletionSchema
+	checkpoints map[string]schema.CheckpointSchema
+	audit       []schema.AuditEventSchema
+	changes     broadcaster
+	sweeper     *sweeper
+}
+
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{
+		files:       map[primitive.ObjectID]*schema.FilesSchema{},
+		signaling:   map[primitive.ObjectID]*schema.SignalingSchema{},
+		revoked:     map[string]time.Time{},
+		completions: map[string]schema.CompletionSchema{},
+		checkpoints: map[string]schema.CheckpointSchema{},
+	}
+	m.sweeper = startSweeper(m.deleteExpired)
+	return m
+}
+
+func (m *MemoryStore) CreateFilesDoc(doc schema.FilesSchema) (*primitive.ObjectID, error) {
+	doc, err := hashPasswords(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	doc.ID = primitive.NewObjectID()
+	doc.Files = slices.Clone(doc.Files)
+
+	m.mu.Lock()
+	m.files[doc.ID] = &doc
+	m.mu.Unlock()
+
+	return &doc.ID, nil
+}
+
+func (m *MemoryStore) CreateSignalingDoc(doc schema.SignalingSchema) (*primitive.ObjectID, error) {
+	doc.ID = primitive.NewObjectID()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, ok := m.files[doc.FilesId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	doc.ExpireAt = files.ExpireAt
+	m.signaling[doc.ID] = &doc
+
+	return &doc.ID, nil
+}
+
+func (m *MemoryStore) DeleteFilesDoc(id string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.files, objId)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) SetHostSession(id string, session string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+	doc.HostSession = session
+	return nil
+}
+
+func (m *MemoryStore) HostSession(id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return "", err
+	}
+	return doc.HostSession, nil
+}
+
+func (m *MemoryStore) SwapHostSession(id string, oldSession string, newSession string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+	if doc.HostSession != oldSession {
+		return ErrNotFound
+	}
+	doc.HostSession = newSession
+	return nil
+}
+
+func (m *MemoryStore) UpdateTTL(id string, expireAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+	if doc.HostSession == "" || !doc.ExpireAt.After(time.Now()) {
+		return ErrNotFound
+	}
+
+	doc.ExpireAt = expireAt
+	for _, signaling := range m.signaling {
+		if signaling.FilesId == doc.ID {
+			signaling.ExpireAt = expireAt
+		}
+	}
+	for id, checkpoint := range m.checkpoints {
+		if checkpoint.FilesId == doc.ID {
+			checkpoint.ExpireAt = expireAt
+			m.checkpoints[id] = checkpoint
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteFilesDocOfSession(id string, session string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if doc.HostSession == session {
+		delete(m.files, doc.ID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteSignalingDoc(id string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.signaling, objId)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) IsPasswordFilesValid(id string, passwordFiles string) bool {
+	m.mu.RLock()
+	doc, err := m.filesDoc(id)
+	m.mu.RUnlock()
+	if err != nil {
+		return false
+	}
+
+	// the passwords are never updated (they are hashed by this same process,
+	// there are no plaintext docs to upgrade), so no lock is needed
+	ok, _ := verifyPassword(doc.PasswordFiles, passwordFiles)
+	return ok
+}
+
+func (m *MemoryStore) IsPasswordUserValid(url string, passwordUser string) bool {
+	m.mu.RLock()
+	doc, err := m.filesDoc(url)
+	m.mu.RUnlock()
+	if err != nil {
+		return false
+	}
+
+	ok, _ := verifyPassword(doc.PasswordUser, passwordUser)
+	return ok
+}
+
+func (m *MemoryStore) AddFiles(id string, files []schema.File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+
+	newFiles, err := addFiles(doc.Files, files)
+	if err != nil {
+		return err
+	}
+	doc.Files = newFiles
+	return nil
+}
+
+func (m *MemoryStore) GetFiles(id string) (*[]schema.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return nil, err
+	}
+
+	files := slices.Clone(doc.Files)
+	return &files, nil
+}
+
+func (m *MemoryStore) RemoveFiles(id string, files []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+
+	doc.Files = slices.DeleteFunc(doc.Files, func(f schema.File) bool {
+		return slices.Contains(files, f.Name)
+	})
+	return nil
+}
+
+func (m *MemoryStore) SetDigests(id string, digests map[string]schema.FileDigest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.filesDoc(id)
+	if err != nil {
+		return err
+	}
+
+	newFiles, err := setDigests(doc.Files, digests)
+	if err != nil {
+		return err
+	}
+	doc.Files = newFiles
+	return nil
+}
+
+func (m *MemoryStore) AddCompletion(doc schema.CompletionSchema) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.completions[doc.ID]; !ok {
+		m.completions[doc.ID] = doc
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetCompletions(filesId string) ([]schema.CompletionSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	docs := []schema.CompletionSchema{}
+	for _, doc := range m.completions {
+		if doc.FilesId == objId {
+			docs = append(docs, doc)
+		}
+	}
+	slices.SortFunc(docs, func(a, b schema.CompletionSchema) int {
+		return a.CompletedAt.Compare(b.CompletedAt)
+	})
+	return docs, nil
+}
+
+func (m *MemoryStore) SetCheckpoint(doc schema.CheckpointSchema) error {
+	doc.Chunks = slices.Clone(doc.Chunks)
+
+	m.mu.Lock()
+	m.checkpoints[doc.ID] = doc
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) GetCheckpoints(filesId string, receiver string) ([]schema.CheckpointSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	docs := []schema.CheckpointSchema{}
+	for _, doc := range m.checkpoints {
+		if doc.FilesId == objId && doc.Receiver == receiver {
+			doc.Chunks = slices.Clone(doc.Chunks)
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (m *MemoryStore) AddAuditEvent(doc schema.AuditEventSchema) error {
+	doc.ID = primitive.NewObjectID()
+	doc.Files = slices.Clone(doc.Files)
+
+	m.mu.Lock()
+	m.audit = append(m.audit, doc)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryStore) GetAuditEvents(filesId string) ([]schema.AuditEventSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	docs := []schema.AuditEventSchema{}
+	for _, doc := range m.audit {
+		if doc.FilesId == objId {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (m *MemoryStore) RevokeToken(id string, expireAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for revokedId, revokedExpireAt := range m.revoked {
+		if revokedExpireAt.Before(now) {
+			delete(m.revoked, revokedId)
+		}
+	}
+
+	m.revoked[id] = expireAt
+	return nil
+}
+
+func (m *MemoryStore) IsTokenRevoked(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.revoked[id]
+	return ok
+}
+
+func (m *MemoryStore) GetSignalingDoc(id string) (*schema.SignalingSchema, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doc, err := m.signalingDoc(id)
+	if err != nil {
+		return nil, err
+	}
+	return cloneSignaling(doc), nil
+}
+
+func (m *MemoryStore) GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	docs := []schema.SignalingSchema{}
+	for _, doc := range m.signaling {
+		if doc.FilesId == objId {
+			docs = append(docs, *cloneSignaling(doc))
+		}
+	}
+	return docs, nil
+}
+
+func (m *MemoryStore) SetSignalingField(id string, field SignalingField, value string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.signalingDoc(id)
+	if err != nil {
+		return 0, err
+	}
+
+	switch field {
+	case SignalingOffer:
+		doc.Offer = value
+	case SignalingAnswer:
+		doc.Answer = value
+	case SignalingRequest:
+		doc.Request = value
+	case SignalingStatus:
+		doc.Status = value
+	case SignalingDisconnect:
+		doc.Disconnect = value
+	case SignalingPresence:
+		doc.Presence = value
+	case SignalingProgress:
+		doc.Progress = value
+	case SignalingResume:
+		doc.Resume = value
+	case SignalingRelay:
+		doc.Relay = value
+	case SignalingRejectMsg:
+		doc.RejectMsg = value
+	default:
+		return 0, fmt.Errorf("cannot $set signaling field %q", field)
+	}
+	doc.Seq++
+
+	m.changes.publish(signalingChange{
+		id:      doc.ID,
+		filesId: doc.FilesId,
+		u:       map[string]interface{}{string(field): value, "seq": doc.Seq},
+	})
+	return doc.Seq, nil
+}
+
+func (m *MemoryStore) PushSignalingField(id string, field SignalingField, value string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := m.signalingDoc(id)
+	if err != nil {
+		return 0, err
+	}
+
+	var arr *[]string
+	switch field {
+	case SignalingOfferIce:
+		arr = &doc.OfferIce
+	case SignalingAnswerIce:
+		arr = &doc.AnswerIce
+	case SignalingMismatches:
+		arr = &doc.Mismatches
+	default:
+		return 0, fmt.Errorf("cannot $push signaling field %q", field)
+	}
+	*arr = append(*arr, value)
+	doc.Seq++
+
+	key := string(field) + "." + strconv.Itoa(len(*arr)-1)
+	m.changes.publish(signalingChange{
+		id:      doc.ID,
+		filesId: doc.FilesId,
+		u:       map[string]interface{}{key: value, "seq": doc.Seq},
+	})
+	return doc.Seq, nil
+}
+
+func (m *MemoryStore) ListenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool, onErr func(err error)) error {
+	return m.changes.listenSignaling(ctx, signalingId, cb)
+}
+
+func (m *MemoryStore) ListenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool, onErr func(err error)) error {
+	return m.changes.listenNewConns(ctx, url, cb)
+}
+
+func (m *MemoryStore) Close() error {
+	m.sweeper.close()
+	m.changes.close()
+	return nil
+}
+
+func (m *MemoryStore) deleteExpired(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, doc := range m.files {
+		if doc.ExpireAt.Before(now) {
+			delete(m.files, id)
+		}
+	}
+	for id, doc := range m.signaling {
+		if doc.ExpireAt.Before(now) {
+			delete(m.signaling, id)
+		}
+	}
+	for id, doc := range m.checkpoints {
+		if doc.ExpireAt.Before(now) {
+			delete(m.checkpoints, id)
+		}
+	}
+	for id, expireAt := range m.revoked {
+		if expireAt.Before(now) {
+			delete(m.revoked, id)
+		}
+	}
+	for id, doc := range m.completions {
+		if doc.ExpireAt.Before(now) {
+			delete(m.completions, id)
+		}
+	}
+	m.audit = slices.DeleteFunc(m.audit, func(doc schema.AuditEventSchema) bool {
+		return doc.ExpireAt.Before(now)
+	})
+	return nil
+}
+
+// m.mu must be held
+func (m *MemoryStore) filesDoc(id string) (*schema.FilesSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := m.files[objId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return doc, nil
+}
+
+// m.mu must be held
+func (m *MemoryStore) signalingDoc(id string) (*schema.SignalingSchema, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := m.signaling[objId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return doc, nil
+}
+
+func cloneSignaling(doc *schema.SignalingSchema) *schema.SignalingSchema {
+	clone := *doc
+	clone.OfferIce = slices.Clone(doc.OfferIce)
+	clone.AnswerIce = slices.Clone(doc.AnswerIce)
+	clone.Mismatches = slices.Clone(doc.Mismatches)
+	return &clone
+}
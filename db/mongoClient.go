@@ -2,10 +2,15 @@ package mongoclient
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,20 +20,16 @@ import (
 
 type MongoClient struct {
 	client *mongo.Database
+	// cancelled by Close, ends the change streams
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// const MongoURI string = "mongodb://localhost:27017"
-const MongoURI string = "mongodb://mongo:27017"
-const MongoDbName string = "webrtc-filetransfer"
-const MongoReplicaSet string = "rs0"
-const MongoLastUpdateTTL time.Duration = time.Hour * 24
-
-var Mongo MongoClient
-
-func Connect() {
-	options := options.Client().
-		ApplyURI(MongoURI).
-		SetReplicaSet(MongoReplicaSet)
+func Connect(cfg config.MongoConfig) *MongoClient {
+	options := options.Client().ApplyURI(cfg.Uri)
+	if cfg.ReplicaSet != "" {
+		options.SetReplicaSet(cfg.ReplicaSet)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
@@ -42,10 +43,35 @@ func Connect() {
 		log.Fatal("Ping to database failed")
 	}
 
-	fmt.Println("Connected to MongoDB (" + MongoURI + "/" + MongoDbName + ")")
-	Mongo = MongoClient{
-		client: client.Database(MongoDbName),
+	fmt.Println("Connected to MongoDB (" + cfg.Database + ")")
+	listenCtx, listenCancel := context.WithCancel(context.Background())
+	c := &MongoClient{
+		client: client.Database(cfg.Database),
+		ctx:    listenCtx,
+		cancel: listenCancel,
+	}
+
+	// abandoned shares, signaling docs of conns that never connected,
+	// checkpoints, revoked tokens, completions and audit events are deleted
+	// by mongo
+	for _, collName := range []string{
+		schema.FilesCollection, schema.SignalingCollection, schema.CheckpointsCollection, schema.RevokedTokensCollection,
+		schema.CompletionsCollection, schema.AuditCollection,
+	} {
+		if err := c.CreateTTLIndex(collName); err != nil {
+			log.Fatal(err)
+		}
 	}
+	return c
+}
+
+// closes the change streams and disconnects the client
+func (c *MongoClient) Close() error {
+	c.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	return c.client.Client().Disconnect(ctx)
 }
 
 func createDoc(col *mongo.Collection, doc any) (*primitive.ObjectID, error) {
@@ -58,6 +84,14 @@ func createDoc(col *mongo.Collection, doc any) (*primitive.ObjectID, error) {
 	return &objId, nil
 }
 
+// the other stores return ErrNotFound for a missing doc
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
 func deleteDoc(col *mongo.Collection, id string) error {
 	objId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -79,24 +113,52 @@ func isPasswordValid(col *mongo.Collection, id string, password string, fieldNam
 	}
 
 	filter := bson.M{
-		"_id":     objId,
-		fieldName: password,
+		"_id": objId,
 	}
+	findOptions := options.FindOne().SetProjection(bson.M{
+		fieldName: 1,
+	})
 
-	count, err := col.CountDocuments(context.TODO(), filter)
-	if err != nil {
+	var result bson.M
+	if err := col.FindOne(context.TODO(), filter, findOptions).Decode(&result); err != nil {
 		return false
 	}
 
-	return count != 0
+	stored, _ := result[fieldName].(string)
+	ok, rehash := verifyPassword(stored, password)
+	if rehash {
+		// only if it wasn't changed in the meantime
+		filter[fieldName] = stored
+		if hash, err := HashPassword(password); err == nil {
+			col.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{fieldName: hash}})
+		}
+	}
+
+	return ok
 }
 
 func (c *MongoClient) CreateFilesDoc(doc schema.FilesSchema) (*primitive.ObjectID, error) {
 	col := c.client.Collection(schema.FilesCollection)
+
+	doc, err := hashPasswords(doc)
+	if err != nil {
+		return nil, err
+	}
 	return createDoc(col, doc)
 }
 
 func (c *MongoClient) CreateSignalingDoc(doc schema.SignalingSchema) (*primitive.ObjectID, error) {
+	findOptions := options.FindOne().SetProjection(bson.M{
+		"expireAt": 1,
+	})
+
+	var files schema.FilesSchema
+	err := c.client.Collection(schema.FilesCollection).FindOne(context.TODO(), bson.M{"_id": doc.FilesId}, findOptions).Decode(&files)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	doc.ExpireAt = files.ExpireAt
+
 	col := c.client.Collection(schema.SignalingCollection)
 	return createDoc(col, doc)
 }
@@ -106,6 +168,67 @@ func (c *MongoClient) DeleteFilesDoc(id string) error {
 	return deleteDoc(col, id)
 }
 
+func (c *MongoClient) SetHostSession(id string, session string) error {
+	return c.updateHostSession(bson.M{}, id, session)
+}
+
+func (c *MongoClient) SwapHostSession(id string, oldSession string, newSession string) error {
+	return c.updateHostSession(bson.M{"hostSession": oldSession}, id, newSession)
+}
+
+func (c *MongoClient) HostSession(id string) (string, error) {
+	col := c.client.Collection(schema.FilesCollection)
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", err
+	}
+
+	findOptions := options.FindOne().SetProjection(bson.M{
+		"hostSession": 1,
+		"_id":         0,
+	})
+
+	var result struct {
+		HostSession string `bson:"hostSession"`
+	}
+	if err := col.FindOne(context.TODO(), bson.M{"_id": objId}, findOptions).Decode(&result); err != nil {
+		return "", notFound(err)
+	}
+	return result.HostSession, nil
+}
+
+func (c *MongoClient) updateHostSession(filter bson.M, id string, session string) error {
+	col := c.client.Collection(schema.FilesCollection)
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	filter["_id"] = objId
+
+	res, err := col.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"hostSession": session}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *MongoClient) DeleteFilesDocOfSession(id string, session string) error {
+	col := c.client.Collection(schema.FilesCollection)
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = col.DeleteOne(context.TODO(), bson.M{"_id": objId, "hostSession": session})
+	return err
+}
+
 func (c *MongoClient) DeleteSignalingDoc(id string) error {
 	col := c.client.Collection(schema.SignalingCollection)
 	return deleteDoc(col, id)
@@ -121,7 +244,7 @@ func (c *MongoClient) IsPasswordUserValid(url string, passwordUser string) bool
 	return isPasswordValid(col, url, passwordUser, "passwordUser")
 }
 
-func (c *MongoClient) AddFiles(id string, passwordFiles string, file []schema.File) error {
+func (c *MongoClient) AddFiles(id string, file []schema.File) error {
 	col := c.client.Collection(schema.FilesCollection)
 
 	objId, err := primitive.ObjectIDFromHex(id)
@@ -129,9 +252,31 @@ func (c *MongoClient) AddFiles(id string, passwordFiles string, file []schema.Fi
 		return err
 	}
 
+	// the conflicts within file aren't caught by the filter
+	if _, err := addFiles(nil, file); err != nil {
+		return err
+	}
+
+	// the names and their directories, and the names as a directory
+	var taken []string
+	var quoted []string
+	for _, f := range file {
+		taken = append(taken, f.Name)
+		taken = append(taken, schema.ParentDirs(f.Name)...)
+		quoted = append(quoted, regexp.QuoteMeta(f.Name))
+	}
+
+	// only matches while none of the names conflicts with a shared file and
+	// the chunks of the share stay under the limit
 	filter := bson.M{
-		"_id":           objId,
-		"passwordFiles": passwordFiles,
+		"_id": objId,
+		"files.name": bson.M{
+			"$nin": taken,
+			"$not": primitive.Regex{Pattern: "^(?:" + strings.Join(quoted, "|") + ")/"},
+		},
+		"$expr": bson.M{
+			"$lte": bson.A{shareChunksExpr(nil), schema.MaxShareDigestChunks - schema.DigestChunks(file)},
+		},
 	}
 	update := bson.M{
 		"$push": bson.M{
@@ -141,7 +286,48 @@ func (c *MongoClient) AddFiles(id string, passwordFiles string, file []schema.Fi
 		},
 	}
 
-	return col.FindOneAndUpdate(context.TODO(), filter, update).Err()
+	res, err := col.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	// the reason the filter didn't match
+	current, err := c.GetFiles(id)
+	if err != nil {
+		return err
+	}
+	if _, err := addFiles(*current, file); err != nil {
+		return err
+	}
+	// the conflicting files were removed after the update
+	return ErrFileExists
+}
+
+// the number of chunk hashes of the files of the doc, replaced has the number
+// of the files (by name) that are going to change
+func shareChunksExpr(replaced map[string]int) bson.M {
+	var chunks interface{} = bson.M{
+		"$size": bson.M{"$ifNull": bson.A{"$$f.digest.chunks", bson.A{}}},
+	}
+	if len(replaced) != 0 {
+		var branches bson.A
+		for name, n := range replaced {
+			branches = append(branches, bson.M{
+				"case": bson.M{"$eq": bson.A{"$$f.name", name}},
+				"then": n,
+			})
+		}
+		chunks = bson.M{"$switch": bson.M{"branches": branches, "default": chunks}}
+	}
+
+	return bson.M{
+		"$sum": bson.M{
+			"$map": bson.M{"input": "$files", "as": "f", "in": chunks},
+		},
+	}
 }
 
 func (c *MongoClient) GetFiles(id string) (*[]schema.File, error) {
@@ -166,13 +352,13 @@ func (c *MongoClient) GetFiles(id string) (*[]schema.File, error) {
 
 	errResult := col.FindOne(context.TODO(), filter, findOptions).Decode(&result)
 	if errResult != nil {
-		return nil, errResult
+		return nil, notFound(errResult)
 	}
 
 	return &result.Files, nil
 }
 
-func (c *MongoClient) RemoveFiles(id string, passwordFiles string, files []string) error {
+func (c *MongoClient) RemoveFiles(id string, files []string) error {
 	col := c.client.Collection(schema.FilesCollection)
 
 	objId, err := primitive.ObjectIDFromHex(id)
@@ -181,8 +367,7 @@ func (c *MongoClient) RemoveFiles(id string, passwordFiles string, files []strin
 	}
 
 	filter := bson.M{
-		"_id":           objId,
-		"passwordFiles": passwordFiles,
+		"_id": objId,
 	}
 
 	update := bson.M{
@@ -195,42 +380,310 @@ func (c *MongoClient) RemoveFiles(id string, passwordFiles string, files []strin
 		},
 	}
 
-	return col.FindOneAndUpdate(context.TODO(), filter, update).Err()
+	return notFound(col.FindOneAndUpdate(context.TODO(), filter, update).Err())
 }
 
-func (c *MongoClient) UpdateSignalingDoc(id string, update bson.M) error {
-	col := c.client.Collection(schema.SignalingCollection)
+func (c *MongoClient) SetDigests(id string, digests map[string]schema.FileDigest) error {
+	col := c.client.Collection(schema.FilesCollection)
 
 	objId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return err
 	}
+	if len(digests) == 0 {
+		return nil
+	}
 
+	// one array filter per file, the names can't be used as identifiers
+	set := bson.M{}
+	var arrayFilters []interface{}
+	replaced := map[string]int{}
+	for name, digest := range digests {
+		identifier := "f" + strconv.Itoa(len(arrayFilters))
+		set["files.$["+identifier+"].digest"] = digest
+		arrayFilters = append(arrayFilters, bson.M{identifier + ".name": name})
+		replaced[name] = len(digest.Chunks)
+	}
+
+	// only matches while the chunks of the share stay under the limit
 	filter := bson.M{
 		"_id": objId,
+		"$expr": bson.M{
+			"$lte": bson.A{shareChunksExpr(replaced), schema.MaxShareDigestChunks},
+		},
+	}
+	updateOptions := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: arrayFilters,
+	})
+
+	res, err := col.UpdateOne(context.TODO(), filter, bson.M{"$set": set}, updateOptions)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	if _, err := c.GetFiles(id); err != nil {
+		return err
+	}
+	return ErrTooManyChunks
+}
+
+func (c *MongoClient) AddCompletion(doc schema.CompletionSchema) error {
+	col := c.client.Collection(schema.CompletionsCollection)
+
+	_, err := col.InsertOne(context.TODO(), doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// already recorded
+		return nil
+	}
+	return err
+}
+
+func (c *MongoClient) GetCompletions(filesId string) ([]schema.CompletionSchema, error) {
+	col := c.client.Collection(schema.CompletionsCollection)
+
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.M{"completedAt": 1})
+	cursor, err := col.Find(context.TODO(), bson.M{"filesId": objId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []schema.CompletionSchema{}
+	if err := cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
 	}
+	return docs, nil
+}
+
+func (c *MongoClient) SetCheckpoint(doc schema.CheckpointSchema) error {
+	col := c.client.Collection(schema.CheckpointsCollection)
 
-	return col.FindOneAndUpdate(context.TODO(), filter, update).Err()
+	replaceOptions := options.Replace().SetUpsert(true)
+	_, err := col.ReplaceOne(context.TODO(), bson.M{"_id": doc.ID}, doc, replaceOptions)
+	return err
 }
 
-func listenFor[T any](c *MongoClient, pipeline mongo.Pipeline, cb func(changes T) bool) error {
+func (c *MongoClient) GetCheckpoints(filesId string, receiver string) ([]schema.CheckpointSchema, error) {
+	col := c.client.Collection(schema.CheckpointsCollection)
+
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := col.Find(context.TODO(), bson.M{"filesId": objId, "receiver": receiver})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []schema.CheckpointSchema{}
+	if err := cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (c *MongoClient) AddAuditEvent(doc schema.AuditEventSchema) error {
+	col := c.client.Collection(schema.AuditCollection)
+
+	doc.ID = primitive.NewObjectID()
+	_, err := col.InsertOne(context.TODO(), doc)
+	return err
+}
+
+func (c *MongoClient) GetAuditEvents(filesId string) ([]schema.AuditEventSchema, error) {
+	col := c.client.Collection(schema.AuditCollection)
+
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := col.Find(context.TODO(), bson.M{"filesId": objId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []schema.AuditEventSchema{}
+	if err := cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (c *MongoClient) RevokeToken(id string, expireAt time.Time) error {
+	col := c.client.Collection(schema.RevokedTokensCollection)
+
+	_, err := col.InsertOne(context.TODO(), schema.RevokedTokenSchema{
+		ID:       id,
+		ExpireAt: expireAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// already revoked
+		return nil
+	}
+	return err
+}
+
+func (c *MongoClient) IsTokenRevoked(id string) bool {
+	col := c.client.Collection(schema.RevokedTokensCollection)
+
+	filter := bson.M{
+		"_id": id,
+	}
+
+	count, err := col.CountDocuments(context.TODO(), filter)
+	// fail closed, a token can't be used if the deny-list can't be read
+	return err != nil || count != 0
+}
+
+func (c *MongoClient) GetSignalingDoc(id string) (*schema.SignalingSchema, error) {
+	col := c.client.Collection(schema.SignalingCollection)
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc schema.SignalingSchema
+	if err := col.FindOne(context.TODO(), bson.M{"_id": objId}).Decode(&doc); err != nil {
+		return nil, notFound(err)
+	}
+	return &doc, nil
+}
+
+func (c *MongoClient) GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error) {
 	col := c.client.Collection(schema.SignalingCollection)
 
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := col.Find(context.TODO(), bson.M{"filesId": objId})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []schema.SignalingSchema{}
+	if err := cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (c *MongoClient) SetSignalingField(id string, field SignalingField, value string) (int64, error) {
+	return c.updateSignalingSeq(id, bson.M{
+		"$set": bson.M{
+			string(field): value,
+		},
+	})
+}
+
+func (c *MongoClient) PushSignalingField(id string, field SignalingField, value string) (int64, error) {
+	return c.updateSignalingSeq(id, bson.M{
+		"$push": bson.M{
+			string(field): value,
+		},
+	})
+}
+
+// applies update and bumps the seq of the doc in the same update, so the
+// change stream event includes it
+func (c *MongoClient) updateSignalingSeq(id string, update bson.M) (int64, error) {
+	col := c.client.Collection(schema.SignalingCollection)
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return 0, err
+	}
+
+	update["$inc"] = bson.M{"seq": int64(1)}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"seq": 1})
+
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err = col.FindOneAndUpdate(context.TODO(), bson.M{"_id": objId}, update, opts).Decode(&doc)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	return doc.Seq, nil
+}
+
+// backoff of the change stream reopen attempts, doubled by each one
+const (
+	listenMinBackoff  time.Duration = time.Millisecond * 500
+	listenMaxBackoff  time.Duration = time.Second * 30
+	listenMaxAttempts int           = 8
+	// a stream open this long starts the attempts over, even without changes
+	listenStableAfter time.Duration = time.Minute
+)
+
+// calls cb with every change until it returns false. If the stream fails it
+// is reopened after the last change received (ResumeAfter), onErr is only
+// called if that's impossible (the oplog no longer has it, or every attempt
+// failed). The stream is closed when ctx is done or the client is closed
+func listenFor[T any](c *MongoClient, ctx context.Context, pipeline mongo.Pipeline, cb func(changes T) bool, onErr func(err error)) error {
+	col := c.client.Collection(schema.SignalingCollection)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.ctx, cancel)
+
 	watchOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
 
-	changeStream, err := col.Watch(context.TODO(), pipeline, watchOptions)
+	changeStream, err := col.Watch(ctx, pipeline, watchOptions)
 	if err != nil {
+		stop()
+		cancel()
 		return err
 	}
 
+	activeListeners.Add(1)
 	go func() {
-		for changeStream.Next(context.TODO()) {
-			var changeEvent T
-			if err := changeStream.Decode(&changeEvent); err != nil {
+		defer activeListeners.Add(-1)
+		defer cancel()
+		defer stop()
+
+		var retry streamRetry
+		opened := time.Now()
+		for {
+			received, stopped, err := readStream(ctx, changeStream, cb)
+			retry.streamEnded(received, time.Since(opened), changeStream.ResumeToken())
+			changeStream.Close(context.Background())
+			if stopped || ctx.Err() != nil {
 				return
 			}
-			if !cb(changeEvent) {
-				return
+
+			for {
+				backoff, ok := retry.next(err)
+				if !ok {
+					onErr(fmt.Errorf("change stream lost: %v", err))
+					return
+				}
+				log.Printf("change stream: %v, reopening in %v\n", err, backoff)
+
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+
+				changeStream, err = col.Watch(ctx, pipeline, retry.watchOptions())
+				if err == nil {
+					opened = time.Now()
+					break
+				}
 			}
 		}
 	}()
@@ -238,12 +691,82 @@ func listenFor[T any](c *MongoClient, pipeline mongo.Pipeline, cb func(changes T
 	return nil
 }
 
-type ListenSignalingEvent struct {
-	U map[string]interface{} `bson:"u" json:"u"`
+// the reopen attempts of a change stream that failed
+type streamRetry struct {
+	// failed attempts since the last stream that received a change or
+	// stayed open listenStableAfter
+	attempt int
+	// of the last change received (or of the last stream position), the
+	// stream is reopened after it. Kept when a stream fails without one
+	resumeToken bson.Raw
+}
+
+// a stream ended, after receiving changes or not and being open for open.
+// resumeToken is its current one, nil if it has none
+func (r *streamRetry) streamEnded(received bool, open time.Duration, resumeToken bson.Raw) {
+	// an idle stream that stayed up isn't a failed attempt, only the ones
+	// failing right after being reopened are
+	if received || open >= listenStableAfter {
+		r.attempt = 0
+	}
+	if resumeToken != nil {
+		r.resumeToken = resumeToken
+	}
+}
+
+// the wait before the next attempt after err, false if the stream can't be
+// reopened (the oplog no longer has the resume token, or every attempt failed)
+func (r *streamRetry) next(err error) (backoff time.Duration, ok bool) {
+	if isFatalStreamError(err) || r.attempt >= listenMaxAttempts {
+		return 0, false
+	}
+
+	backoff = min(listenMinBackoff<<r.attempt, listenMaxBackoff)
+	r.attempt++
+	return backoff, true
+}
+
+// the options of the reopened stream, after the resume token if any
+func (r *streamRetry) watchOptions() *options.ChangeStreamOptions {
+	watchOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if r.resumeToken != nil {
+		watchOptions.SetResumeAfter(r.resumeToken)
+	}
+	return watchOptions
+}
+
+// received is true if at least one change was read, stopped if cb returned false
+func readStream[T any](ctx context.Context, changeStream *mongo.ChangeStream, cb func(changes T) bool) (received bool, stopped bool, err error) {
+	for changeStream.Next(ctx) {
+		received = true
+
+		var changeEvent T
+		if err := changeStream.Decode(&changeEvent); err != nil {
+			// only this change is lost
+			log.Printf("change stream: invalid change: %v\n", err)
+			continue
+		}
+		if !cb(changeEvent) {
+			return received, true, nil
+		}
+	}
+	return received, false, changeStream.Err()
+}
+
+// the changes since the resume token are gone, reopening won't recover them
+func isFatalStreamError(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	return serverErr.HasErrorLabel("NonResumableChangeStreamError") ||
+		serverErr.HasErrorCode(286) || // ChangeStreamHistoryLost
+		serverErr.HasErrorCode(280) || // ChangeStreamFatalError
+		serverErr.HasErrorCode(260) // InvalidResumeToken
 }
 
 // listend to signaling doc with the _id equal to the signalingId
-func (c *MongoClient) ListenSignaling(signalingId string, cb func(changes ListenSignalingEvent) bool) error {
+func (c *MongoClient) ListenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool, onErr func(err error)) error {
 	objId, err := primitive.ObjectIDFromHex(signalingId)
 	if err != nil {
 		return err
@@ -297,16 +820,11 @@ func (c *MongoClient) ListenSignaling(signalingId string, cb func(changes Listen
 		},
 	}
 
-	return listenFor(c, pipeline, cb)
-}
-
-type ListenNewConnsEvent struct {
-	Id primitive.ObjectID     `bson:"id" json:"id"`
-	U  map[string]interface{} `bson:"u" json:"u"`
+	return listenFor(c, ctx, pipeline, cb, onErr)
 }
 
 // listens for new signaling docs with the filesId equal to the objId
-func (c *MongoClient) ListenNewConns(url string, cb func(changes ListenNewConnsEvent) bool) error {
+func (c *MongoClient) ListenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool, onErr func(err error)) error {
 	objId, err := primitive.ObjectIDFromHex(url)
 	if err != nil {
 		return err
@@ -362,11 +880,11 @@ func (c *MongoClient) ListenNewConns(url string, cb func(changes ListenNewConnsE
 		},
 	}
 
-	return listenFor(c, pipeline, cb)
+	return listenFor(c, ctx, pipeline, cb, onErr)
 }
 
 func (c *MongoClient) ListenFor(pipeline mongo.Pipeline, cb func(changes bson.M) bool) {
-	if err := listenFor(c, mongo.Pipeline{
+	if err := listenFor(c, context.Background(), mongo.Pipeline{
 		bson.D{
 			{
 				Key: "$match", Value: bson.M{
@@ -374,57 +892,106 @@ func (c *MongoClient) ListenFor(pipeline mongo.Pipeline, cb func(changes bson.M)
 				},
 			},
 		},
-	}, cb); err != nil {
+	}, cb, func(err error) {
+		fmt.Printf("err3: %v\n", err)
+	}); err != nil {
 		fmt.Printf("err3: %v\n", err)
 	}
 }
 
-// func (c *MongoClient) CreateTTLIndex(collName string) error {
-// 	collection := c.client.Collection(collName)
-// 	ttlIndexName := "files_1day_ttl"
-
-// 	// if existent, do not create
-// 	indexes, errIndexes := collection.Indexes().List(context.TODO(), nil)
-// 	if errIndexes != nil {
-// 		return errIndexes
-// 	}
-// 	for indexes.Next(context.TODO()) {
-// 		var idx bson.M
-// 		indexes.Decode(&idx)
-
-// 		if idx["name"] != nil && idx["name"] == ttlIndexName {
-// 			return nil
-// 		}
-// 	}
-
-// 	// doesn't exist, Create.
-// 	indexModel := mongo.IndexModel{
-// 		Keys:    bson.M{"expireAt": 1},
-// 		Options: options.Index().SetExpireAfterSeconds(0).SetName("files_1day_ttl"),
-// 	}
-
-// 	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
-// 	if err != nil {
-// 		return fmt.Errorf("could not create TTL index: %v", err)
-// 	}
-// 	return nil
-// }
-
-// func (c *MongoClient) UpdateTTL(collName string, documentID string, duration time.Duration) error {
-// 	collection := c.client.Collection(collName)
-
-// 	objectID, err := primitive.ObjectIDFromHex(documentID)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	filter := bson.M{"_id": objectID}
-// 	update := bson.M{
-// 		"$set": bson.M{
-// 			"expireAt": time.Now().Add(duration),
-// 		},
-// 	}
-
-// 	_, err = collection.UpdateOne(context.TODO(), filter, update)
-// 	return err
-// }
+// the docs of collName are deleted by mongo once their expireAt is reached
+// (checked about every minute). Creating it again is a no-op, and an index on
+// expireAt created with another name (or options) is reused
+func (c *MongoClient) CreateTTLIndex(collName string) error {
+	collection := c.client.Collection(collName)
+
+	existing, err := expireAtIndex(collection)
+	if err != nil {
+		return fmt.Errorf("could not list the indexes of %v: %v", collName, err)
+	}
+
+	if existing == nil {
+		indexModel := mongo.IndexModel{
+			Keys:    bson.M{"expireAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0).SetName("expireAt_ttl"),
+		}
+
+		_, err = collection.Indexes().CreateOne(context.TODO(), indexModel)
+		if err != nil {
+			return fmt.Errorf("could not create TTL index of %v: %v", collName, err)
+		}
+		return nil
+	}
+
+	if existing.ExpireAfterSeconds != nil && *existing.ExpireAfterSeconds == 0 {
+		return nil
+	}
+	// makes it a TTL index, or changes its delay
+	command := bson.D{
+		{Key: "collMod", Value: collName},
+		{Key: "index", Value: bson.M{"name": existing.Name, "expireAfterSeconds": 0}},
+	}
+	if err := c.client.RunCommand(context.TODO(), command).Err(); err != nil {
+		return fmt.Errorf("could not make %v a TTL index of %v: %v", existing.Name, collName, err)
+	}
+	return nil
+}
+
+type indexSpec struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+}
+
+// the single field index on expireAt, nil if there's none
+func expireAtIndex(collection *mongo.Collection) (*indexSpec, error) {
+	cursor, err := collection.Indexes().List(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []indexSpec
+	if err := cursor.All(context.TODO(), &indexes); err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0].Key == "expireAt" {
+			return &index, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *MongoClient) UpdateTTL(id string, expireAt time.Time) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"_id":         objId,
+		"hostSession": bson.M{"$exists": true, "$ne": ""},
+		"expireAt":    bson.M{"$gt": time.Now()},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"expireAt": expireAt,
+		},
+	}
+
+	res, err := c.client.Collection(schema.FilesCollection).UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	for _, collName := range []string{schema.SignalingCollection, schema.CheckpointsCollection} {
+		if _, err := c.client.Collection(collName).UpdateMany(context.TODO(), bson.M{"filesId": objId}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
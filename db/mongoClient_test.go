@@ -0,0 +1,179 @@
+package mongoclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestStreamRetryBackoff(t *testing.T) {
+	var retry streamRetry
+	err := errors.New("connection reset")
+
+	want := []time.Duration{
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}
+	for i, want := range want {
+		backoff, ok := retry.next(err)
+		if !ok || backoff != want {
+			t.Errorf("attempt %v: backoff %v (%v), want %v", i, backoff, ok, want)
+		}
+	}
+
+	if _, ok := retry.next(err); ok {
+		t.Errorf("attempt %v allowed, max %v", listenMaxAttempts, listenMaxAttempts)
+	}
+
+	// a stream that received changes starts over
+	retry.streamEnded(true, 0, nil)
+	if backoff, ok := retry.next(err); !ok || backoff != listenMinBackoff {
+		t.Errorf("after a change: backoff %v (%v), want %v", backoff, ok, listenMinBackoff)
+	}
+}
+
+// an idle stream lost at every failover is reopened every time
+func TestStreamRetryIdle(t *testing.T) {
+	var retry streamRetry
+	err := errors.New("connection reset")
+
+	for i := range 3 * listenMaxAttempts {
+		backoff, ok := retry.next(err)
+		if !ok || backoff != listenMinBackoff {
+			t.Fatalf("reopen %v: backoff %v (%v), want %v", i, backoff, ok, listenMinBackoff)
+		}
+		retry.streamEnded(false, listenStableAfter, nil)
+	}
+
+	// the ones failing right after being reopened are still counted
+	for range listenMaxAttempts {
+		retry.next(err)
+		retry.streamEnded(false, time.Second, nil)
+	}
+	if _, ok := retry.next(err); ok {
+		t.Errorf("attempt %v allowed, max %v", listenMaxAttempts, listenMaxAttempts)
+	}
+}
+
+func TestStreamRetryFatal(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		fatal bool
+	}{
+		{"network", errors.New("connection reset"), false},
+		{"resumable server error", mongo.CommandError{Code: 43, Name: "CursorNotFound"}, false},
+		{"history lost", mongo.CommandError{Code: 286, Name: "ChangeStreamHistoryLost"}, true},
+		{"fatal", mongo.CommandError{Code: 280, Name: "ChangeStreamFatalError"}, true},
+		{"invalid resume token", mongo.CommandError{Code: 260, Name: "InvalidResumeToken"}, true},
+		{"wrapped", fmt.Errorf("watch: %w", mongo.CommandError{Code: 286}), true},
+		{"non resumable label", mongo.CommandError{Code: 1, Labels: []string{"NonResumableChangeStreamError"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var retry streamRetry
+			if _, ok := retry.next(tt.err); ok == tt.fatal {
+				t.Errorf("retried %v, want %v", ok, !tt.fatal)
+			}
+		})
+	}
+}
+
+// the stream is reopened after the last known resume token, even if the
+// streams opened since then failed without one
+func TestStreamRetryResumeToken(t *testing.T) {
+	var retry streamRetry
+	if got := retry.watchOptions().ResumeAfter; got != nil {
+		t.Errorf("resume after %v without a token", got)
+	}
+
+	first, _ := bson.Marshal(bson.M{"_data": "first"})
+	second, _ := bson.Marshal(bson.M{"_data": "second"})
+
+	steps := []struct {
+		name  string
+		token bson.Raw
+		want  bson.Raw
+	}{
+		{"first change", first, first},
+		{"failed without token", nil, first},
+		{"next change", second, second},
+		{"failed again", nil, second},
+	}
+	for _, step := range steps {
+		retry.streamEnded(step.token != nil, 0, step.token)
+		got, _ := retry.watchOptions().ResumeAfter.(bson.Raw)
+		if !bytes.Equal(got, step.want) {
+			t.Errorf("%v: resume after %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+// the changes made after the change stream was killed are still received
+func TestMongoListenerKilled(t *testing.T) {
+	uri := os.Getenv(testMongoUriEnv)
+	if uri == "" {
+		t.Skipf("%v not set", testMongoUriEnv)
+	}
+	store := Connect(config.MongoConfig{Uri: uri, Database: "webrtc_test"})
+	defer store.Close()
+
+	signalingId := createSignalingDoc(t, store, createFilesDoc(t, store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan receivedChange, 100)
+	err := store.ListenSignaling(ctx, signalingId, func(event ListenSignalingEvent) bool {
+		for _, change := range receivedChanges("", event.U) {
+			changes <- change
+		}
+		return true
+	}, func(err error) {
+		t.Errorf("listener stopped: %v", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.SetSignalingField(signalingId, SignalingOffer, "before"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, changes, 1)
+
+	// kills the cursor of the stream, and its getMore waiting for changes
+	err = store.client.Client().Database("admin").RunCommand(context.Background(), bson.D{{Key: "killAllSessions", Value: bson.A{}}}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []receivedChange
+	for i := range 3 {
+		value := fmt.Sprint("after", i)
+		if _, err := store.SetSignalingField(signalingId, SignalingOffer, value); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, receivedChange{string(SignalingOffer), value, int64(i + 2)})
+	}
+
+	received := receive(t, changes, len(want))
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("change %v: got %v, want %v", i, received[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mongoclient
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters of the new hashes (OWASP recommendation)
+const (
+	argon2Memory  uint32 = 19 * 1024
+	argon2Time    uint32 = 2
+	argon2Threads uint8  = 1
+	argon2KeyLen  uint32 = 32
+	argon2SaltLen int    = 16
+)
+
+const argon2Prefix string = "$argon2id$"
+
+// HashPassword returns the password hashed with argon2id and a random salt,
+// encoded like $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// verifyPassword compares password with the stored hash in constant time.
+// Docs created before the passwords were hashed store them in plaintext,
+// rehash is true when the stored value is plaintext or uses old parameters
+// and should be replaced with HashPassword(password)
+func verifyPassword(stored string, password string) (ok bool, rehash bool) {
+	if !strings.HasPrefix(stored, argon2Prefix) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	ok = subtle.ConstantTimeCompare(hash, computed) == 1
+
+	outdated := memory != argon2Memory || time != argon2Time || threads != argon2Threads
+	return ok, ok && outdated
+}
+
+// replaces the plaintext passwords of the doc with their hashes
+func hashPasswords(doc schema.FilesSchema) (schema.FilesSchema, error) {
+	passwordUser, err := HashPassword(doc.PasswordUser)
+	if err != nil {
+		return doc, err
+	}
+	passwordFiles, err := HashPassword(doc.PasswordFiles)
+	if err != nil {
+		return doc, err
+	}
+
+	doc.PasswordUser = passwordUser
+	doc.PasswordFiles = passwordFiles
+	return doc, nil
+}
@@ -0,0 +1,870 @@
+package mongoclient
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const postgresChannel string = "signaling_changes"
+
+// the rows of signaling_changes are read by the listeners right after their
+// notification, or when the listener reconnects
+const postgresChangesTtl time.Duration = time.Minute
+
+// held by the transaction of every migration, the replicas started at the
+// same time would apply them concurrently. The key is arbitrary, only used
+// for the migrations
+const postgresMigrationLock = `SELECT pg_advisory_xact_lock(7283514093)`
+
+// a seq is taken when the change is inserted, but the transactions commit
+// in any order: a change committed after a higher seq is read on reconnect
+// if its seq is at most this far below the last one published
+const postgresCatchUpWindow = 1000
+
+var postgresMigrations = []string{
+	`CREATE TABLE files (
+		id             TEXT PRIMARY KEY,
+		password_user  TEXT NOT NULL,
+		password_files TEXT NOT NULL,
+		files          JSONB NOT NULL DEFAULT '[]',
+		expire_at      TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE signaling (
+		id         TEXT PRIMARY KEY,
+		files_id   TEXT NOT NULL,
+		offer      TEXT NOT NULL DEFAULT '',
+		offer_ice  TEXT[] NOT NULL DEFAULT '{}',
+		answer     TEXT NOT NULL DEFAULT '',
+		answer_ice TEXT[] NOT NULL DEFAULT '{}'
+	);
+	CREATE INDEX signaling_files_id ON signaling (files_id);`,
+
+	`CREATE TABLE revoked_tokens (
+		id        TEXT PRIMARY KEY,
+		expire_at TIMESTAMPTZ NOT NULL
+	);`,
+
+	`ALTER TABLE signaling ADD COLUMN request TEXT NOT NULL DEFAULT '';
+	ALTER TABLE signaling ADD COLUMN status TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN host_session TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN disconnect TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN presence TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN progress TEXT NOT NULL DEFAULT '';
+	CREATE TABLE completions (
+		id           TEXT PRIMARY KEY,
+		files_id     TEXT NOT NULL,
+		signaling_id TEXT NOT NULL,
+		receiver     TEXT NOT NULL,
+		file         TEXT NOT NULL,
+		length       BIGINT NOT NULL,
+		completed_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX completions_files_id ON completions (files_id);`,
+
+	`CREATE TABLE audit_events (
+		id           TEXT PRIMARY KEY,
+		files_id     TEXT NOT NULL,
+		type         TEXT NOT NULL,
+		at           TIMESTAMPTZ NOT NULL,
+		signaling_id TEXT NOT NULL DEFAULT '',
+		peer_name    TEXT NOT NULL DEFAULT '',
+		peer_network TEXT NOT NULL DEFAULT '',
+		peer_local   BOOLEAN NOT NULL,
+		files        JSONB NOT NULL DEFAULT '[]',
+		detail       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_events_files_id ON audit_events (files_id, at);`,
+
+	`ALTER TABLE signaling ADD COLUMN expire_at TIMESTAMPTZ NOT NULL DEFAULT 'epoch';
+	UPDATE signaling SET expire_at = files.expire_at FROM files WHERE files.id = signaling.files_id;
+	CREATE INDEX files_expire_at ON files (expire_at);
+	CREATE INDEX signaling_expire_at ON signaling (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN mismatches TEXT[] NOT NULL DEFAULT '{}';`,
+
+	`ALTER TABLE signaling ADD COLUMN resume TEXT NOT NULL DEFAULT '';
+	CREATE TABLE checkpoints (
+		id         TEXT PRIMARY KEY,
+		files_id   TEXT NOT NULL,
+		receiver   TEXT NOT NULL,
+		file       TEXT NOT NULL,
+		chunk_size BIGINT NOT NULL,
+		chunks     JSONB NOT NULL DEFAULT '[]',
+		updated_at TIMESTAMPTZ NOT NULL,
+		expire_at  TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX checkpoints_receiver ON checkpoints (files_id, receiver);
+	CREATE INDEX checkpoints_expire_at ON checkpoints (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN relay TEXT NOT NULL DEFAULT '';`,
+
+	`CREATE TABLE signaling_changes (
+		seq          BIGSERIAL PRIMARY KEY,
+		signaling_id TEXT NOT NULL,
+		files_id     TEXT NOT NULL,
+		key          TEXT NOT NULL,
+		value        TEXT NOT NULL,
+		doc_seq      BIGINT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX signaling_changes_created_at ON signaling_changes (created_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE signaling ADD COLUMN reject_msg TEXT NOT NULL DEFAULT '';`,
+
+	// the rows already there are kept for the default retention (30 days)
+	`ALTER TABLE completions ADD COLUMN expire_at TIMESTAMPTZ;
+	UPDATE completions SET expire_at = completed_at + interval '30 days';
+	ALTER TABLE completions ALTER COLUMN expire_at SET NOT NULL;
+	CREATE INDEX completions_expire_at ON completions (expire_at);
+	ALTER TABLE audit_events ADD COLUMN expire_at TIMESTAMPTZ;
+	UPDATE audit_events SET expire_at = at + interval '30 days';
+	ALTER TABLE audit_events ALTER COLUMN expire_at SET NOT NULL;
+	CREATE INDEX audit_events_expire_at ON audit_events (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN secret TEXT NOT NULL DEFAULT '';`,
+}
+
+// PostgresStore stores the files and signaling docs in PostgreSQL. Every
+// signaling update is announced with NOTIFY, so all the replicas connected
+// to the same database receive it (like the mongo change streams)
+type PostgresStore struct {
+	db      *sql.DB
+	dsn     string
+	changes broadcaster
+	sweeper *sweeper
+	// cancelled by Close, stops the listener
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func ConnectPostgres(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if db.PingContext(ctx) != nil {
+		db.Close()
+		return nil, errors.New("ping to database failed")
+	}
+
+	if err := migrate(db, postgresMigrations, postgresMigrationLock); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate postgres database: %v", err)
+	}
+
+	listenCtx, listenCancel := context.WithCancel(context.Background())
+	p := &PostgresStore{
+		db:     db,
+		dsn:    dsn,
+		ctx:    listenCtx,
+		cancel: listenCancel,
+	}
+	go p.listen()
+	p.sweeper = startSweeper(p.deleteExpired)
+
+	fmt.Println("Connected to PostgreSQL")
+	return p, nil
+}
+
+func (p *PostgresStore) CreateFilesDoc(doc schema.FilesSchema) (*primitive.ObjectID, error) {
+	doc, err := hashPasswords(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := json.Marshal(nonNil(doc.Files))
+	if err != nil {
+		return nil, err
+	}
+
+	objId := primitive.NewObjectID()
+	_, err = p.db.Exec(
+		`INSERT INTO files (id, password_user, password_files, files, expire_at) VALUES ($1, $2, $3, $4, $5)`,
+		objId.Hex(), doc.PasswordUser, doc.PasswordFiles, string(files), doc.ExpireAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objId, nil
+}
+
+func (p *PostgresStore) CreateSignalingDoc(doc schema.SignalingSchema) (*primitive.ObjectID, error) {
+	objId := primitive.NewObjectID()
+	res, err := p.db.Exec(
+		`INSERT INTO signaling (id, files_id, expire_at, secret) SELECT $1, id, expire_at, $3 FROM files WHERE id = $2`,
+		objId.Hex(), doc.FilesId.Hex(), doc.Secret,
+	)
+	if err := affectedOne(res, err); err != nil {
+		return nil, err
+	}
+
+	return &objId, nil
+}
+
+func (p *PostgresStore) DeleteFilesDoc(id string) error {
+	_, err := p.db.Exec(`DELETE FROM files WHERE id = $1`, id)
+	return err
+}
+
+func (p *PostgresStore) SetHostSession(id string, session string) error {
+	res, err := p.db.Exec(`UPDATE files SET host_session = $1 WHERE id = $2`, session, id)
+	return affectedOne(res, err)
+}
+
+func (p *PostgresStore) SwapHostSession(id string, oldSession string, newSession string) error {
+	res, err := p.db.Exec(
+		`UPDATE files SET host_session = $1 WHERE id = $2 AND host_session = $3`,
+		newSession, id, oldSession,
+	)
+	return affectedOne(res, err)
+}
+
+func (p *PostgresStore) HostSession(id string) (string, error) {
+	var session string
+	err := p.db.QueryRow(`SELECT host_session FROM files WHERE id = $1`, id).Scan(&session)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return session, err
+}
+
+func (p *PostgresStore) UpdateTTL(id string, expireAt time.Time) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE files SET expire_at = $1 WHERE id = $2 AND host_session != '' AND expire_at > now()`,
+		expireAt, id,
+	)
+	if err := affectedOne(res, err); err != nil {
+		return err
+	}
+	for _, table := range []string{"signaling", "checkpoints"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET expire_at = $1 WHERE files_id = $2`, expireAt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresStore) DeleteFilesDocOfSession(id string, session string) error {
+	_, err := p.db.Exec(`DELETE FROM files WHERE id = $1 AND host_session = $2`, id, session)
+	return err
+}
+
+func (p *PostgresStore) DeleteSignalingDoc(id string) error {
+	_, err := p.db.Exec(`DELETE FROM signaling WHERE id = $1`, id)
+	return err
+}
+
+func (p *PostgresStore) IsPasswordFilesValid(id string, passwordFiles string) bool {
+	return p.isPasswordValid(id, passwordFiles, "password_files")
+}
+
+func (p *PostgresStore) IsPasswordUserValid(url string, passwordUser string) bool {
+	return p.isPasswordValid(url, passwordUser, "password_user")
+}
+
+func (p *PostgresStore) AddFiles(id string, files []schema.File) error {
+	return p.updateFiles(id, func(current []schema.File) ([]schema.File, error) {
+		return addFiles(current, files)
+	})
+}
+
+func (p *PostgresStore) GetFiles(id string) (*[]schema.File, error) {
+	var filesJson string
+	err := p.db.QueryRow(`SELECT files FROM files WHERE id = $1`, id).Scan(&filesJson)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []schema.File
+	if err := json.Unmarshal([]byte(filesJson), &files); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+func (p *PostgresStore) RemoveFiles(id string, files []string) error {
+	res, err := p.db.Exec(
+		`UPDATE files SET files = COALESCE(
+			(SELECT jsonb_agg(f) FROM jsonb_array_elements(files) f WHERE NOT (f->>'name' = ANY($1))),
+			'[]'
+		) WHERE id = $2`,
+		files, id,
+	)
+	return affectedOne(res, err)
+}
+
+func (p *PostgresStore) SetDigests(id string, digests map[string]schema.FileDigest) error {
+	return p.updateFiles(id, func(current []schema.File) ([]schema.File, error) {
+		return setDigests(current, digests)
+	})
+}
+
+// the row is locked until the update is done
+func (p *PostgresStore) updateFiles(id string, update func([]schema.File) ([]schema.File, error)) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var filesJson string
+	err = tx.QueryRow(`SELECT files FROM files WHERE id = $1 FOR UPDATE`, id).Scan(&filesJson)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var files []schema.File
+	if err := json.Unmarshal([]byte(filesJson), &files); err != nil {
+		return err
+	}
+
+	updated, err := update(files)
+	if err != nil {
+		return err
+	}
+	newFiles, err := json.Marshal(nonNil(updated))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET files = $1 WHERE id = $2`, string(newFiles), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresStore) AddCompletion(doc schema.CompletionSchema) error {
+	_, err := p.db.Exec(
+		`INSERT INTO completions (id, files_id, signaling_id, receiver, file, length, completed_at, expire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`,
+		doc.ID, doc.FilesId.Hex(), doc.SignalingId.Hex(), doc.Receiver, doc.File, int64(doc.Length), doc.CompletedAt, doc.ExpireAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) GetCompletions(filesId string) ([]schema.CompletionSchema, error) {
+	rows, err := p.db.Query(
+		`SELECT id, files_id, signaling_id, receiver, file, length, completed_at
+		FROM completions WHERE files_id = $1 ORDER BY completed_at`, filesId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.CompletionSchema{}
+	for rows.Next() {
+		var doc schema.CompletionSchema
+		var docFilesId, signalingId string
+		var length int64
+		if err := rows.Scan(&doc.ID, &docFilesId, &signalingId, &doc.Receiver, &doc.File, &length, &doc.CompletedAt); err != nil {
+			return nil, err
+		}
+		if doc.FilesId, err = primitive.ObjectIDFromHex(docFilesId); err != nil {
+			return nil, err
+		}
+		if doc.SignalingId, err = primitive.ObjectIDFromHex(signalingId); err != nil {
+			return nil, err
+		}
+		doc.Length = uint64(length)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (p *PostgresStore) SetCheckpoint(doc schema.CheckpointSchema) error {
+	chunks, err := json.Marshal(nonNil(doc.Chunks))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(
+		`INSERT INTO checkpoints (id, files_id, receiver, file, chunk_size, chunks, updated_at, expire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET chunk_size = excluded.chunk_size, chunks = excluded.chunks,
+			updated_at = excluded.updated_at, expire_at = excluded.expire_at`,
+		doc.ID, doc.FilesId.Hex(), doc.Receiver, doc.File, int64(doc.ChunkSize), string(chunks),
+		doc.UpdatedAt, doc.ExpireAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) GetCheckpoints(filesId string, receiver string) ([]schema.CheckpointSchema, error) {
+	rows, err := p.db.Query(
+		`SELECT id, files_id, receiver, file, chunk_size, chunks, updated_at, expire_at
+		FROM checkpoints WHERE files_id = $1 AND receiver = $2`, filesId, receiver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.CheckpointSchema{}
+	for rows.Next() {
+		var doc schema.CheckpointSchema
+		var docFilesId, chunks string
+		var chunkSize int64
+		if err := rows.Scan(&doc.ID, &docFilesId, &doc.Receiver, &doc.File, &chunkSize, &chunks, &doc.UpdatedAt, &doc.ExpireAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(chunks), &doc.Chunks); err != nil {
+			return nil, err
+		}
+		doc.FilesId, _ = primitive.ObjectIDFromHex(docFilesId)
+		doc.ChunkSize = uint64(chunkSize)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (p *PostgresStore) AddAuditEvent(doc schema.AuditEventSchema) error {
+	files, err := json.Marshal(nonNil(doc.Files))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(
+		`INSERT INTO audit_events (id, files_id, type, at, signaling_id, peer_name, peer_network, peer_local, files, detail, expire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		primitive.NewObjectID().Hex(), doc.FilesId.Hex(), doc.Type, doc.At, doc.SignalingId,
+		doc.Peer.Name, doc.Peer.Network, doc.Peer.Local, string(files), doc.Detail, doc.ExpireAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) GetAuditEvents(filesId string) ([]schema.AuditEventSchema, error) {
+	rows, err := p.db.Query(
+		`SELECT id, files_id, type, at, signaling_id, peer_name, peer_network, peer_local, files, detail
+		FROM audit_events WHERE files_id = $1 ORDER BY at, id`, filesId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.AuditEventSchema{}
+	for rows.Next() {
+		var doc schema.AuditEventSchema
+		var id, docFilesId, files string
+		err := rows.Scan(&id, &docFilesId, &doc.Type, &doc.At, &doc.SignalingId,
+			&doc.Peer.Name, &doc.Peer.Network, &doc.Peer.Local, &files, &doc.Detail)
+		if err != nil {
+			return nil, err
+		}
+		if doc.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		if doc.FilesId, err = primitive.ObjectIDFromHex(docFilesId); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(files), &doc.Files); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (p *PostgresStore) RevokeToken(id string, expireAt time.Time) error {
+	if _, err := p.db.Exec(`DELETE FROM revoked_tokens WHERE expire_at < now()`); err != nil {
+		return err
+	}
+
+	_, err := p.db.Exec(
+		`INSERT INTO revoked_tokens (id, expire_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		id, expireAt,
+	)
+	return err
+}
+
+func (p *PostgresStore) IsTokenRevoked(id string) bool {
+	var one int
+	err := p.db.QueryRow(`SELECT 1 FROM revoked_tokens WHERE id = $1`, id).Scan(&one)
+	// fail closed, a token can't be used if the deny-list can't be read
+	return !errors.Is(err, sql.ErrNoRows)
+}
+
+const postgresSignalingColumns = `id, files_id, offer, offer_ice, answer, answer_ice, request, status, disconnect, presence, progress, expire_at, mismatches, resume, relay, seq, reject_msg, secret`
+
+func (p *PostgresStore) GetSignalingDoc(id string) (*schema.SignalingSchema, error) {
+	row := p.db.QueryRow(`SELECT `+postgresSignalingColumns+` FROM signaling WHERE id = $1`, id)
+
+	doc, err := scanPostgresSignaling(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return doc, err
+}
+
+func (p *PostgresStore) GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error) {
+	rows, err := p.db.Query(`SELECT `+postgresSignalingColumns+` FROM signaling WHERE files_id = $1`, filesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.SignalingSchema{}
+	for rows.Next() {
+		doc, err := scanPostgresSignaling(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *doc)
+	}
+	return docs, rows.Err()
+}
+
+// NOTIFY payloads are limited to 8000 bytes (an sdp can be bigger), so every
+// update appends the change to signaling_changes and notifies its seq
+func (p *PostgresStore) SetSignalingField(id string, field SignalingField, value string) (int64, error) {
+	var column string
+	switch field {
+	case SignalingOffer:
+		column = "offer"
+	case SignalingAnswer:
+		column = "answer"
+	case SignalingRequest:
+		column = "request"
+	case SignalingStatus:
+		column = "status"
+	case SignalingDisconnect:
+		column = "disconnect"
+	case SignalingPresence:
+		column = "presence"
+	case SignalingProgress:
+		column = "progress"
+	case SignalingResume:
+		column = "resume"
+	case SignalingRelay:
+		column = "relay"
+	case SignalingRejectMsg:
+		column = "reject_msg"
+	default:
+		return 0, fmt.Errorf("cannot $set signaling field %q", field)
+	}
+
+	var seq int64
+	err := p.db.QueryRow(
+		`WITH updated AS (
+			UPDATE signaling SET `+column+` = $1, seq = seq + 1 WHERE id = $2 RETURNING id, files_id, seq
+		), change AS (
+			INSERT INTO signaling_changes (signaling_id, files_id, key, value, doc_seq)
+			SELECT id, files_id, $4, $1, seq FROM updated RETURNING seq, doc_seq
+		)
+		SELECT doc_seq FROM (
+			SELECT doc_seq, pg_notify($3, seq::text) FROM change
+		) notified`,
+		value, id, postgresChannel, string(field),
+	).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return seq, err
+}
+
+func (p *PostgresStore) PushSignalingField(id string, field SignalingField, value string) (int64, error) {
+	var column string
+	switch field {
+	case SignalingOfferIce:
+		column = "offer_ice"
+	case SignalingAnswerIce:
+		column = "answer_ice"
+	case SignalingMismatches:
+		column = "mismatches"
+	default:
+		return 0, fmt.Errorf("cannot $push signaling field %q", field)
+	}
+
+	// the key uses the 0-based index, like the mongo change stream projection
+	var seq int64
+	err := p.db.QueryRow(
+		`WITH updated AS (
+			UPDATE signaling SET `+column+` = array_append(`+column+`, $1), seq = seq + 1 WHERE id = $2
+			RETURNING id, files_id, cardinality(`+column+`) AS length, seq
+		), change AS (
+			INSERT INTO signaling_changes (signaling_id, files_id, key, value, doc_seq)
+			SELECT id, files_id, $4::text || '.' || (length - 1), $1, seq FROM updated RETURNING seq, doc_seq
+		)
+		SELECT doc_seq FROM (
+			SELECT doc_seq, pg_notify($3, seq::text) FROM change
+		) notified`,
+		value, id, postgresChannel, string(field),
+	).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return seq, err
+}
+
+func (p *PostgresStore) ListenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool, onErr func(err error)) error {
+	return p.changes.listenSignaling(ctx, signalingId, cb)
+}
+
+func (p *PostgresStore) ListenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool, onErr func(err error)) error {
+	return p.changes.listenNewConns(ctx, url, cb)
+}
+
+// keeps a dedicated connection LISTENing to the signaling channel and
+// republishes every notification to the local listeners. The changes
+// notified while it reconnects are read from signaling_changes, from a
+// window below the last one it published
+func (p *PostgresStore) listen() {
+	published := newPublishedSeqs()
+	for {
+		err := p.listenConn(p.ctx, published)
+		if p.ctx.Err() != nil {
+			return
+		}
+		log.Printf("postgres listener: %v, reconnecting\n", err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PostgresStore) Close() error {
+	p.sweeper.close()
+	p.cancel()
+	p.changes.close()
+	return p.db.Close()
+}
+
+func (p *PostgresStore) deleteExpired(now time.Time) error {
+	for _, table := range []string{"files", "signaling", "checkpoints", "revoked_tokens", "completions", "audit_events"} {
+		if _, err := p.db.Exec(`DELETE FROM `+table+` WHERE expire_at < $1`, now); err != nil {
+			return err
+		}
+	}
+	_, err := p.db.Exec(`DELETE FROM signaling_changes WHERE created_at < $1`, now.Add(-postgresChangesTtl))
+	return err
+}
+
+func (p *PostgresStore) listenConn(ctx context.Context, published *publishedSeqs) error {
+	conn, err := pgx.Connect(ctx, p.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+postgresChannel); err != nil {
+		return err
+	}
+
+	// the changes read after the LISTEN may be notified too, published skips
+	// them
+	if published.last < 0 {
+		// nobody was listening before, only the next changes are published
+		err = p.skipExisting(ctx, published)
+	} else {
+		err = p.catchUp(ctx, published)
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		seq, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			log.Printf("postgres listener: invalid payload %q\n", notification.Payload)
+			continue
+		}
+		if published.has(seq) {
+			continue
+		}
+
+		var change postgresChange
+		err = p.db.QueryRowContext(ctx, `SELECT `+postgresChangeColumns+` FROM signaling_changes WHERE seq = $1`, seq).
+			Scan(&change.seq, &change.id, &change.filesId, &change.key, &change.value, &change.docSeq)
+		if err != nil {
+			log.Printf("postgres listener: change %v: %v\n", seq, err)
+			continue
+		}
+		p.publishChange(change)
+		published.add(seq)
+	}
+}
+
+// publishes the changes of the window below the last one published and the
+// ones after it, skipping the ones already published
+func (p *PostgresStore) catchUp(ctx context.Context, published *publishedSeqs) error {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+postgresChangeColumns+` FROM signaling_changes WHERE seq > $1 ORDER BY seq`, published.last-postgresCatchUpWindow)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change postgresChange
+		if err := rows.Scan(&change.seq, &change.id, &change.filesId, &change.key, &change.value, &change.docSeq); err != nil {
+			return err
+		}
+		if published.has(change.seq) {
+			continue
+		}
+		p.publishChange(change)
+		published.add(change.seq)
+	}
+	return rows.Err()
+}
+
+// adds the changes already in signaling_changes to published, so they are
+// never published
+func (p *PostgresStore) skipExisting(ctx context.Context, published *publishedSeqs) error {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT seq FROM signaling_changes WHERE seq > (SELECT COALESCE(MAX(seq), 0) FROM signaling_changes) - $1`,
+		postgresCatchUpWindow,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// added once all are read, until then it's still the first LISTEN
+	var seqs []int64
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return err
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	published.last = 0
+	for _, seq := range seqs {
+		published.add(seq)
+	}
+	return nil
+}
+
+// seqs of the changes published by the listener, kept across reconnects.
+// Only the ones in the catch up window below last are remembered, older ones
+// count as published
+type publishedSeqs struct {
+	// highest seq published, -1 until the first LISTEN
+	last int64
+	seqs map[int64]bool
+}
+
+func newPublishedSeqs() *publishedSeqs {
+	return &publishedSeqs{last: -1, seqs: map[int64]bool{}}
+}
+
+func (p *publishedSeqs) has(seq int64) bool {
+	return seq <= p.last-postgresCatchUpWindow || p.seqs[seq]
+}
+
+func (p *publishedSeqs) add(seq int64) {
+	p.seqs[seq] = true
+	p.last = max(p.last, seq)
+
+	// forgets the ones out of the window, not on every add
+	if len(p.seqs) > 2*postgresCatchUpWindow {
+		for seq := range p.seqs {
+			if seq <= p.last-postgresCatchUpWindow {
+				delete(p.seqs, seq)
+			}
+		}
+	}
+}
+
+const postgresChangeColumns = `seq, signaling_id, files_id, key, value, doc_seq`
+
+// row of signaling_changes, docSeq is the seq of the signaling doc after the
+// update
+type postgresChange struct {
+	seq     int64
+	id      string
+	filesId string
+	key     string
+	value   string
+	docSeq  int64
+}
+
+func (p *PostgresStore) publishChange(change postgresChange) {
+	objId, _ := primitive.ObjectIDFromHex(change.id)
+	filesObjId, _ := primitive.ObjectIDFromHex(change.filesId)
+	p.changes.publish(signalingChange{
+		id:      objId,
+		filesId: filesObjId,
+		u:       map[string]interface{}{change.key: change.value, "seq": change.docSeq},
+	})
+}
+
+// upgrades the stored password to a hash if verifyPassword asks for it
+func (p *PostgresStore) isPasswordValid(id string, password string, column string) bool {
+	var stored string
+	if p.db.QueryRow(`SELECT `+column+` FROM files WHERE id = $1`, id).Scan(&stored) != nil {
+		return false
+	}
+
+	ok, rehash := verifyPassword(stored, password)
+	if rehash {
+		// only if it wasn't changed in the meantime
+		if hash, err := HashPassword(password); err == nil {
+			p.db.Exec(`UPDATE files SET `+column+` = $1 WHERE id = $2 AND `+column+` = $3`, hash, id, stored)
+		}
+	}
+
+	return ok
+}
+
+// row is a *sql.Row or *sql.Rows of the postgresSignalingColumns
+func scanPostgresSignaling(row interface{ Scan(dest ...any) error }) (*schema.SignalingSchema, error) {
+	var doc schema.SignalingSchema
+	var id, filesId string
+	// database/sql can't scan postgres arrays by itself
+	m := pgtype.NewMap()
+	if err := row.Scan(&id, &filesId, &doc.Offer, m.SQLScanner(&doc.OfferIce), &doc.Answer, m.SQLScanner(&doc.AnswerIce), &doc.Request, &doc.Status, &doc.Disconnect, &doc.Presence, &doc.Progress, &doc.ExpireAt, m.SQLScanner(&doc.Mismatches), &doc.Resume, &doc.Relay, &doc.Seq, &doc.RejectMsg, &doc.Secret); err != nil {
+		return nil, err
+	}
+
+	doc.ID, _ = primitive.ObjectIDFromHex(id)
+	doc.FilesId, _ = primitive.ObjectIDFromHex(filesId)
+	return &doc, nil
+}
@@ -0,0 +1,154 @@
+package mongoclient
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// the changes made while the listener reconnects are read from
+// signaling_changes once it's back
+func TestPostgresListenerReconnect(t *testing.T) {
+	dsn := os.Getenv(testPostgresDsnEnv)
+	if dsn == "" {
+		t.Skipf("%v not set", testPostgresDsnEnv)
+	}
+	store, err := ConnectPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	signalingId := createSignalingDoc(t, store, createFilesDoc(t, store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan receivedChange, 100)
+	err = store.ListenSignaling(ctx, signalingId, func(event ListenSignalingEvent) bool {
+		for _, change := range receivedChanges("", event.U) {
+			changes <- change
+		}
+		return true
+	}, func(err error) {
+		t.Errorf("listener stopped: %v", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// the listener waits a second before reconnecting
+	_, err = store.db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE query = 'LISTEN ` + postgresChannel + `'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var want []receivedChange
+	for i := range 3 {
+		value := fmt.Sprint("offer", i)
+		if _, err := store.SetSignalingField(signalingId, SignalingOffer, value); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, receivedChange{string(SignalingOffer), value, int64(i + 1)})
+	}
+
+	received := receive(t, changes, len(want))
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("change %v: got %v, want %v", i, received[i], want[i])
+		}
+	}
+}
+
+// the replicas started at the same time apply every migration once
+func TestPostgresMigrateConcurrent(t *testing.T) {
+	dsn := os.Getenv(testPostgresDsnEnv)
+	if dsn == "" {
+		t.Skipf("%v not set", testPostgresDsnEnv)
+	}
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// an empty schema, the tables of the other tests are already migrated
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RuntimeParams["search_path"] = schema
+
+	const replicas = 5
+	errs := make(chan error, replicas)
+	for range replicas {
+		go func() {
+			db := stdlib.OpenDB(*config)
+			defer db.Close()
+			errs <- migrate(db, postgresMigrations, postgresMigrationLock)
+		}()
+	}
+	for range replicas {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	var applied int
+	if err := admin.QueryRow(`SELECT COUNT(*) FROM ` + schema + `.schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(postgresMigrations) {
+		t.Errorf("%v migrations applied, want %v", applied, len(postgresMigrations))
+	}
+}
+
+// a change committed after a higher seq is published once, if it's in the
+// window below the last one
+func TestPublishedSeqs(t *testing.T) {
+	published := newPublishedSeqs()
+	published.last = 0
+
+	steps := []struct {
+		name string
+		seq  int64
+		// has before adding it
+		has bool
+	}{
+		{"first", 10, false},
+		{"again", 10, true},
+		{"committed after a higher one", 5, false},
+		{"far ahead", 10 + postgresCatchUpWindow, false},
+		{"in the window", 11, false},
+		{"below the window", 10, true},
+		{"never published below the window", 9, true},
+	}
+
+	for _, step := range steps {
+		if got := published.has(step.seq); got != step.has {
+			t.Errorf("%v: has %v, want %v", step.name, got, step.has)
+		}
+		published.add(step.seq)
+	}
+
+	// the old ones are forgotten
+	for seq := range int64(2 * postgresCatchUpWindow) {
+		published.add(published.last + 1 + seq)
+	}
+	if len(published.seqs) > 2*postgresCatchUpWindow {
+		t.Errorf("%v seqs remembered", len(published.seqs))
+	}
+}
@@ -0,0 +1,89 @@
+package mongoclient
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// helpers shared by the sql backends (sqlite, postgres)
+
+// applies the pending migrations, each one in its own transaction. lock, if
+// not empty, is run first in every transaction so the replicas started at
+// the same time apply them one at a time
+func migrate(db *sql.DB, migrations []string, lock string) error {
+	for {
+		applied, err := migrateNext(db, migrations, lock)
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// applies the first pending migration, the version is read under the lock so
+// a migration applied by another replica in the meantime isn't applied again
+func migrateNext(db *sql.DB, migrations []string, lock string) (applied bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if lock != "" {
+		if _, err := tx.Exec(lock); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return false, err
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return false, err
+	}
+	if version >= len(migrations) {
+		return false, tx.Commit()
+	}
+
+	if _, err := tx.Exec(migrations[version]); err != nil {
+		return false, fmt.Errorf("migration %d: %v", version+1, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (` + strconv.Itoa(version+1) + `)`); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Printf("Applied migration %d\n", version+1)
+	return true, nil
+}
+
+func exists(db *sql.DB, query string, args ...any) bool {
+	var one int
+	return db.QueryRow(query, args...).Scan(&one) == nil
+}
+
+// so an empty list is stored as [] instead of null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// ErrNotFound if no row was changed
+func affectedOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
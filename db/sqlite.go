@@ -0,0 +1,661 @@
+package mongoclient
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+const SqliteDefaultPath string = "webrtc-filetransfer.db"
+
+// every entry is applied once, in order, and recorded in schema_migrations.
+// Never edit an entry that was already released, append a new one instead
+var sqliteMigrations = []string{
+	`CREATE TABLE files (
+		id             TEXT PRIMARY KEY,
+		password_user  TEXT NOT NULL,
+		password_files TEXT NOT NULL,
+		files          TEXT NOT NULL DEFAULT '[]',
+		expire_at      INTEGER NOT NULL
+	);
+	CREATE TABLE signaling (
+		id         TEXT PRIMARY KEY,
+		files_id   TEXT NOT NULL,
+		offer      TEXT NOT NULL DEFAULT '',
+		offer_ice  TEXT NOT NULL DEFAULT '[]',
+		answer     TEXT NOT NULL DEFAULT '',
+		answer_ice TEXT NOT NULL DEFAULT '[]'
+	);
+	CREATE INDEX signaling_files_id ON signaling (files_id);`,
+
+	`CREATE TABLE revoked_tokens (
+		id        TEXT PRIMARY KEY,
+		expire_at INTEGER NOT NULL
+	);`,
+
+	`ALTER TABLE signaling ADD COLUMN request TEXT NOT NULL DEFAULT '';
+	ALTER TABLE signaling ADD COLUMN status TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN host_session TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN disconnect TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN presence TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN progress TEXT NOT NULL DEFAULT '';
+	CREATE TABLE completions (
+		id           TEXT PRIMARY KEY,
+		files_id     TEXT NOT NULL,
+		signaling_id TEXT NOT NULL,
+		receiver     TEXT NOT NULL,
+		file         TEXT NOT NULL,
+		length       INTEGER NOT NULL,
+		completed_at INTEGER NOT NULL
+	);
+	CREATE INDEX completions_files_id ON completions (files_id);`,
+
+	`CREATE TABLE audit_events (
+		id           TEXT PRIMARY KEY,
+		files_id     TEXT NOT NULL,
+		type         TEXT NOT NULL,
+		at           INTEGER NOT NULL,
+		signaling_id TEXT NOT NULL DEFAULT '',
+		peer_name    TEXT NOT NULL DEFAULT '',
+		peer_network TEXT NOT NULL DEFAULT '',
+		peer_local   INTEGER NOT NULL,
+		files        TEXT NOT NULL DEFAULT '[]',
+		detail       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_events_files_id ON audit_events (files_id, at);`,
+
+	`ALTER TABLE signaling ADD COLUMN expire_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE signaling SET expire_at = COALESCE((SELECT expire_at FROM files WHERE files.id = signaling.files_id), 0);
+	CREATE INDEX files_expire_at ON files (expire_at);
+	CREATE INDEX signaling_expire_at ON signaling (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN mismatches TEXT NOT NULL DEFAULT '[]';`,
+
+	`ALTER TABLE signaling ADD COLUMN resume TEXT NOT NULL DEFAULT '';
+	CREATE TABLE checkpoints (
+		id         TEXT PRIMARY KEY,
+		files_id   TEXT NOT NULL,
+		receiver   TEXT NOT NULL,
+		file       TEXT NOT NULL,
+		chunk_size INTEGER NOT NULL,
+		chunks     TEXT NOT NULL DEFAULT '[]',
+		updated_at INTEGER NOT NULL,
+		expire_at  INTEGER NOT NULL
+	);
+	CREATE INDEX checkpoints_receiver ON checkpoints (files_id, receiver);
+	CREATE INDEX checkpoints_expire_at ON checkpoints (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN relay TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE signaling ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE signaling ADD COLUMN reject_msg TEXT NOT NULL DEFAULT '';`,
+
+	// the rows already there are kept for the default retention (30 days)
+	`ALTER TABLE completions ADD COLUMN expire_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE completions SET expire_at = completed_at / 1000 + 2592000;
+	CREATE INDEX completions_expire_at ON completions (expire_at);
+	ALTER TABLE audit_events ADD COLUMN expire_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE audit_events SET expire_at = at / 1000 + 2592000;
+	CREATE INDEX audit_events_expire_at ON audit_events (expire_at);`,
+
+	`ALTER TABLE signaling ADD COLUMN secret TEXT NOT NULL DEFAULT '';`,
+}
+
+// SqliteStore stores the files and signaling docs in a single SQLite file.
+// Changes are only notified to listeners of the same process
+type SqliteStore struct {
+	db      *sql.DB
+	changes broadcaster
+	sweeper *sweeper
+}
+
+func ConnectSqlite(path string) (*SqliteStore, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db, sqliteMigrations, ""); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate sqlite database: %v", err)
+	}
+
+	fmt.Println("Connected to SQLite (" + path + ")")
+	s := &SqliteStore{
+		db: db,
+	}
+	s.sweeper = startSweeper(s.deleteExpired)
+	return s, nil
+}
+
+func (s *SqliteStore) CreateFilesDoc(doc schema.FilesSchema) (*primitive.ObjectID, error) {
+	doc, err := hashPasswords(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := json.Marshal(nonNil(doc.Files))
+	if err != nil {
+		return nil, err
+	}
+
+	objId := primitive.NewObjectID()
+	_, err = s.db.Exec(
+		`INSERT INTO files (id, password_user, password_files, files, expire_at) VALUES (?, ?, ?, ?, ?)`,
+		objId.Hex(), doc.PasswordUser, doc.PasswordFiles, string(files), doc.ExpireAt.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objId, nil
+}
+
+func (s *SqliteStore) CreateSignalingDoc(doc schema.SignalingSchema) (*primitive.ObjectID, error) {
+	objId := primitive.NewObjectID()
+	res, err := s.db.Exec(
+		`INSERT INTO signaling (id, files_id, expire_at, secret) SELECT ?, id, expire_at, ? FROM files WHERE id = ?`,
+		objId.Hex(), doc.Secret, doc.FilesId.Hex(),
+	)
+	if err := affectedOne(res, err); err != nil {
+		return nil, err
+	}
+
+	return &objId, nil
+}
+
+func (s *SqliteStore) DeleteFilesDoc(id string) error {
+	_, err := s.db.Exec(`DELETE FROM files WHERE id = ?`, id)
+	return err
+}
+
+func (s *SqliteStore) SetHostSession(id string, session string) error {
+	res, err := s.db.Exec(`UPDATE files SET host_session = ? WHERE id = ?`, session, id)
+	return affectedOne(res, err)
+}
+
+func (s *SqliteStore) SwapHostSession(id string, oldSession string, newSession string) error {
+	res, err := s.db.Exec(
+		`UPDATE files SET host_session = ? WHERE id = ? AND host_session = ?`,
+		newSession, id, oldSession,
+	)
+	return affectedOne(res, err)
+}
+
+func (s *SqliteStore) HostSession(id string) (string, error) {
+	var session string
+	err := s.db.QueryRow(`SELECT host_session FROM files WHERE id = ?`, id).Scan(&session)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return session, err
+}
+
+func (s *SqliteStore) UpdateTTL(id string, expireAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE files SET expire_at = ? WHERE id = ? AND host_session != '' AND expire_at > ?`,
+		expireAt.Unix(), id, time.Now().Unix(),
+	)
+	if err := affectedOne(res, err); err != nil {
+		return err
+	}
+	for _, table := range []string{"signaling", "checkpoints"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET expire_at = ? WHERE files_id = ?`, expireAt.Unix(), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) DeleteFilesDocOfSession(id string, session string) error {
+	_, err := s.db.Exec(`DELETE FROM files WHERE id = ? AND host_session = ?`, id, session)
+	return err
+}
+
+func (s *SqliteStore) DeleteSignalingDoc(id string) error {
+	_, err := s.db.Exec(`DELETE FROM signaling WHERE id = ?`, id)
+	return err
+}
+
+func (s *SqliteStore) IsPasswordFilesValid(id string, passwordFiles string) bool {
+	return s.isPasswordValid(id, passwordFiles, "password_files")
+}
+
+func (s *SqliteStore) IsPasswordUserValid(url string, passwordUser string) bool {
+	return s.isPasswordValid(url, passwordUser, "password_user")
+}
+
+func (s *SqliteStore) AddFiles(id string, files []schema.File) error {
+	return s.updateFiles(id, func(current []schema.File) ([]schema.File, error) {
+		return addFiles(current, files)
+	})
+}
+
+func (s *SqliteStore) GetFiles(id string) (*[]schema.File, error) {
+	var filesJson string
+	err := s.db.QueryRow(`SELECT files FROM files WHERE id = ?`, id).Scan(&filesJson)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []schema.File
+	if err := json.Unmarshal([]byte(filesJson), &files); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+func (s *SqliteStore) RemoveFiles(id string, files []string) error {
+	return s.updateFiles(id, func(current []schema.File) ([]schema.File, error) {
+		return slices.DeleteFunc(current, func(f schema.File) bool {
+			return slices.Contains(files, f.Name)
+		}), nil
+	})
+}
+
+func (s *SqliteStore) SetDigests(id string, digests map[string]schema.FileDigest) error {
+	return s.updateFiles(id, func(current []schema.File) ([]schema.File, error) {
+		return setDigests(current, digests)
+	})
+}
+
+func (s *SqliteStore) AddCompletion(doc schema.CompletionSchema) error {
+	_, err := s.db.Exec(
+		`INSERT INTO completions (id, files_id, signaling_id, receiver, file, length, completed_at, expire_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		doc.ID, doc.FilesId.Hex(), doc.SignalingId.Hex(), doc.Receiver, doc.File, doc.Length, doc.CompletedAt.UnixMilli(), doc.ExpireAt.Unix(),
+	)
+	return err
+}
+
+func (s *SqliteStore) GetCompletions(filesId string) ([]schema.CompletionSchema, error) {
+	rows, err := s.db.Query(
+		`SELECT id, files_id, signaling_id, receiver, file, length, completed_at
+		FROM completions WHERE files_id = ? ORDER BY completed_at`, filesId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.CompletionSchema{}
+	for rows.Next() {
+		var doc schema.CompletionSchema
+		var docFilesId, signalingId string
+		var completedAt int64
+		if err := rows.Scan(&doc.ID, &docFilesId, &signalingId, &doc.Receiver, &doc.File, &doc.Length, &completedAt); err != nil {
+			return nil, err
+		}
+		if doc.FilesId, err = primitive.ObjectIDFromHex(docFilesId); err != nil {
+			return nil, err
+		}
+		if doc.SignalingId, err = primitive.ObjectIDFromHex(signalingId); err != nil {
+			return nil, err
+		}
+		doc.CompletedAt = time.UnixMilli(completedAt)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) SetCheckpoint(doc schema.CheckpointSchema) error {
+	chunks, err := json.Marshal(nonNil(doc.Chunks))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO checkpoints (id, files_id, receiver, file, chunk_size, chunks, updated_at, expire_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET chunk_size = excluded.chunk_size, chunks = excluded.chunks,
+			updated_at = excluded.updated_at, expire_at = excluded.expire_at`,
+		doc.ID, doc.FilesId.Hex(), doc.Receiver, doc.File, int64(doc.ChunkSize), string(chunks),
+		doc.UpdatedAt.UnixMilli(), doc.ExpireAt.Unix(),
+	)
+	return err
+}
+
+func (s *SqliteStore) GetCheckpoints(filesId string, receiver string) ([]schema.CheckpointSchema, error) {
+	rows, err := s.db.Query(
+		`SELECT id, files_id, receiver, file, chunk_size, chunks, updated_at, expire_at
+		FROM checkpoints WHERE files_id = ? AND receiver = ?`, filesId, receiver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.CheckpointSchema{}
+	for rows.Next() {
+		var doc schema.CheckpointSchema
+		var docFilesId, chunks string
+		var chunkSize, updatedAt, expireAt int64
+		if err := rows.Scan(&doc.ID, &docFilesId, &doc.Receiver, &doc.File, &chunkSize, &chunks, &updatedAt, &expireAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(chunks), &doc.Chunks); err != nil {
+			return nil, err
+		}
+		doc.FilesId, _ = primitive.ObjectIDFromHex(docFilesId)
+		doc.ChunkSize = uint64(chunkSize)
+		doc.UpdatedAt = time.UnixMilli(updatedAt)
+		doc.ExpireAt = time.Unix(expireAt, 0)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) AddAuditEvent(doc schema.AuditEventSchema) error {
+	files, err := json.Marshal(nonNil(doc.Files))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO audit_events (id, files_id, type, at, signaling_id, peer_name, peer_network, peer_local, files, detail, expire_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		primitive.NewObjectID().Hex(), doc.FilesId.Hex(), doc.Type, doc.At.UnixMilli(), doc.SignalingId,
+		doc.Peer.Name, doc.Peer.Network, doc.Peer.Local, string(files), doc.Detail, doc.ExpireAt.Unix(),
+	)
+	return err
+}
+
+func (s *SqliteStore) GetAuditEvents(filesId string) ([]schema.AuditEventSchema, error) {
+	rows, err := s.db.Query(
+		`SELECT id, files_id, type, at, signaling_id, peer_name, peer_network, peer_local, files, detail
+		FROM audit_events WHERE files_id = ? ORDER BY at, rowid`, filesId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.AuditEventSchema{}
+	for rows.Next() {
+		var doc schema.AuditEventSchema
+		var id, docFilesId, files string
+		var at int64
+		err := rows.Scan(&id, &docFilesId, &doc.Type, &at, &doc.SignalingId,
+			&doc.Peer.Name, &doc.Peer.Network, &doc.Peer.Local, &files, &doc.Detail)
+		if err != nil {
+			return nil, err
+		}
+		if doc.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		if doc.FilesId, err = primitive.ObjectIDFromHex(docFilesId); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(files), &doc.Files); err != nil {
+			return nil, err
+		}
+		doc.At = time.UnixMilli(at)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) RevokeToken(id string, expireAt time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expire_at < ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(
+		`INSERT INTO revoked_tokens (id, expire_at) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+		id, expireAt.Unix(),
+	)
+	return err
+}
+
+func (s *SqliteStore) IsTokenRevoked(id string) bool {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM revoked_tokens WHERE id = ?`, id).Scan(&one)
+	// fail closed, a token can't be used if the deny-list can't be read
+	return !errors.Is(err, sql.ErrNoRows)
+}
+
+const sqliteSignalingColumns = `id, files_id, offer, offer_ice, answer, answer_ice, request, status, disconnect, presence, progress, expire_at, mismatches, resume, relay, seq, reject_msg, secret`
+
+func (s *SqliteStore) GetSignalingDoc(id string) (*schema.SignalingSchema, error) {
+	row := s.db.QueryRow(`SELECT `+sqliteSignalingColumns+` FROM signaling WHERE id = ?`, id)
+
+	doc, err := scanSqliteSignaling(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return doc, err
+}
+
+func (s *SqliteStore) GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteSignalingColumns+` FROM signaling WHERE files_id = ?`, filesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []schema.SignalingSchema{}
+	for rows.Next() {
+		doc, err := scanSqliteSignaling(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) SetSignalingField(id string, field SignalingField, value string) (int64, error) {
+	var column string
+	switch field {
+	case SignalingOffer:
+		column = "offer"
+	case SignalingAnswer:
+		column = "answer"
+	case SignalingRequest:
+		column = "request"
+	case SignalingStatus:
+		column = "status"
+	case SignalingDisconnect:
+		column = "disconnect"
+	case SignalingPresence:
+		column = "presence"
+	case SignalingProgress:
+		column = "progress"
+	case SignalingResume:
+		column = "resume"
+	case SignalingRelay:
+		column = "relay"
+	case SignalingRejectMsg:
+		column = "reject_msg"
+	default:
+		return 0, fmt.Errorf("cannot $set signaling field %q", field)
+	}
+
+	var filesId string
+	var seq int64
+	err := s.db.QueryRow(
+		`UPDATE signaling SET `+column+` = ?, seq = seq + 1 WHERE id = ? RETURNING files_id, seq`, value, id,
+	).Scan(&filesId, &seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	s.publish(id, filesId, map[string]interface{}{string(field): value, "seq": seq})
+	return seq, nil
+}
+
+func (s *SqliteStore) PushSignalingField(id string, field SignalingField, value string) (int64, error) {
+	var column string
+	switch field {
+	case SignalingOfferIce:
+		column = "offer_ice"
+	case SignalingAnswerIce:
+		column = "answer_ice"
+	case SignalingMismatches:
+		column = "mismatches"
+	default:
+		return 0, fmt.Errorf("cannot $push signaling field %q", field)
+	}
+
+	var filesId string
+	var length int
+	var seq int64
+	err := s.db.QueryRow(
+		`UPDATE signaling SET `+column+` = json_insert(`+column+`, '$[#]', ?), seq = seq + 1 WHERE id = ?
+		RETURNING files_id, json_array_length(`+column+`), seq`, value, id,
+	).Scan(&filesId, &length, &seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	key := string(field) + "." + strconv.Itoa(length-1)
+	s.publish(id, filesId, map[string]interface{}{key: value, "seq": seq})
+	return seq, nil
+}
+
+func (s *SqliteStore) ListenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool, onErr func(err error)) error {
+	return s.changes.listenSignaling(ctx, signalingId, cb)
+}
+
+func (s *SqliteStore) ListenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool, onErr func(err error)) error {
+	return s.changes.listenNewConns(ctx, url, cb)
+}
+
+func (s *SqliteStore) Close() error {
+	s.sweeper.close()
+	s.changes.close()
+	return s.db.Close()
+}
+
+func (s *SqliteStore) deleteExpired(now time.Time) error {
+	for _, table := range []string{"files", "signaling", "checkpoints", "revoked_tokens", "completions", "audit_events"} {
+		if _, err := s.db.Exec(`DELETE FROM `+table+` WHERE expire_at < ?`, now.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read-modify-write of the files column
+func (s *SqliteStore) updateFiles(id string, update func([]schema.File) ([]schema.File, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var filesJson string
+	err = tx.QueryRow(`SELECT files FROM files WHERE id = ?`, id).Scan(&filesJson)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var files []schema.File
+	if err := json.Unmarshal([]byte(filesJson), &files); err != nil {
+		return err
+	}
+
+	updated, err := update(files)
+	if err != nil {
+		return err
+	}
+	newFiles, err := json.Marshal(nonNil(updated))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET files = ? WHERE id = ?`, string(newFiles), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) publish(id string, filesId string, u map[string]interface{}) {
+	objId, _ := primitive.ObjectIDFromHex(id)
+	filesObjId, _ := primitive.ObjectIDFromHex(filesId)
+
+	s.changes.publish(signalingChange{
+		id:      objId,
+		filesId: filesObjId,
+		u:       u,
+	})
+}
+
+// upgrades the stored password to a hash if verifyPassword asks for it
+func (s *SqliteStore) isPasswordValid(id string, password string, column string) bool {
+	var stored string
+	if s.db.QueryRow(`SELECT `+column+` FROM files WHERE id = ?`, id).Scan(&stored) != nil {
+		return false
+	}
+
+	ok, rehash := verifyPassword(stored, password)
+	if rehash {
+		// only if it wasn't changed in the meantime
+		if hash, err := HashPassword(password); err == nil {
+			s.db.Exec(`UPDATE files SET `+column+` = ? WHERE id = ? AND `+column+` = ?`, hash, id, stored)
+		}
+	}
+
+	return ok
+}
+
+// row is a *sql.Row or *sql.Rows of the sqliteSignalingColumns
+func scanSqliteSignaling(row interface{ Scan(dest ...any) error }) (*schema.SignalingSchema, error) {
+	var doc schema.SignalingSchema
+	var id, filesId string
+	var offerIce, answerIce, mismatches string
+	var expireAt int64
+	if err := row.Scan(&id, &filesId, &doc.Offer, &offerIce, &doc.Answer, &answerIce, &doc.Request, &doc.Status, &doc.Disconnect, &doc.Presence, &doc.Progress, &expireAt, &mismatches, &doc.Resume, &doc.Relay, &doc.Seq, &doc.RejectMsg, &doc.Secret); err != nil {
+		return nil, err
+	}
+	doc.ExpireAt = time.Unix(expireAt, 0)
+	if err := json.Unmarshal([]byte(offerIce), &doc.OfferIce); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(answerIce), &doc.AnswerIce); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(mismatches), &doc.Mismatches); err != nil {
+		return nil, err
+	}
+
+	doc.ID, _ = primitive.ObjectIDFromHex(id)
+	doc.FilesId, _ = primitive.ObjectIDFromHex(filesId)
+	return &doc, nil
+}
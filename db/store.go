@@ -0,0 +1,189 @@
+package mongoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNotFound = errors.New("document not found")
+
+// returned by AddFiles when one of the names is already shared
+var ErrFileExists = errors.New("a file with the same name is already shared")
+
+// returned by AddFiles and SetDigests when the files of the share would have
+// more than schema.MaxShareDigestChunks chunk hashes
+var ErrTooManyChunks = fmt.Errorf("at most %v chunks are allowed in a share", schema.MaxShareDigestChunks)
+
+var activeListeners atomic.Int64
+
+// ActiveListeners is the number of open ListenSignaling and ListenNewConns
+// listeners of every store, it should go back to 0 when the websockets close
+func ActiveListeners() int64 {
+	return activeListeners.Load()
+}
+
+// field of the signaling doc that can be updated by the ws messages
+type SignalingField string
+
+const (
+	SignalingOffer      SignalingField = "offer"
+	SignalingOfferIce   SignalingField = "offerIce"
+	SignalingAnswer     SignalingField = "answer"
+	SignalingAnswerIce  SignalingField = "answerIce"
+	SignalingRequest    SignalingField = "request"
+	SignalingStatus     SignalingField = "status"
+	SignalingDisconnect SignalingField = "disconnect"
+	SignalingPresence   SignalingField = "presence"
+	SignalingProgress   SignalingField = "progress"
+	SignalingMismatches SignalingField = "mismatches"
+	SignalingResume     SignalingField = "resume"
+	SignalingRelay      SignalingField = "relay"
+	SignalingRejectMsg  SignalingField = "rejectMsg"
+)
+
+// Store is implemented by every storage backend
+type Store interface {
+	CreateFilesDoc(doc schema.FilesSchema) (*primitive.ObjectID, error)
+	DeleteFilesDoc(id string) error
+	// ErrFileExists if one of the names is already shared or is a file and a
+	// directory of another one, ErrTooManyChunks if the share would have too
+	// many chunk hashes, both checked within the update
+	AddFiles(id string, files []schema.File) error
+	GetFiles(id string) (*[]schema.File, error)
+	RemoveFiles(id string, files []string) error
+	// sets the digest of the files (by name), the files not found are ignored.
+	// ErrTooManyChunks like AddFiles
+	SetDigests(id string, digests map[string]schema.FileDigest) error
+
+	// the host session is the hash of the resume token of the host websocket.
+	// Set replaces it, Swap only if the current one is oldSession (else
+	// ErrNotFound), and the files doc is only deleted if it's still session
+	SetHostSession(id string, session string) error
+	SwapHostSession(id string, oldSession string, newSession string) error
+	// the current host session, empty if the share isn't hosted
+	HostSession(id string) (string, error)
+	DeleteFilesDocOfSession(id string, session string) error
+
+	// sets the expireAt of the files doc, its signaling docs and checkpoints,
+	// only while it's hosted (it has a host session) and not expired, else
+	// ErrNotFound
+	UpdateTTL(id string, expireAt time.Time) error
+
+	IsPasswordFilesValid(id string, passwordFiles string) bool
+	IsPasswordUserValid(url string, passwordUser string) bool
+
+	// the expireAt of the doc is the one of its files doc, ErrNotFound if
+	// there's no files doc
+	CreateSignalingDoc(doc schema.SignalingSchema) (*primitive.ObjectID, error)
+	DeleteSignalingDoc(id string) error
+	GetSignalingDoc(id string) (*schema.SignalingSchema, error)
+	// every signaling doc of the files doc
+	GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error)
+	// $set the field to value, returns the new seq of the doc. The changes
+	// of the listeners include it as "seq"
+	SetSignalingField(id string, field SignalingField, value string) (int64, error)
+	// $push the value to the field array, returns the new seq of the doc
+	PushSignalingField(id string, field SignalingField, value string) (int64, error)
+
+	// files fully received by the conns, a completion already recorded is
+	// ignored. They are kept after the files doc is deleted
+	AddCompletion(doc schema.CompletionSchema) error
+	GetCompletions(filesId string) ([]schema.CompletionSchema, error)
+
+	// the chunks acknowledged by the receivers, replaced by id. They are kept
+	// until their expireAt, across the signaling docs of the receiver
+	SetCheckpoint(doc schema.CheckpointSchema) error
+	GetCheckpoints(filesId string, receiver string) ([]schema.CheckpointSchema, error)
+
+	// events of the audit log, in the order they happened
+	AddAuditEvent(doc schema.AuditEventSchema) error
+	GetAuditEvents(filesId string) ([]schema.AuditEventSchema, error)
+
+	// deny-list of the capability tokens, kept until expireAt
+	RevokeToken(id string, expireAt time.Time) error
+	IsTokenRevoked(id string) bool
+
+	// cb is called with every change until it returns false or ctx is done,
+	// then the listener is closed. onErr is called if the listener stops
+	// because of an error, after that cb isn't called
+	ListenSignaling(ctx context.Context, signalingId string, cb func(changes ListenSignalingEvent) bool, onErr func(err error)) error
+	ListenNewConns(ctx context.Context, url string, cb func(changes ListenNewConnsEvent) bool, onErr func(err error)) error
+
+	// stops the listeners and closes the connection to the database
+	Close() error
+}
+
+var (
+	_ Store = (*MongoClient)(nil)
+	_ Store = (*SqliteStore)(nil)
+	_ Store = (*PostgresStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+type ListenSignalingEvent struct {
+	U map[string]interface{} `bson:"u" json:"u"`
+}
+
+type ListenNewConnsEvent struct {
+	Id primitive.ObjectID     `bson:"id" json:"id"`
+	U  map[string]interface{} `bson:"u" json:"u"`
+}
+
+// Open returns the store of cfg.Backend ("mongo", "sqlite", "postgres" or
+// "memory"). cfg.Dsn is the sqlite file path or the postgres connection
+// string, ignored by the other backends
+func Open(cfg config.StoreConfig) (Store, error) {
+	switch cfg.Backend {
+	case "mongo":
+		return Connect(cfg.Mongo), nil
+	case "sqlite":
+		if cfg.Dsn == "" {
+			return ConnectSqlite(SqliteDefaultPath)
+		}
+		return ConnectSqlite(cfg.Dsn)
+	case "postgres":
+		if cfg.Dsn == "" {
+			return nil, errors.New("the postgres store needs a connection string")
+		}
+		return ConnectPostgres(cfg.Dsn)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.Backend)
+	}
+}
+
+// appends files to current, ErrFileExists if one of them is already there,
+// repeated in files or a file and a directory of another one ("a" and "a/b")
+func addFiles(current []schema.File, files []schema.File) ([]schema.File, error) {
+	if schema.PathConflict(current, files) != "" {
+		return nil, ErrFileExists
+	}
+	newFiles := append(slices.Clip(current), files...)
+	if schema.DigestChunks(newFiles) > schema.MaxShareDigestChunks {
+		return nil, ErrTooManyChunks
+	}
+	return newFiles, nil
+}
+
+// a copy of files with the digests set (by name)
+func setDigests(files []schema.File, digests map[string]schema.FileDigest) ([]schema.File, error) {
+	newFiles := slices.Clone(files)
+	for i, file := range newFiles {
+		if digest, ok := digests[file.Name]; ok {
+			newFiles[i].Digest = &digest
+		}
+	}
+	if schema.DigestChunks(newFiles) > schema.MaxShareDigestChunks {
+		return nil, ErrTooManyChunks
+	}
+	return newFiles, nil
+}
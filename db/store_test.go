@@ -0,0 +1,775 @@
+package mongoclient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/argon2"
+)
+
+// the contract tests run against the memory and sqlite stores, and against
+// postgres and mongo (a replica set, for the change streams) when these are
+// set. Their data is kept, the tests only use the docs they create
+const (
+	testPostgresDsnEnv = "WEBRTC_TEST_POSTGRES_DSN"
+	testMongoUriEnv    = "WEBRTC_TEST_MONGO_URI"
+)
+
+// runs test with a new store of every backend
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store {
+			return NewMemoryStore()
+		}},
+		{"sqlite", func(t *testing.T) Store {
+			store, err := ConnectSqlite(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+		{"postgres", func(t *testing.T) Store {
+			dsn := os.Getenv(testPostgresDsnEnv)
+			if dsn == "" {
+				t.Skipf("%v not set", testPostgresDsnEnv)
+			}
+			store, err := ConnectPostgres(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+		{"mongo", func(t *testing.T) Store {
+			uri := os.Getenv(testMongoUriEnv)
+			if uri == "" {
+				t.Skipf("%v not set", testMongoUriEnv)
+			}
+			return Connect(config.MongoConfig{Uri: uri, Database: "webrtc_test"})
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			t.Cleanup(func() { store.Close() })
+			test(t, store)
+		})
+	}
+}
+
+func createFilesDoc(t *testing.T, store Store, files ...schema.File) string {
+	t.Helper()
+
+	id, err := store.CreateFilesDoc(schema.NewFileSchema("user", "files", files, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.Hex()
+}
+
+func createSignalingDoc(t *testing.T, store Store, filesId string) string {
+	t.Helper()
+
+	objId, _ := primitive.ObjectIDFromHex(filesId)
+	id, err := store.CreateSignalingDoc(schema.NewSignalingSchema(objId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.Hex()
+}
+
+// the changes received by the listener, by key, with the seq of the doc
+type receivedChange struct {
+	key   string
+	value interface{}
+	seq   interface{}
+}
+
+func receivedChanges(prefix string, u map[string]interface{}) []receivedChange {
+	var changes []receivedChange
+	for key, value := range u {
+		if key != "seq" {
+			changes = append(changes, receivedChange{prefix + key, value, u["seq"]})
+		}
+	}
+	return changes
+}
+
+func receive(t *testing.T, changes <-chan receivedChange, n int) []receivedChange {
+	t.Helper()
+
+	var received []receivedChange
+	timeout := time.After(5 * time.Second)
+	for len(received) < n {
+		select {
+		case change := <-changes:
+			received = append(received, change)
+		case <-timeout:
+			t.Fatalf("received %v of %v changes: %v", len(received), n, received)
+		}
+	}
+
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change %v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return received
+}
+
+func TestStoreSignalingFields(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		signalingId := createSignalingDoc(t, store, createFilesDoc(t, store))
+
+		tests := []struct {
+			field SignalingField
+			push  bool
+			value string
+			check func(doc *schema.SignalingSchema) bool
+		}{
+			{SignalingOffer, false, "offer", func(doc *schema.SignalingSchema) bool { return doc.Offer == "offer" }},
+			{SignalingAnswer, false, "answer", func(doc *schema.SignalingSchema) bool { return doc.Answer == "answer" }},
+			{SignalingStatus, false, schema.SignalingApproved, func(doc *schema.SignalingSchema) bool { return doc.Status == schema.SignalingApproved }},
+			{SignalingRelay, false, schema.SignalingRelayRequested, func(doc *schema.SignalingSchema) bool { return doc.Relay == schema.SignalingRelayRequested }},
+			{SignalingOfferIce, true, "ice0", func(doc *schema.SignalingSchema) bool { return len(doc.OfferIce) == 1 && doc.OfferIce[0] == "ice0" }},
+			{SignalingOfferIce, true, "ice1", func(doc *schema.SignalingSchema) bool { return len(doc.OfferIce) == 2 && doc.OfferIce[1] == "ice1" }},
+			{SignalingAnswerIce, true, "ice0", func(doc *schema.SignalingSchema) bool { return len(doc.AnswerIce) == 1 }},
+		}
+
+		for i, tt := range tests {
+			var seq int64
+			var err error
+			if tt.push {
+				seq, err = store.PushSignalingField(signalingId, tt.field, tt.value)
+			} else {
+				seq, err = store.SetSignalingField(signalingId, tt.field, tt.value)
+			}
+			if err != nil {
+				t.Fatalf("%v %v: %v", tt.field, tt.value, err)
+			}
+			if seq != int64(i+1) {
+				t.Errorf("%v %v: seq %v, want %v", tt.field, tt.value, seq, i+1)
+			}
+
+			doc, err := store.GetSignalingDoc(signalingId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(doc) {
+				t.Errorf("%v %v not stored: %+v", tt.field, tt.value, doc)
+			}
+			if doc.Seq != seq {
+				t.Errorf("%v %v: doc seq %v, want %v", tt.field, tt.value, doc.Seq, seq)
+			}
+		}
+
+		// $set only accepts the single value fields and $push the arrays
+		if _, err := store.SetSignalingField(signalingId, SignalingOfferIce, "x"); err == nil {
+			t.Error("$set of an array field")
+		}
+		if _, err := store.PushSignalingField(signalingId, SignalingOffer, "x"); err == nil {
+			t.Error("$push of a single value field")
+		}
+	})
+}
+
+func TestStoreSignalingNotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		missing := primitive.NewObjectID()
+		missingHex := missing.Hex()
+
+		if _, err := store.CreateSignalingDoc(schema.NewSignalingSchema(missing)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("create without files doc: %v", err)
+		}
+		if _, err := store.GetSignalingDoc(missingHex); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get: %v", err)
+		}
+		if _, err := store.SetSignalingField(missingHex, SignalingOffer, "x"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("set: %v", err)
+		}
+		if _, err := store.PushSignalingField(missingHex, SignalingOfferIce, "x"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("push: %v", err)
+		}
+
+		signalingId := createSignalingDoc(t, store, createFilesDoc(t, store))
+		if err := store.DeleteSignalingDoc(signalingId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetSignalingDoc(signalingId); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get after delete: %v", err)
+		}
+	})
+}
+
+// every update is delivered once with its own value, even when the same
+// field is set again before the listeners read the previous one
+func TestStoreListenSignaling(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store)
+		signalingId := createSignalingDoc(t, store, filesId)
+		other := createSignalingDoc(t, store, filesId)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		changes := make(chan receivedChange, 100)
+		err := store.ListenSignaling(ctx, signalingId, func(event ListenSignalingEvent) bool {
+			for _, change := range receivedChanges("", event.U) {
+				changes <- change
+			}
+			return true
+		}, func(err error) {
+			t.Errorf("listener stopped: %v", err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newConns := make(chan receivedChange, 100)
+		err = store.ListenNewConns(ctx, filesId, func(event ListenNewConnsEvent) bool {
+			for _, change := range receivedChanges(event.Id.Hex()+" ", event.U) {
+				newConns <- change
+			}
+			return true
+		}, func(err error) {
+			t.Errorf("listener stopped: %v", err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the mongo change streams and the postgres LISTEN start in the
+		// background
+		time.Sleep(500 * time.Millisecond)
+
+		var want []receivedChange
+		for i := range 10 {
+			value := fmt.Sprint("offer", i)
+			if _, err := store.SetSignalingField(signalingId, SignalingOffer, value); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, receivedChange{string(SignalingOffer), value, int64(len(want) + 1)})
+		}
+		for i := range 3 {
+			value := fmt.Sprint("ice", i)
+			if _, err := store.PushSignalingField(signalingId, SignalingOfferIce, value); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, receivedChange{fmt.Sprint(SignalingOfferIce, ".", i), value, int64(len(want) + 1)})
+		}
+		// not received by the signaling listener
+		if _, err := store.SetSignalingField(other, SignalingRequest, "bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		received := receive(t, changes, len(want))
+		for i := range want {
+			if received[i] != want[i] {
+				t.Errorf("change %v: got %v, want %v", i, received[i], want[i])
+			}
+		}
+
+		received = receive(t, newConns, len(want)+1)
+		last := received[len(received)-1]
+		if last != (receivedChange{other + " " + string(SignalingRequest), "bob", int64(1)}) {
+			t.Errorf("last new conns change: %v", last)
+		}
+	})
+}
+
+func TestStoreFiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store, schema.File{Name: "a", Length: 1}, schema.File{Name: "b", Length: 2})
+		digest := schema.FileDigest{Algorithm: "sha-256", Hash: "00"}
+
+		tests := []struct {
+			name   string
+			update func() error
+			err    error
+			want   []string
+		}{
+			{"created", func() error { return nil }, nil, []string{"a", "b"}},
+			{"added", func() error { return store.AddFiles(filesId, []schema.File{{Name: "c", Length: 3}}) }, nil, []string{"a", "b", "c"}},
+			{"added twice", func() error { return store.AddFiles(filesId, []schema.File{{Name: "d"}, {Name: "d"}}) }, ErrFileExists, []string{"a", "b", "c"}},
+			{"already shared", func() error { return store.AddFiles(filesId, []schema.File{{Name: "d"}, {Name: "a"}}) }, ErrFileExists, []string{"a", "b", "c"}},
+			{"file and dir", func() error { return store.AddFiles(filesId, []schema.File{{Name: "d"}, {Name: "d/e"}}) }, ErrFileExists, []string{"a", "b", "c"}},
+			{"in a shared file", func() error { return store.AddFiles(filesId, []schema.File{{Name: "a/e"}}) }, ErrFileExists, []string{"a", "b", "c"}},
+			{"added in a dir", func() error { return store.AddFiles(filesId, []schema.File{{Name: "d/e"}}) }, nil, []string{"a", "b", "c", "d/e"}},
+			{"shared dir", func() error { return store.AddFiles(filesId, []schema.File{{Name: "d"}}) }, ErrFileExists, []string{"a", "b", "c", "d/e"}},
+			{"removed", func() error { return store.RemoveFiles(filesId, []string{"b", "x", "d/e"}) }, nil, []string{"a", "c"}},
+			{"digests", func() error {
+				return store.SetDigests(filesId, map[string]schema.FileDigest{"a": digest, "x": digest})
+			}, nil, []string{"a", "c"}},
+			{"missing doc", func() error { return store.AddFiles(primitive.NewObjectID().Hex(), []schema.File{{Name: "e"}}) }, ErrNotFound, []string{"a", "c"}},
+		}
+
+		for _, tt := range tests {
+			if err := tt.update(); !errors.Is(err, tt.err) {
+				t.Fatalf("%v: got %v, want %v", tt.name, err, tt.err)
+			}
+
+			files, err := store.GetFiles(filesId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, file := range *files {
+				names = append(names, file.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("%v: files %v, want %v", tt.name, names, tt.want)
+			}
+		}
+
+		files, _ := store.GetFiles(filesId)
+		if got := (*files)[0].Digest; got == nil || got.Hash != digest.Hash {
+			t.Errorf("digest %v, want %v", got, digest)
+		}
+		if got := (*files)[1].Digest; got != nil {
+			t.Errorf("digest of a file not set: %v", got)
+		}
+
+		if err := store.DeleteFilesDoc(filesId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetFiles(filesId); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get after delete: %v", err)
+		}
+	})
+}
+
+func TestStoreShareChunks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store, schema.File{Name: "a"}, schema.File{Name: "b"})
+		withChunks := func(n int) schema.FileDigest {
+			return schema.FileDigest{Algorithm: "sha-256", Hash: "00", ChunkSize: 1, Chunks: make([]string, n)}
+		}
+		oneChunk := withChunks(1)
+
+		tests := []struct {
+			name   string
+			update func() error
+			err    error
+		}{
+			{"all the chunks", func() error {
+				return store.SetDigests(filesId, map[string]schema.FileDigest{"a": withChunks(schema.MaxShareDigestChunks)})
+			}, nil},
+			{"added with chunks", func() error {
+				return store.AddFiles(filesId, []schema.File{{Name: "c", Digest: &oneChunk}})
+			}, ErrTooManyChunks},
+			{"added without chunks", func() error { return store.AddFiles(filesId, []schema.File{{Name: "c"}}) }, nil},
+			{"one more chunk", func() error {
+				return store.SetDigests(filesId, map[string]schema.FileDigest{"b": withChunks(1)})
+			}, ErrTooManyChunks},
+			{"replaced chunks", func() error {
+				return store.SetDigests(filesId, map[string]schema.FileDigest{
+					"a": withChunks(schema.MaxShareDigestChunks - 1),
+					"b": withChunks(1),
+				})
+			}, nil},
+		}
+
+		for _, tt := range tests {
+			if err := tt.update(); !errors.Is(err, tt.err) {
+				t.Fatalf("%v: got %v, want %v", tt.name, err, tt.err)
+			}
+		}
+
+		files, err := store.GetFiles(filesId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schema.DigestChunks(*files); got != schema.MaxShareDigestChunks {
+			t.Errorf("%v chunks, want %v", got, schema.MaxShareDigestChunks)
+		}
+	})
+}
+
+func TestStorePasswords(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store)
+		missing := primitive.NewObjectID().Hex()
+
+		tests := []struct {
+			name  string
+			valid func() bool
+			want  bool
+		}{
+			{"files", func() bool { return store.IsPasswordFilesValid(filesId, "files") }, true},
+			{"wrong files", func() bool { return store.IsPasswordFilesValid(filesId, "user") }, false},
+			{"user", func() bool { return store.IsPasswordUserValid(filesId, "user") }, true},
+			{"wrong user", func() bool { return store.IsPasswordUserValid(filesId, "files") }, false},
+			{"missing doc", func() bool { return store.IsPasswordFilesValid(missing, "files") }, false},
+			{"invalid id", func() bool { return store.IsPasswordUserValid("x", "user") }, false},
+		}
+
+		for _, tt := range tests {
+			if got := tt.valid(); got != tt.want {
+				t.Errorf("%v: %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+// reads and writes the stored passwordFiles of a doc, to create the docs of
+// older versions. Skips the memory store, it has no docs to upgrade
+func storedPasswordFiles(t *testing.T, store Store) (get func(id string) string, set func(id string, value string)) {
+	t.Helper()
+
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	switch s := store.(type) {
+	case *SqliteStore:
+		get = func(id string) (stored string) {
+			check(s.db.QueryRow(`SELECT password_files FROM files WHERE id = ?`, id).Scan(&stored))
+			return stored
+		}
+		set = func(id string, value string) {
+			_, err := s.db.Exec(`UPDATE files SET password_files = ? WHERE id = ?`, value, id)
+			check(err)
+		}
+	case *PostgresStore:
+		get = func(id string) (stored string) {
+			check(s.db.QueryRow(`SELECT password_files FROM files WHERE id = $1`, id).Scan(&stored))
+			return stored
+		}
+		set = func(id string, value string) {
+			_, err := s.db.Exec(`UPDATE files SET password_files = $1 WHERE id = $2`, value, id)
+			check(err)
+		}
+	case *MongoClient:
+		col := s.client.Collection(schema.FilesCollection)
+		get = func(id string) string {
+			objId, _ := primitive.ObjectIDFromHex(id)
+			var doc schema.FilesSchema
+			check(col.FindOne(context.TODO(), bson.M{"_id": objId}).Decode(&doc))
+			return doc.PasswordFiles
+		}
+		set = func(id string, value string) {
+			objId, _ := primitive.ObjectIDFromHex(id)
+			_, err := col.UpdateOne(context.TODO(), bson.M{"_id": objId}, bson.M{"$set": bson.M{"passwordFiles": value}})
+			check(err)
+		}
+	default:
+		t.Skip("no stored passwords")
+	}
+	return get, set
+}
+
+// an argon2id hash with fewer iterations than HashPassword
+func outdatedHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, 1, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, argon2Memory, 1, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	)
+}
+
+func TestStorePasswordRehash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		get, set := storedPasswordFiles(t, store)
+		current, err := HashPassword("files")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name     string
+			stored   string
+			password string
+			valid    bool
+			rehashed bool
+		}{
+			{"plaintext", "files", "files", true, true},
+			{"wrong plaintext", "files", "user", false, false},
+			{"outdated params", outdatedHash("files"), "files", true, true},
+			{"wrong password with outdated params", outdatedHash("files"), "user", false, false},
+			{"current params", current, "files", true, false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				filesId := createFilesDoc(t, store)
+				set(filesId, tt.stored)
+
+				if got := store.IsPasswordFilesValid(filesId, tt.password); got != tt.valid {
+					t.Fatalf("valid %v, want %v", got, tt.valid)
+				}
+
+				stored := get(filesId)
+				if rehashed := stored != tt.stored; rehashed != tt.rehashed {
+					t.Fatalf("rehashed %v, want %v: %q", rehashed, tt.rehashed, stored)
+				}
+				if ok, rehash := verifyPassword(stored, "files"); !ok || (tt.rehashed && rehash) {
+					t.Errorf("stored %q: valid %v, outdated %v", stored, ok, rehash)
+				}
+				// the upgraded doc still accepts the password
+				if tt.valid && !store.IsPasswordFilesValid(filesId, tt.password) {
+					t.Error("not valid after the upgrade")
+				}
+			})
+		}
+	})
+}
+
+func TestStoreHostSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store)
+		signalingId := createSignalingDoc(t, store, filesId)
+		expireAt := time.Now().Add(2 * time.Hour)
+
+		// only extended while it's hosted
+		if err := store.UpdateTTL(filesId, expireAt); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ttl without host session: %v", err)
+		}
+
+		if session, err := store.HostSession(filesId); err != nil || session != "" {
+			t.Errorf("session before set: %q %v", session, err)
+		}
+		if err := store.SetHostSession(filesId, "s1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SwapHostSession(filesId, "s0", "s2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("swap of another session: %v", err)
+		}
+		if err := store.SwapHostSession(filesId, "s1", "s2"); err != nil {
+			t.Errorf("swap: %v", err)
+		}
+		if session, err := store.HostSession(filesId); err != nil || session != "s2" {
+			t.Errorf("session after swap: %q %v", session, err)
+		}
+
+		if err := store.UpdateTTL(filesId, expireAt); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := store.GetSignalingDoc(signalingId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.ExpireAt.Sub(expireAt).Abs() > time.Second {
+			t.Errorf("signaling doc expires at %v, want %v", doc.ExpireAt, expireAt)
+		}
+
+		// the host of s1 doesn't delete the share of s2
+		if err := store.DeleteFilesDocOfSession(filesId, "s1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetFiles(filesId); err != nil {
+			t.Errorf("deleted by an old session: %v", err)
+		}
+		if err := store.DeleteFilesDocOfSession(filesId, "s2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetFiles(filesId); !errors.Is(err, ErrNotFound) {
+			t.Errorf("not deleted by its session: %v", err)
+		}
+		if err := store.DeleteFilesDocOfSession(filesId, "s2"); err != nil {
+			t.Errorf("delete of a deleted doc: %v", err)
+		}
+		if _, err := store.HostSession(filesId); !errors.Is(err, ErrNotFound) {
+			t.Errorf("session of a deleted doc: %v", err)
+		}
+	})
+}
+
+func TestStoreRevokedTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		id := primitive.NewObjectID().Hex()
+		if store.IsTokenRevoked(id) {
+			t.Error("revoked before RevokeToken")
+		}
+		if err := store.RevokeToken(id, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if !store.IsTokenRevoked(id) {
+			t.Error("not revoked")
+		}
+		// revoking it again keeps it revoked
+		if err := store.RevokeToken(id, time.Now().Add(time.Hour)); err != nil {
+			t.Errorf("revoked twice: %v", err)
+		}
+	})
+}
+
+func TestStoreCompletions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store, schema.File{Name: "a", Length: 1}, schema.File{Name: "b", Length: 2})
+		objId, _ := primitive.ObjectIDFromHex(filesId)
+		signalingId := primitive.NewObjectID()
+
+		for _, file := range []string{"a", "b", "a"} {
+			doc := schema.NewCompletionSchema(objId, signalingId, "bob", file, 1, time.Hour)
+			if err := store.AddCompletion(doc); err != nil {
+				t.Fatalf("%v: %v", file, err)
+			}
+		}
+		// kept after the share is deleted
+		if err := store.DeleteFilesDoc(filesId); err != nil {
+			t.Fatal(err)
+		}
+
+		completions, err := store.GetCompletions(filesId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, completion := range completions {
+			files = append(files, completion.File)
+		}
+		slices.Sort(files)
+		if !slices.Equal(files, []string{"a", "b"}) {
+			t.Errorf("completions of %v, want a and b once", files)
+		}
+	})
+}
+
+func TestStoreCheckpoints(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store)
+		objId, _ := primitive.ObjectIDFromHex(filesId)
+		expireAt := time.Now().Add(time.Hour)
+
+		first := schema.NewCheckpointSchema(objId, "r1", "a", 64, expireAt)
+		first.Chunks = []schema.ChunkRange{{Start: 0, End: 2}}
+		replaced := schema.NewCheckpointSchema(objId, "r1", "a", 64, expireAt)
+		replaced.Chunks = []schema.ChunkRange{{Start: 0, End: 4}, {Start: 6, End: 8}}
+		other := schema.NewCheckpointSchema(objId, "r2", "a", 64, expireAt)
+
+		for _, doc := range []schema.CheckpointSchema{first, replaced, other} {
+			if err := store.SetCheckpoint(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checkpoints, err := store.GetCheckpoints(filesId, "r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(checkpoints) != 1 || !slices.Equal(checkpoints[0].Chunks, replaced.Chunks) {
+			t.Errorf("checkpoints %+v, want %v", checkpoints, replaced.Chunks)
+		}
+
+		checkpoints, err = store.GetCheckpoints(filesId, "r3")
+		if err != nil || len(checkpoints) != 0 {
+			t.Errorf("checkpoints of another receiver: %v %v", checkpoints, err)
+		}
+	})
+}
+
+func TestStoreAuditEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId := createFilesDoc(t, store)
+		objId, _ := primitive.ObjectIDFromHex(filesId)
+
+		want := []string{schema.AuditShareCreated, schema.AuditReceiverConnected, schema.AuditTransferCompleted, schema.AuditShareDeleted}
+		for _, eventType := range want {
+			if err := store.AddAuditEvent(schema.NewAuditEventSchema(objId, eventType)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// of another share
+		other := schema.NewAuditEventSchema(primitive.NewObjectID(), schema.AuditShareCreated)
+		if err := store.AddAuditEvent(other); err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := store.GetAuditEvents(filesId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, event := range events {
+			got = append(got, event.Type)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("events %v, want %v", got, want)
+		}
+	})
+}
+
+// the completions and the audit events are deleted once their retention
+// ends. Mongo deletes them with its TTL indexes
+func TestStoreRetention(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		sweepable, ok := store.(interface{ deleteExpired(now time.Time) error })
+		if !ok {
+			t.Skip("expired by the TTL indexes")
+		}
+		objId := primitive.NewObjectID()
+		signalingId := primitive.NewObjectID()
+
+		for _, doc := range []schema.CompletionSchema{
+			schema.NewCompletionSchema(objId, signalingId, "bob", "expired", 1, time.Minute),
+			schema.NewCompletionSchema(objId, signalingId, "bob", "kept", 1, time.Hour),
+		} {
+			if err := store.AddCompletion(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, retention := range []time.Duration{time.Minute, time.Hour} {
+			event := schema.NewAuditEventSchema(objId, schema.AuditShareCreated)
+			event.Detail = retention.String()
+			event.ExpireAt = event.At.Add(retention)
+			if err := store.AddAuditEvent(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := sweepable.deleteExpired(time.Now().Add(2 * time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		completions, err := store.GetCompletions(objId.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(completions) != 1 || completions[0].File != "kept" {
+			t.Errorf("completions %+v, want the kept one", completions)
+		}
+		events, err := store.GetAuditEvents(objId.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Detail != time.Hour.String() {
+			t.Errorf("events %+v, want the one kept for an hour", events)
+		}
+	})
+}
+
+func TestStoreSignalingSecret(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		filesId, _ := primitive.ObjectIDFromHex(createFilesDoc(t, store))
+		doc := schema.NewSignalingSchema(filesId)
+		doc.Secret = "hash"
+		id, err := store.CreateSignalingDoc(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetSignalingDoc(id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Secret != doc.Secret {
+			t.Errorf("secret %q, want %q", got.Secret, doc.Secret)
+		}
+	})
+}
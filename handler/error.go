@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HttpError is returned by a TargetFunc to respond with a status code other
+// than 400 Bad Request
+type HttpError struct {
+	Status int
+	Msg    string
+	// sent in the Retry-After header if not 0
+	RetryAfter time.Duration
+}
+
+func NewHttpError(status int, msg string) *HttpError {
+	return &HttpError{
+		Status: status,
+		Msg:    msg,
+	}
+}
+
+// 429 Too Many Requests
+func NewRetryError(retryAfter time.Duration) *HttpError {
+	return &HttpError{
+		Status:     http.StatusTooManyRequests,
+		Msg:        "too many requests",
+		RetryAfter: retryAfter,
+	}
+}
+
+func (e *HttpError) Error() string {
+	return e.Msg
+}
+
+// SendError responds with the status of the error (400 if it isn't an HttpError)
+func SendError(w http.ResponseWriter, err error) {
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if httpErr.RetryAfter > 0 {
+		seconds := int(math.Ceil(httpErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	http.Error(w, httpErr.Msg, httpErr.Status)
+}
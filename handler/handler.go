@@ -7,6 +7,9 @@ import (
 	"net/http"
 )
 
+// longest request body of the json handlers and read by the share rate limits
+const maxBodySize int64 = 8 << 20
+
 // In -> request body
 // Out -> response body
 type TargetFunc[In any, Out any] func(*http.Request, In) (*Out, error)
@@ -16,6 +19,7 @@ func HandleBody[In any, Out any](f TargetFunc[In, Out]) http.Handler {
 		var in In
 
 		// Retrieve data from request.
+		req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
 		err := json.NewDecoder(req.Body).Decode(&in)
 		if err != nil {
 			// Format error response
@@ -29,7 +33,7 @@ func HandleBody[In any, Out any](f TargetFunc[In, Out]) http.Handler {
 		if err != nil {
 			// Format error response
 			fmt.Printf("err2: %v\n", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			SendError(w, err)
 			return
 		}
 
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleBodySize(t *testing.T) {
+	type request struct {
+		Name string `json:"name"`
+	}
+	h := HandleBody(func(req *http.Request, in request) (*request, error) {
+		return &in, nil
+	})
+
+	tests := []struct {
+		name string
+		size int64
+		want int
+	}{
+		{"small", 100, http.StatusCreated},
+		{"longest", maxBodySize, http.StatusCreated},
+		{"too long", maxBodySize + 1, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := `{"name":"`
+			body := prefix + strings.Repeat("a", int(tt.size)-len(prefix)-2) + `"}`
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+			if w.Code != tt.want {
+				t.Errorf("status %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
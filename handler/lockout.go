@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutPolicy is when a key is locked and for how long
+type LockoutPolicy struct {
+	MaxFailures int
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// lock of a key already locked level times
+func (p LockoutPolicy) lockDuration(level int) time.Duration {
+	duration := min(p.Duration<<level, p.MaxDuration)
+	// the shift overflows after enough levels
+	if duration <= 0 {
+		return p.MaxDuration
+	}
+	return duration
+}
+
+// LockoutBackend keeps the failed attempts and the locks of the keys
+type LockoutBackend interface {
+	// Check returns true and the remaining time if the key is locked
+	Check(key string) (remaining time.Duration, locked bool)
+	// Fail records a failed attempt, locking the key once it has
+	// policy.MaxFailures
+	Fail(key string, policy LockoutPolicy)
+	// Succeed resets the key
+	Succeed(key string)
+}
+
+// Lockout locks a key (like a files id) after MaxFailures failed password
+// attempts. Every new lock of the same key lasts twice the previous one, up
+// to MaxDuration, until a successful attempt resets it
+type Lockout struct {
+	backend LockoutBackend
+	policy  LockoutPolicy
+}
+
+func NewLockout(backend LockoutBackend, maxFailures int, duration time.Duration, maxDuration time.Duration) *Lockout {
+	return &Lockout{
+		backend: backend,
+		policy: LockoutPolicy{
+			MaxFailures: maxFailures,
+			Duration:    duration,
+			MaxDuration: maxDuration,
+		},
+	}
+}
+
+// Check returns true and the remaining time if the key is locked
+func (l *Lockout) Check(key string) (time.Duration, bool) {
+	return l.backend.Check(key)
+}
+
+// Fail records a failed attempt, locking the key if needed
+func (l *Lockout) Fail(key string) {
+	l.backend.Fail(key, l.policy)
+}
+
+// Succeed resets the key
+func (l *Lockout) Succeed(key string) {
+	l.backend.Succeed(key)
+}
+
+type lockoutEntry struct {
+	failures    int
+	level       int // times it was locked, doubles the next lock
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// MemoryLockout keeps the failures in memory, every instance has its own
+type MemoryLockout struct {
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+	fails   int
+}
+
+func NewMemoryLockout() *MemoryLockout {
+	return &MemoryLockout{
+		entries: map[string]*lockoutEntry{},
+	}
+}
+
+func (m *MemoryLockout) Check(key string) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := time.Until(entry.lockedUntil)
+	return remaining, remaining > 0
+}
+
+func (m *MemoryLockout) Fail(key string, policy LockoutPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.fails++
+	if m.fails%1000 == 0 {
+		m.sweep(now, policy.MaxDuration)
+	}
+
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &lockoutEntry{}
+		m.entries[key] = entry
+	}
+
+	entry.lastFailure = now
+	entry.failures++
+	if entry.failures < policy.MaxFailures {
+		return
+	}
+
+	entry.lockedUntil = now.Add(policy.lockDuration(entry.level))
+	entry.failures = 0
+	entry.level++
+}
+
+func (m *MemoryLockout) Succeed(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+}
+
+// forgets the keys without failures in the last maxDuration, m.mu must be held
+func (m *MemoryLockout) sweep(now time.Time, maxDuration time.Duration) {
+	for key, entry := range m.entries {
+		if now.Sub(entry.lastFailure) > maxDuration && now.After(entry.lockedUntil) {
+			delete(m.entries, key)
+		}
+	}
+}
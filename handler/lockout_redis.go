@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// failures and lock of a key stored in a redis hash, updated atomically like
+// MemoryLockout.Fail. The hash is forgotten maxDuration after the last
+// failure, or when the lock ends.
+// KEYS[1] = key, ARGV = max failures, duration in ms, max duration in ms,
+// now in ms
+var failScript = redis.NewScript(`
+local max_failures = tonumber(ARGV[1])
+local duration = tonumber(ARGV[2])
+local max_duration = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local failures = redis.call("HINCRBY", KEYS[1], "failures", 1)
+if failures >= max_failures then
+	local level = tonumber(redis.call("HGET", KEYS[1], "level")) or 0
+	local lock = math.min(duration * 2 ^ level, max_duration)
+	redis.call("HSET", KEYS[1], "failures", 0, "level", level + 1, "lockedUntil", now + lock)
+end
+
+local locked_until = tonumber(redis.call("HGET", KEYS[1], "lockedUntil")) or 0
+redis.call("PEXPIRE", KEYS[1], math.max(max_duration, locked_until - now))
+return 0
+`)
+
+// RedisLockout shares the failures between every instance connected to the
+// same redis. It uses the client of a RedisLimiter
+type RedisLockout struct {
+	client *redis.Client
+}
+
+// Lockout returns the lockout backend stored in the redis of the limiter
+func (r *RedisLimiter) Lockout() *RedisLockout {
+	return &RedisLockout{
+		client: r.client,
+	}
+}
+
+func lockoutKey(key string) string {
+	return "lockout:" + key
+}
+
+func (r *RedisLockout) Check(key string) (time.Duration, bool) {
+	lockedUntil, err := r.client.HGet(context.TODO(), lockoutKey(key), "lockedUntil").Int64()
+	if err != nil {
+		// not locked (redis.Nil), or fail open like the limiter
+		return 0, false
+	}
+
+	remaining := time.Until(time.UnixMilli(lockedUntil))
+	return remaining, remaining > 0
+}
+
+func (r *RedisLockout) Fail(key string, policy LockoutPolicy) {
+	failScript.Run(
+		context.TODO(), r.client, []string{lockoutKey(key)},
+		policy.MaxFailures, policy.Duration.Milliseconds(), policy.MaxDuration.Milliseconds(), time.Now().UnixMilli(),
+	)
+}
+
+func (r *RedisLockout) Succeed(key string) {
+	r.client.Del(context.TODO(), lockoutKey(key))
+}
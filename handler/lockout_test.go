@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// the redis tests run when it's set. Its keys are kept, the tests only use
+// keys of their own
+const testRedisAddrEnv = "WEBRTC_TEST_REDIS_ADDR"
+
+// runs test with a new backend of every kind, key makes a key of this run
+func forEachLockoutBackend(t *testing.T, test func(t *testing.T, backend LockoutBackend, key func(name string) string)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) LockoutBackend
+	}{
+		{"memory", func(t *testing.T) LockoutBackend {
+			return NewMemoryLockout()
+		}},
+		{"redis", func(t *testing.T) LockoutBackend {
+			addr := os.Getenv(testRedisAddrEnv)
+			if addr == "" {
+				t.Skipf("%v not set", testRedisAddrEnv)
+			}
+			limiter, err := ConnectRedisLimiter(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { limiter.Close() })
+			return limiter.Lockout()
+		}},
+	}
+
+	run := time.Now().UnixNano()
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t), func(name string) string {
+				return fmt.Sprintf("%v/%v/%v", t.Name(), run, name)
+			})
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	const (
+		duration    = time.Minute
+		maxDuration = 3 * time.Minute
+	)
+
+	tests := []struct {
+		name string
+		// failed attempts of "a", a "" resets it
+		fails []string
+		key   string
+		// remaining lock, about, 0 if it isn't locked
+		want time.Duration
+	}{
+		{"below the failures", []string{"a", "a"}, "a", 0},
+		{"locked", []string{"a", "a", "a"}, "a", duration},
+		{"other key", []string{"a", "a", "a"}, "b", 0},
+		{"doubled", []string{"a", "a", "a", "a", "a", "a"}, "a", 2 * duration},
+		{"up to the max", []string{"a", "a", "a", "a", "a", "a", "a", "a", "a"}, "a", maxDuration},
+		{"reset by a success", []string{"a", "a", "", "a"}, "a", 0},
+		{"reset level", []string{"a", "a", "a", "", "a", "a", "a"}, "a", duration},
+	}
+
+	forEachLockoutBackend(t, func(t *testing.T, backend LockoutBackend, key func(name string) string) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				// the backend is shared by the tests
+				key := func(name string) string { return key(tt.name + "/" + name) }
+
+				lockout := NewLockout(backend, 3, duration, maxDuration)
+				for _, name := range tt.fails {
+					if name == "" {
+						lockout.Succeed(key("a"))
+						continue
+					}
+					lockout.Fail(key(name))
+				}
+
+				remaining, locked := lockout.Check(key(tt.key))
+				if locked != (tt.want > 0) {
+					t.Fatalf("locked %v, want %v", locked, tt.want > 0)
+				}
+				if locked && (remaining > tt.want || remaining < tt.want-time.Second) {
+					t.Errorf("remaining %v, want %v", remaining, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestLockoutOverflow(t *testing.T) {
+	forEachLockoutBackend(t, func(t *testing.T, backend LockoutBackend, key func(name string) string) {
+		lockout := NewLockout(backend, 1, time.Hour, 24*time.Hour)
+		for range 100 {
+			lockout.Fail(key("a"))
+		}
+
+		remaining, locked := lockout.Check(key("a"))
+		if !locked || remaining > 24*time.Hour || remaining < 24*time.Hour-time.Second {
+			t.Errorf("remaining %v, want the max duration", remaining)
+		}
+	})
+}
+
+// the replicas sharing a backend count the failures of each other
+func TestLockoutShared(t *testing.T) {
+	forEachLockoutBackend(t, func(t *testing.T, backend LockoutBackend, key func(name string) string) {
+		replicas := []*Lockout{
+			NewLockout(backend, 3, time.Minute, time.Hour),
+			NewLockout(backend, 3, time.Minute, time.Hour),
+		}
+		for i := range 3 {
+			replicas[i%2].Fail(key("a"))
+		}
+
+		for i, lockout := range replicas {
+			if _, locked := lockout.Check(key("a")); !locked {
+				t.Errorf("replica %v: not locked", i)
+			}
+		}
+	})
+}
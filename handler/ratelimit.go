@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/gorilla/mux"
+)
+
+// LimiterBackend keeps the token buckets
+type LimiterBackend interface {
+	// Take removes a token from the bucket key. If it's empty, returns false
+	// and the time until the next token
+	Take(key string, rate config.Rate) (ok bool, retryAfter time.Duration)
+	Close() error
+}
+
+// RateLimiter limits the requests of every client ip per route, and the
+// requests of every share per route from all the ips
+type RateLimiter struct {
+	backend     LimiterBackend
+	limits      config.RateLimits
+	shareLimits config.RateLimits
+	// use X-Forwarded-For, only when behind a reverse proxy that sets it
+	trustProxy bool
+}
+
+func NewRateLimiter(backend LimiterBackend, limits config.RateLimits, shareLimits config.RateLimits, trustProxy bool) *RateLimiter {
+	return &RateLimiter{
+		backend:     backend,
+		limits:      limits,
+		shareLimits: shareLimits,
+		trustProxy:  trustProxy,
+	}
+}
+
+// Limit responds with 429 Too Many Requests when the client ip, or the share
+// of the request, has no tokens left for the route
+func (l *RateLimiter) Limit(route string, next http.Handler) http.Handler {
+	rate, limitIp := l.limits.For(route)
+	shareRate, limitShare := l.shareLimits.For(route)
+	if !limitIp && !limitShare {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if limitIp {
+			key := route + ":" + ClientIp(req, l.trustProxy)
+			if ok, retryAfter := l.backend.Take(key, rate); !ok {
+				SendError(w, NewRetryError(retryAfter))
+				return
+			}
+		}
+
+		if limitShare {
+			if id := shareId(req); id != "" {
+				key := "share:" + route + ":" + id
+				if ok, retryAfter := l.backend.Take(key, shareRate); !ok {
+					SendError(w, NewRetryError(retryAfter))
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// the objId of the path, or the url of the json body. The body is read and
+// put back for the handler
+func shareId(req *http.Request) string {
+	if id := mux.Vars(req)["objId"]; id != "" {
+		return id
+	}
+	if req.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+
+	var in struct {
+		Url string `json:"url"`
+	}
+	json.Unmarshal(body, &in)
+	return in.Url
+}
+
+// with trustProxy, the address the reverse proxy appended to X-Forwarded-For.
+// The entries before it are sent by the client and can be anything
+func ClientIp(req *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := req.Header.Values("X-Forwarded-For"); len(values) != 0 {
+			forwarded := values[len(values)-1]
+			if i := strings.LastIndex(forwarded, ","); i >= 0 {
+				forwarded = forwarded[i+1:]
+			}
+			if ip := strings.TrimSpace(forwarded); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// IpInfo is the ip info shown to the host and kept in the audit log, the full
+// ip isn't shared
+func IpInfo(clientIp string) (network string, local bool) {
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return "", false
+	}
+
+	mask := net.CIDRMask(48, 128)
+	if ip.To4() != nil {
+		ip = ip.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	ipNet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	return ipNet.String(), ip.IsPrivate() || ip.IsLoopback()
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	interval time.Duration // the bucket is full after it
+}
+
+// MemoryLimiter keeps the buckets in memory, every instance has its own
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: map[string]*bucket{},
+	}
+}
+
+func (m *MemoryLimiter) Take(key string, rate config.Rate) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.takes++
+	if m.takes%1000 == 0 {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now, interval: rate.Interval}
+		m.buckets[key] = b
+	}
+
+	// refill
+	b.tokens += float64(now.Sub(b.last)) / float64(rate.PerToken())
+	b.tokens = min(b.tokens, float64(rate.Burst))
+	b.last = now
+
+	if b.tokens < 1 {
+		missing := (1 - b.tokens) * float64(rate.PerToken())
+		return false, time.Duration(missing)
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (m *MemoryLimiter) Close() error {
+	return nil
+}
+
+// removes the buckets that are full again, m.mu must be held
+func (m *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.last) > b.interval {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// token bucket stored in a redis hash, updated atomically.
+// KEYS[1] = bucket, ARGV = burst, ms per token, now in ms.
+// Returns the ms to wait for the next token, 0 if one was taken
+var takeScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local per_token = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + (now - last) / per_token)
+
+local wait = 0
+if tokens < 1 then
+	wait = math.ceil((1 - tokens) * per_token)
+else
+	tokens = tokens - 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * per_token))
+return wait
+`)
+
+// RedisLimiter shares the buckets between every instance connected to the
+// same redis
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+func ConnectRedisLimiter(addr string) (*RedisLimiter, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping to redis failed: %v", err)
+	}
+
+	return &RedisLimiter{
+		client: client,
+	}, nil
+}
+
+func (r *RedisLimiter) Close() error {
+	return r.client.Close()
+}
+
+func (r *RedisLimiter) Take(key string, rate config.Rate) (bool, time.Duration) {
+	perToken := max(rate.PerToken().Milliseconds(), 1)
+
+	wait, err := takeScript.Run(
+		context.TODO(), r.client, []string{"ratelimit:" + key},
+		rate.Burst, perToken, time.Now().UnixMilli(),
+	).Int64()
+	if err != nil {
+		// fail open, redis being down shouldn't take the api down
+		return true, 0
+	}
+
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Millisecond
+	}
+	return true, 0
+}
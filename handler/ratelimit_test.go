@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/gorilla/mux"
+)
+
+func TestMemoryLimiterTake(t *testing.T) {
+	rate := config.Rate{Burst: 3, Interval: time.Hour}
+
+	tests := []struct {
+		name  string
+		keys  []string
+		want  []bool
+		retry time.Duration // of the last take, about
+	}{
+		{"within the burst", []string{"a", "a", "a"}, []bool{true, true, true}, 0},
+		{"empty bucket", []string{"a", "a", "a", "a"}, []bool{true, true, true, false}, 20 * time.Minute},
+		{"buckets by key", []string{"a", "a", "a", "b"}, []bool{true, true, true, true}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewMemoryLimiter()
+
+			var retryAfter time.Duration
+			for i, key := range tt.keys {
+				var ok bool
+				ok, retryAfter = limiter.Take(key, rate)
+				if ok != tt.want[i] {
+					t.Fatalf("take %v of %v: %v, want %v", i, key, ok, tt.want[i])
+				}
+			}
+			if retryAfter > tt.retry || retryAfter < tt.retry-time.Second {
+				t.Errorf("retry after %v, want %v", retryAfter, tt.retry)
+			}
+		})
+	}
+}
+
+func TestMemoryLimiterRefill(t *testing.T) {
+	rate := config.Rate{Burst: 2, Interval: 100 * time.Millisecond}
+	limiter := NewMemoryLimiter()
+
+	limiter.Take("a", rate)
+	limiter.Take("a", rate)
+	if ok, _ := limiter.Take("a", rate); ok {
+		t.Fatal("took more than the burst")
+	}
+
+	// one token every 50ms
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := limiter.Take("a", rate); !ok {
+		t.Error("not refilled")
+	}
+	if ok, _ := limiter.Take("a", rate); ok {
+		t.Error("refilled more than one token")
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	limits := config.RateLimits{
+		"files/new": {Burst: 1, Interval: time.Hour},
+	}
+
+	tests := []struct {
+		name       string
+		route      string
+		trustProxy bool
+		// of the second request
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"limited", "files/new", false, "1.1.1.1:1000", "", http.StatusTooManyRequests},
+		{"other ip", "files/new", false, "2.2.2.2:1000", "", http.StatusOK},
+		{"route without limit", "stats", false, "1.1.1.1:1000", "", http.StatusOK},
+		{"forwarded ignored", "files/new", false, "1.1.1.1:1000", "2.2.2.2", http.StatusTooManyRequests},
+		{"forwarded trusted", "files/new", true, "1.1.1.1:1000", "1.1.1.1, 2.2.2.2", http.StatusOK},
+		// only the last address is appended by the proxy
+		{"forwarded spoofed", "files/new", true, "1.1.1.1:1000", "2.2.2.2, 1.1.1.1", http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(NewMemoryLimiter(), limits, nil, tt.trustProxy)
+			h := limiter.Limit(tt.route, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+			first := httptest.NewRequest(http.MethodPost, "/", nil)
+			first.RemoteAddr = "1.1.1.1:1000"
+			h.ServeHTTP(httptest.NewRecorder(), first)
+
+			second := httptest.NewRequest(http.MethodPost, "/", nil)
+			second.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				second.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, second)
+
+			if res.Code != tt.want {
+				t.Errorf("status %v, want %v", res.Code, tt.want)
+			}
+			if tt.want == http.StatusTooManyRequests && res.Header().Get("Retry-After") == "" {
+				t.Error("missing Retry-After")
+			}
+		})
+	}
+}
+
+func TestRateLimiterShareLimit(t *testing.T) {
+	shareLimits := config.RateLimits{
+		"token/new": {Burst: 1, Interval: time.Hour},
+		"files/get": {Burst: 1, Interval: time.Hour},
+	}
+
+	// the first request of every test is for share a from 1.1.1.1
+	tests := []struct {
+		name  string
+		route string
+		// of the second request, from 2.2.2.2
+		share string
+		want  int
+	}{
+		{"body url", "token/new", "a", http.StatusTooManyRequests},
+		{"other share", "token/new", "b", http.StatusOK},
+		{"path id", "files/get", "a", http.StatusTooManyRequests},
+		{"route without limit", "files/new", "a", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(NewMemoryLimiter(), nil, shareLimits, false)
+			var body string
+			h := limiter.Limit(tt.route, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := io.ReadAll(req.Body)
+				body = string(b)
+			}))
+
+			request := func(share string, remoteAddr string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"url":"`+share+`"}`))
+				if tt.route == "files/get" {
+					req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"objId": share})
+				}
+				req.RemoteAddr = remoteAddr
+				res := httptest.NewRecorder()
+				h.ServeHTTP(res, req)
+				return res
+			}
+
+			request("a", "1.1.1.1:1000")
+			if tt.route == "token/new" && body != `{"url":"a"}` {
+				t.Errorf("handler read %q", body)
+			}
+
+			if res := request(tt.share, "2.2.2.2:1000"); res.Code != tt.want {
+				t.Errorf("status %v, want %v", res.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy bool
+		forwarded  []string
+		want       string
+	}{
+		{"remote addr", false, nil, "1.1.1.1"},
+		{"forwarded ignored", false, []string{"2.2.2.2"}, "1.1.1.1"},
+		{"forwarded", true, []string{"2.2.2.2"}, "2.2.2.2"},
+		{"last entry", true, []string{"3.3.3.3, 2.2.2.2"}, "2.2.2.2"},
+		{"last header", true, []string{"3.3.3.3", "4.4.4.4, 2.2.2.2"}, "2.2.2.2"},
+		{"empty last entry", true, []string{"2.2.2.2,"}, "1.1.1.1"},
+		{"without header", true, nil, "1.1.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "1.1.1.1:1000"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := ClientIp(req, tt.trustProxy); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpInfo(t *testing.T) {
+	tests := []struct {
+		ip      string
+		network string
+		local   bool
+	}{
+		{"203.0.113.7", "203.0.113.0/24", false},
+		{"192.168.1.20", "192.168.1.0/24", true},
+		{"127.0.0.1", "127.0.0.0/24", true},
+		{"2001:db8:1:2::1", "2001:db8:1::/48", false},
+		{"not an ip", "", false},
+	}
+
+	for _, tt := range tests {
+		network, local := IpInfo(tt.ip)
+		if network != tt.network || local != tt.local {
+			t.Errorf("IpInfo(%v) = %v %v, want %v %v", tt.ip, network, local, tt.network, tt.local)
+		}
+	}
+}
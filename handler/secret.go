@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// NewSecret returns a random secret, only given to its client, and the hash
+// the store keeps
+func NewSecret() (secret string, hash string, err error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", "", err
+	}
+
+	secret = base64.RawURLEncoding.EncodeToString(bytes)
+	return secret, HashSecret(secret), nil
+}
+
+// the secret is random, a fast hash is enough
+func HashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// IsSecretValid compares the hash of secret with hash in constant time. An
+// empty hash (no secret was issued) is never valid
+func IsSecretValid(secret string, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(hash)) == 1
+}
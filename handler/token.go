@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Permission string
+
+const (
+	PermAdd    Permission = "add"    // /files/add
+	PermRemove Permission = "remove" // /files/remove
+	PermHost   Permission = "host"   // ListenOffersHost ws message
+	PermAudit  Permission = "audit"  // /audit/{objId}
+)
+
+var AllPermissions = []Permission{PermAdd, PermRemove, PermHost, PermAudit}
+
+// the audit log is kept after the share is deleted, and can be read with them
+var AuditPermissions = []Permission{PermAudit}
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims of a capability token, scoped to a files doc
+type Claims struct {
+	Id       string       `json:"jti"`
+	FilesId  string       `json:"fid"`
+	Perms    []Permission `json:"perms"`
+	ExpireAt int64        `json:"exp"` // unix seconds
+}
+
+// Allows is true if the token was issued for filesId with the permission perm
+func (c *Claims) Allows(filesId string, perm Permission) bool {
+	return c.FilesId == filesId && slices.Contains(c.Perms, perm)
+}
+
+// DenyList keeps the ids of the revoked tokens until they expire
+type DenyList interface {
+	RevokeToken(id string, expireAt time.Time) error
+	IsTokenRevoked(id string) bool
+}
+
+// Tokens issues and verifies the capability tokens, signed with HMAC-SHA256.
+// The format is base64url(json claims) + "." + base64url(signature)
+type Tokens struct {
+	key []byte
+	ttl time.Duration
+	// of the tokens with AuditPermissions
+	auditTtl time.Duration
+	denyList DenyList
+}
+
+func NewTokens(key []byte, ttl time.Duration, auditTtl time.Duration, denyList DenyList) *Tokens {
+	return &Tokens{
+		key:      key,
+		ttl:      ttl,
+		auditTtl: auditTtl,
+		denyList: denyList,
+	}
+}
+
+// the token lives ttl, or auditTtl if its only permission is PermAudit
+func (t *Tokens) Issue(filesId string, perms []Permission) (string, *Claims, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	claims := &Claims{
+		Id:       base64.RawURLEncoding.EncodeToString(id),
+		FilesId:  filesId,
+		Perms:    perms,
+		ExpireAt: time.Now().Add(t.lifetime(perms)).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + t.sign(encoded), claims, nil
+}
+
+// Verify checks the signature, expiration and revocation of the token
+func (t *Tokens) Verify(token string) (*Claims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(encoded))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpireAt {
+		return nil, errors.New("expired token")
+	}
+	if t.denyList.IsTokenRevoked(claims.Id) {
+		return nil, errors.New("revoked token")
+	}
+
+	return &claims, nil
+}
+
+func (t *Tokens) Revoke(claims *Claims) error {
+	return t.denyList.RevokeToken(claims.Id, time.Unix(claims.ExpireAt, 0))
+}
+
+func (t *Tokens) lifetime(perms []Permission) time.Duration {
+	if slices.Equal(perms, AuditPermissions) {
+		return t.auditTtl
+	}
+	return t.ttl
+}
+
+func (t *Tokens) sign(encoded string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type claimsKey struct{}
+
+// RequireToken only calls next if the request has a valid
+// "Authorization: Bearer <token>" header with the permission perm.
+// The claims are available to next with ClaimsFromContext
+func (t *Tokens) RequireToken(perm Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := t.Verify(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if perm != "" && !slices.Contains(claims.Perms, perm) {
+			http.Error(w, "token without "+string(perm)+" permission", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), claimsKey{}, claims)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// RequireStaticToken only calls next if the request has the
+// "Authorization: Bearer <token>" header with token, for the admin routes
+// that don't belong to a share
+func RequireStaticToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// claims of a request that went through RequireToken
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDenyList map[string]time.Time
+
+func (d fakeDenyList) RevokeToken(id string, expireAt time.Time) error {
+	d[id] = expireAt
+	return nil
+}
+
+func (d fakeDenyList) IsTokenRevoked(id string) bool {
+	_, ok := d[id]
+	return ok
+}
+
+func newTestTokens() (*Tokens, fakeDenyList) {
+	denyList := fakeDenyList{}
+	return NewTokens([]byte("key"), time.Hour, 24*time.Hour, denyList), denyList
+}
+
+func TestTokensVerify(t *testing.T) {
+	tokens, _ := newTestTokens()
+	token, claims, err := tokens.Issue("files", AllPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	otherPayload, _, _ := strings.Cut(mustIssue(t, tokens, "other"), ".")
+
+	expired := NewTokens([]byte("key"), -time.Second, time.Hour, fakeDenyList{})
+	expiredToken, _, _ := expired.Issue("files", AllPermissions)
+
+	otherKey := NewTokens([]byte("other key"), time.Hour, time.Hour, fakeDenyList{})
+
+	tests := []struct {
+		name   string
+		tokens *Tokens
+		token  string
+		valid  bool
+	}{
+		{"issued", tokens, token, true},
+		{"no signature", tokens, payload, false},
+		{"other payload", tokens, otherPayload + "." + signature, false},
+		{"tampered signature", tokens, payload + "." + strings.ToUpper(signature), false},
+		{"other key", otherKey, token, false},
+		{"expired", expired, expiredToken, false},
+		{"empty", tokens, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.tokens.Verify(tt.token)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && (got.Id != claims.Id || got.FilesId != "files" || !slices.Equal(got.Perms, AllPermissions)) {
+				t.Errorf("claims %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func mustIssue(t *testing.T, tokens *Tokens, filesId string) string {
+	t.Helper()
+
+	token, _, err := tokens.Issue(filesId, AllPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokensRevoke(t *testing.T) {
+	tokens, denyList := newTestTokens()
+	token, claims, _ := tokens.Issue("files", AllPermissions)
+	other := mustIssue(t, tokens, "files")
+
+	if err := tokens.Revoke(claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Verify(token); err == nil {
+		t.Error("revoked token verified")
+	}
+	if _, err := tokens.Verify(other); err != nil {
+		t.Errorf("other token of the share: %v", err)
+	}
+	// kept in the deny list until the token expires
+	if !denyList[claims.Id].Equal(time.Unix(claims.ExpireAt, 0)) {
+		t.Errorf("revoked until %v, the token expires at %v", denyList[claims.Id], claims.ExpireAt)
+	}
+}
+
+func TestTokensLifetime(t *testing.T) {
+	tokens, _ := newTestTokens()
+
+	tests := []struct {
+		name  string
+		perms []Permission
+		want  time.Duration
+	}{
+		{"every permission", AllPermissions, time.Hour},
+		{"host", []Permission{PermHost}, time.Hour},
+		{"audit and more", []Permission{PermAudit, PermAdd}, time.Hour},
+		{"audit", AuditPermissions, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, claims, err := tokens.Issue("files", tt.perms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lifetime := time.Until(time.Unix(claims.ExpireAt, 0))
+			if lifetime < tt.want-time.Minute || lifetime > tt.want {
+				t.Errorf("lifetime %v, want %v", lifetime, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimsAllows(t *testing.T) {
+	claims := Claims{FilesId: "files", Perms: []Permission{PermAdd, PermAudit}}
+
+	tests := []struct {
+		filesId string
+		perm    Permission
+		want    bool
+	}{
+		{"files", PermAdd, true},
+		{"files", PermAudit, true},
+		{"files", PermHost, false},
+		{"other", PermAdd, false},
+	}
+
+	for _, tt := range tests {
+		if got := claims.Allows(tt.filesId, tt.perm); got != tt.want {
+			t.Errorf("Allows(%v, %v) = %v, want %v", tt.filesId, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	tokens, _ := newTestTokens()
+	host, _, _ := tokens.Issue("files", []Permission{PermHost})
+	audit, _, _ := tokens.Issue("files", AuditPermissions)
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"valid", "Bearer " + host, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", host, http.StatusUnauthorized},
+		{"invalid", "Bearer x.y", http.StatusUnauthorized},
+		{"without the permission", "Bearer " + audit, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tokens.RequireToken(PermHost, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if ClaimsFromContext(req.Context()).FilesId != "files" {
+					t.Error("claims not in the context")
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+
+			if res.Code != tt.status {
+				t.Errorf("status %v, want %v", res.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireStaticToken(t *testing.T) {
+	h := RequireStaticToken("secret", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid", "Bearer secret", http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "secret", http.StatusUnauthorized},
+		{"wrong token", "Bearer other", http.StatusUnauthorized},
+		{"prefix of the token", "Bearer secre", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
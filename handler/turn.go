@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// TurnCredentials mints the time limited credentials of the TURN REST API
+// (coturn use-auth-secret): the username is "<expireAt unix seconds>:<user>"
+// and the credential is base64(HMAC-SHA1(secret, username)), so the TURN
+// server can check them with the shared secret alone
+func TurnCredentials(secret string, user string, expireAt time.Time) (username string, credential string) {
+	username = strconv.FormatInt(expireAt.Unix(), 10) + ":" + user
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
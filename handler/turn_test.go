@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTurnCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		secret         string
+		user           string
+		expireAt       time.Time
+		wantUsername   string
+		wantCredential string
+	}{
+		{
+			"url",
+			"secret", "6ad34526f16169fbb0b6dc0b", time.Unix(1700000000, 0),
+			"1700000000:6ad34526f16169fbb0b6dc0b", "kvYypNfSTqkaItCkmgOX9yymY9I=",
+		},
+		{
+			"signaling id",
+			"s3", "6ad345a4a1056e844943e377", time.Unix(1792274020, 0),
+			"1792274020:6ad345a4a1056e844943e377", "QhVzLg8OtmPF2I6kRJJ4tT3hyU8=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, credential := TurnCredentials(tt.secret, tt.user, tt.expireAt)
+			if username != tt.wantUsername {
+				t.Errorf("username %q, want %q", username, tt.wantUsername)
+			}
+			if credential != tt.wantCredential {
+				t.Errorf("credential %q, want %q", credential, tt.wantCredential)
+			}
+		})
+	}
+
+	_, credential := TurnCredentials("secret", "user", time.Unix(1700000000, 0))
+	_, other := TurnCredentials("other", "user", time.Unix(1700000000, 0))
+	if credential == other {
+		t.Error("the credential doesn't depend on the secret")
+	}
+}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/audit"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/bus"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
 	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/routes"
@@ -13,41 +24,167 @@ import (
 )
 
 func main() {
-	mongoclient.Connect()
-	//mongoclient.Mongo.CreateTTLIndex(schema.FilesCollection)
+	cfg, printConfig, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Error printing the config: %v\n", err)
+		}
+		return
+	}
+
+	store, err := mongoclient.Open(cfg.Store)
+	if err != nil {
+		log.Fatalf("Error opening store: %v\n", err)
+	}
+
+	// already validated
+	key, _ := base64.StdEncoding.DecodeString(cfg.Tokens.Key)
+	if len(key) == 0 {
+		log.Println("No token key, using a random one")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Error generating the token key: %v\n", err)
+		}
+	}
+	tokens := handler.NewTokens(key, cfg.Tokens.Ttl, cfg.Tokens.AuditTtl, store)
+
+	var signaler routesWs.Signaler
+	var b bus.Bus
+	switch cfg.Signaling.Relay {
+	case "store":
+		signaler = routesWs.NewStoreSignaler(store)
+	case "hub":
+		b, err = bus.Open(cfg.Signaling.Bus, cfg.Signaling.BusAddr)
+		if err != nil {
+			log.Fatalf("Error opening bus: %v\n", err)
+		}
+		signaler = routesWs.NewHub(store, b)
+	}
+
+	limits, err := config.ParseRateLimits(cfg.RateLimit.Limits)
+	if err != nil {
+		log.Fatalf("Invalid rate limits: %v\n", err)
+	}
+	shareLimits, err := config.ParseRateLimits(cfg.RateLimit.ShareLimits)
+	if err != nil {
+		log.Fatalf("Invalid share rate limits: %v\n", err)
+	}
+	var limiterBackend handler.LimiterBackend
+	switch cfg.RateLimit.Backend {
+	case "memory":
+		limiterBackend = handler.NewMemoryLimiter()
+	case "redis":
+		limiterBackend, err = handler.ConnectRedisLimiter(cfg.RateLimit.Addr)
+		if err != nil {
+			log.Fatalf("Error connecting to the rate limit redis: %v\n", err)
+		}
+	}
+	limiter := handler.NewRateLimiter(limiterBackend, limits, shareLimits, cfg.RateLimit.TrustProxy)
+	var lockoutBackend handler.LockoutBackend
+	switch cfg.Lockout.Backend {
+	case "memory":
+		lockoutBackend = handler.NewMemoryLockout()
+	case "redis":
+		// checked by Validate
+		lockoutBackend = limiterBackend.(*handler.RedisLimiter).Lockout()
+	}
+	lockout := handler.NewLockout(lockoutBackend, cfg.Lockout.Failures, cfg.Lockout.Duration, cfg.Lockout.MaxDuration)
+
+	auditLog := audit.NewLog(store, cfg.RateLimit.TrustProxy, cfg.Retention)
+
+	api := routes.NewApi(store, tokens, lockout, auditLog, cfg.FilesTtl, cfg.FilesMinTtl, cfg.FilesMaxTtl, cfg.Ice)
+	wsServer := routesWs.NewServer(store, signaler, tokens, cfg.RateLimit.TrustProxy, cfg.HostGrace, cfg.Websocket, cfg.FileRelay, cfg.Retention, auditLog)
 
 	router := mux.NewRouter()
-	api := router.PathPrefix("/api").Subrouter()
+	apiRouter := router.PathPrefix("/api").Subrouter()
 
 	// files
-	api.Handle("/files/remove", handler.HandleBody(routes.RemoveFilesHandler)).Methods("POST")
-	api.Handle("/files/add", handler.HandleBody(routes.AddFileHandler)).Methods("POST")
-	api.Handle("/files/new", handler.HandleBody(routes.NewFileHandler)).Methods("POST")
-	api.HandleFunc("/files/{objId}", routes.GetFilesHandler).Methods("GET")
+	apiRouter.Handle("/files/remove", limiter.Limit("files/remove", tokens.RequireToken(handler.PermRemove, handler.HandleBody(api.RemoveFilesHandler)))).Methods("POST")
+	apiRouter.Handle("/files/digests", limiter.Limit("files/digests", tokens.RequireToken(handler.PermAdd, handler.HandleBody(api.SetDigestsHandler)))).Methods("POST")
+	apiRouter.Handle("/files/add", limiter.Limit("files/add", tokens.RequireToken(handler.PermAdd, handler.HandleBody(api.AddFileHandler)))).Methods("POST")
+	apiRouter.Handle("/files/extend", limiter.Limit("files/extend", tokens.RequireToken(handler.PermHost, handler.HandleBody(api.ExtendHandler)))).Methods("POST")
+	apiRouter.Handle("/files/new", limiter.Limit("files/new", handler.HandleBody(api.NewFileHandler))).Methods("POST")
+	apiRouter.Handle("/files/{objId}", limiter.Limit("files/get", http.HandlerFunc(api.GetFilesHandler))).Methods("GET")
+
+	// tokens
+	apiRouter.Handle("/token/new", limiter.Limit("token/new", handler.HandleBody(api.NewTokenHandler))).Methods("POST")
+	apiRouter.Handle("/token/refresh", limiter.Limit("token/refresh", tokens.RequireToken("", http.HandlerFunc(api.RefreshTokenHandler)))).Methods("POST")
+	apiRouter.Handle("/token/revoke", limiter.Limit("token/revoke", tokens.RequireToken("", http.HandlerFunc(api.RevokeTokenHandler)))).Methods("POST")
+
+	// audit
+	apiRouter.Handle("/audit/{objId}", limiter.Limit("audit", tokens.RequireToken(handler.PermAudit, http.HandlerFunc(api.AuditHandler)))).Methods("GET")
 
 	// signaling
-	api.Handle("/signaling/new", handler.HandleBody(routes.NewSignalingHandler)).Methods("POST")
+	apiRouter.Handle("/signaling/new", limiter.Limit("signaling/new", handler.HandleBody(api.NewSignalingHandler))).Methods("POST")
+
+	// ice servers
+	apiRouter.Handle("/ice/host", limiter.Limit("ice/host", tokens.RequireToken(handler.PermHost, handler.HandleBody(api.HostIceServersHandler)))).Methods("POST")
 
 	// ws
-	api.HandleFunc("/ws/conn/{objId}", routesWs.WsHandler(routesWs.WsRoleConn))
-	api.HandleFunc("/ws/host/{objId}", routesWs.WsHandler(routesWs.WsRoleHost))
+	apiRouter.Handle("/ws/conn/{objId}", limiter.Limit("ws/conn", http.HandlerFunc(wsServer.WsHandler(routesWs.WsRoleConn))))
+	apiRouter.Handle("/ws/host/{objId}", limiter.Limit("ws/host", http.HandlerFunc(wsServer.WsHandler(routesWs.WsRoleHost))))
+	apiRouter.Handle("/ws/relay/conn/{objId}", limiter.Limit("ws/relay", http.HandlerFunc(wsServer.RelayHandler(routesWs.WsRoleConn))))
+	apiRouter.Handle("/ws/relay/host/{objId}", limiter.Limit("ws/relay", http.HandlerFunc(wsServer.RelayHandler(routesWs.WsRoleHost))))
+
+	// stats
+	if cfg.StatsToken != "" {
+		apiRouter.Handle("/stats", limiter.Limit("stats", handler.RequireStaticToken(cfg.StatsToken, http.HandlerFunc(wsServer.StatsHandler)))).Methods("GET")
+	}
 
 	// ping
-	api.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+	apiRouter.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("pong"))
 	})
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"*"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
+		AllowedOrigins:   cfg.Cors.AllowedOrigins,
+		AllowedMethods:   cfg.Cors.AllowedMethods,
+		AllowedHeaders:   cfg.Cors.AllowedHeaders,
+		AllowCredentials: cfg.Cors.AllowCredentials,
 	})
 
 	handler := c.Handler(router)
 
-	log.Println("Listening in 0.0.0.0:8900")
-	if err := http.ListenAndServe("0.0.0.0:8900", handler); err != nil {
-		log.Fatalf("Error setting up listener: %v\n", err)
+	server := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: handler,
+	}
+
+	go func() {
+		log.Println("Listening in " + cfg.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error setting up listener: %v\n", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %v, shutting down\n", <-signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// stops accepting connections and waits for the http requests, the
+	// websockets are hijacked so they are closed by the ws server
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down the http server: %v\n", err)
+	}
+	if err := wsServer.Shutdown(ctx); err != nil {
+		log.Printf("Error closing the websockets: %v\n", err)
+	}
+
+	if b != nil {
+		b.Close()
+	}
+	limiterBackend.Close()
+	if err := store.Close(); err != nil {
+		log.Printf("Error closing the store: %v\n", err)
 	}
+	log.Println("Shut down")
 }
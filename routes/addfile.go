@@ -4,79 +4,298 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
 
 	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type NewUrlRequest struct {
-	Password string        `json:"password"`
-	Files    []schema.File `json:"files"`
+	Password string `json:"password"`
+	// the names can be paths relative to the share, the files of dirs are
+	// added to them
+	Files []schema.File    `json:"files"`
+	Dirs  schema.Directory `json:"dirs"`
+	// lifetime of the share in seconds, the default one if 0
+	Ttl int64 `json:"ttl"`
 }
 
 type NewUrlResponse struct {
-	Url           string `json:"url"`
-	PasswordFiles string `json:"passwordFiles" validate:"required"` // password files
+	Url string `json:"url"`
+	// only needed to get a new token (/token/new) once the last one expired
+	PasswordFiles string `json:"passwordFiles" validate:"required"`
+	// scoped to the url with every permission
+	Token         string `json:"token"`
+	TokenExpireAt int64  `json:"tokenExpireAt"`
+	// only with the audit permission, it reads the audit log after the share
+	// is deleted
+	AuditToken         string `json:"auditToken"`
+	AuditTokenExpireAt int64  `json:"auditTokenExpireAt"`
+	// unix seconds, the share is deleted then unless it's extended
+	ExpireAt int64 `json:"expireAt"`
 }
 
-func NewFileHandler(req *http.Request, newUrl NewUrlRequest) (*NewUrlResponse, error) {
+func (a *Api) NewFileHandler(req *http.Request, newUrl NewUrlRequest) (*NewUrlResponse, error) {
+	ttl, err := a.lifetime(newUrl.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
 	bytes := make([]byte, 20)
 	if _, err := rand.Read(bytes); err != nil {
 		return nil, errors.New("error while creating url")
 	}
 	passwordFiles := base64.RawStdEncoding.EncodeToString(bytes)
 
-	filesSchema := schema.NewFileSchema(newUrl.Password, passwordFiles, newUrl.Files, mongoclient.MongoLastUpdateTTL)
+	files, err := shareFiles(newUrl.Files, newUrl.Dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	filesSchema := schema.NewFileSchema(newUrl.Password, passwordFiles, files, ttl)
 
-	objId, err := mongoclient.Mongo.CreateFilesDoc(filesSchema)
+	objId, err := a.store.CreateFilesDoc(filesSchema)
+	if err != nil {
+		return nil, errors.New("error while creating url")
+	}
+
+	event := schema.NewAuditEventSchema(*objId, schema.AuditShareCreated)
+	event.Files = fileNames(files)
+	a.audit.RecordRequest(req, event)
+
+	token, claims, err := a.tokens.Issue(objId.Hex(), handler.AllPermissions)
+	if err != nil {
+		return nil, errors.New("error while creating url")
+	}
+	auditToken, auditClaims, err := a.tokens.Issue(objId.Hex(), handler.AuditPermissions)
 	if err != nil {
 		return nil, errors.New("error while creating url")
 	}
 
 	return &NewUrlResponse{
-		Url:           objId.Hex(),
-		PasswordFiles: passwordFiles,
+		Url:                objId.Hex(),
+		PasswordFiles:      passwordFiles,
+		Token:              token,
+		TokenExpireAt:      claims.ExpireAt,
+		AuditToken:         auditToken,
+		AuditTokenExpireAt: auditClaims.ExpireAt,
+		ExpireAt:           filesSchema.ExpireAt.Unix(),
 	}, nil
 }
 
 //----------------------------------------------------------------------
 
+// needs a token with the add permission. Like in NewUrlRequest, the names
+// can be paths and the files of dirs are added to them
 type AddFileRequest struct {
-	Url           string        `json:"url" validate:"required"`
-	PasswordFiles string        `json:"passwordFiles" validate:"required"` // password files
-	Files         []schema.File `json:"files"`
+	Url   string           `json:"url" validate:"required"`
+	Files []schema.File    `json:"files"`
+	Dirs  schema.Directory `json:"dirs"`
+}
+
+func (a *Api) AddFileHandler(req *http.Request, addFile AddFileRequest) (*any, error) {
+	if !handler.ClaimsFromContext(req.Context()).Allows(addFile.Url, handler.PermAdd) {
+		return nil, handler.NewHttpError(http.StatusForbidden, "token not valid for this url")
+	}
+
+	files, err := shareFiles(addFile.Files, addFile.Dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.store.AddFiles(addFile.Url, files)
+	if errors.Is(err, mongoclient.ErrFileExists) {
+		return nil, handler.NewHttpError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.recordFiles(req, addFile.Url, schema.AuditFilesAdded, fileNames(files))
+	return nil, nil
+}
+
+// the files and the files of the dirs, by path
+func shareFiles(files []schema.File, dirs schema.Directory) ([]schema.File, error) {
+	root := schema.DirectoryContent{
+		Files: files,
+		Dirs:  dirs,
+	}
+
+	flat, err := root.Flatten()
+	if err != nil {
+		return nil, err
+	}
+	if err := schema.CheckDigests(flat); err != nil {
+		return nil, err
+	}
+	return flat, schema.CheckPaths(flat)
+}
+
+//----------------------------------------------------------------------
+
+// needs a token with the add permission. Sets the digest of files already
+// shared (by path), for a host that hashes them after sharing
+type SetDigestsRequest struct {
+	Url     string                       `json:"url" validate:"required"`
+	Digests map[string]schema.FileDigest `json:"digests"`
+}
+
+func (a *Api) SetDigestsHandler(req *http.Request, setDigests SetDigestsRequest) (*any, error) {
+	if !handler.ClaimsFromContext(req.Context()).Allows(setDigests.Url, handler.PermAdd) {
+		return nil, handler.NewHttpError(http.StatusForbidden, "token not valid for this url")
+	}
+
+	current, err := a.store.GetFiles(setDigests.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]schema.File, 0, len(setDigests.Digests))
+	for name, digest := range setDigests.Digests {
+		i := slices.IndexFunc(*current, func(f schema.File) bool {
+			return f.Name == name
+		})
+		if i == -1 {
+			return nil, fmt.Errorf("file %q isn't shared", name)
+		}
+
+		file := (*current)[i]
+		file.Digest = &digest
+		files = append(files, file)
+	}
+	if err := schema.CheckDigests(files); err != nil {
+		return nil, err
+	}
+
+	return nil, a.store.SetDigests(setDigests.Url, setDigests.Digests)
 }
 
-func AddFileHandler(req *http.Request, addFile AddFileRequest) (*any, error) {
-	err := mongoclient.Mongo.AddFiles(addFile.Url, addFile.PasswordFiles, addFile.Files)
-	return nil, err
+func fileNames(files []schema.File) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func (a *Api) recordFiles(req *http.Request, url string, eventType string, files []string) {
+	objId, err := primitive.ObjectIDFromHex(url)
+	if err != nil {
+		return
+	}
+
+	event := schema.NewAuditEventSchema(objId, eventType)
+	event.Files = files
+	a.audit.RecordRequest(req, event)
 }
 
 //----------------------------------------------------------------------
 
-func GetFilesHandler(w http.ResponseWriter, req *http.Request) {
+// the directory tree of the files, or the files by path with ?flat=true
+func (a *Api) GetFilesHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	result, err := mongoclient.Mongo.GetFiles(vars["objId"])
+	flat, _ := strconv.ParseBool(req.URL.Query().Get("flat"))
+
+	result, err := a.store.GetFiles(vars["objId"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	handler.SendResponse(w, result)
+
+	if flat {
+		handler.SendResponse(w, result)
+		return
+	}
+	handler.SendResponse(w, schema.NewDirectoryContent(*result))
 }
 
 // ----------------------------------------------------------------------
 
+// needs a token with the remove permission. Files are paths, every file
+// inside of dirs (its whole subtree) is removed too
 type RemoveFilesRequest struct {
-	Url           string   `json:"url" validate:"required"`
-	PasswordFiles string   `json:"passwordFiles" validate:"required"` // password files
-	Files         []string `json:"files" validate:"required"`
+	Url   string   `json:"url" validate:"required"`
+	Files []string `json:"files"`
+	Dirs  []string `json:"dirs"`
+}
+
+func (a *Api) RemoveFilesHandler(req *http.Request, removeFile RemoveFilesRequest) (*any, error) {
+	if !handler.ClaimsFromContext(req.Context()).Allows(removeFile.Url, handler.PermRemove) {
+		return nil, handler.NewHttpError(http.StatusForbidden, "token not valid for this url")
+	}
+
+	files := removeFile.Files
+	if len(removeFile.Dirs) != 0 {
+		current, err := a.store.GetFiles(removeFile.Url)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range *current {
+			if schema.InDirs(file.Name, removeFile.Dirs) && !slices.Contains(files, file.Name) {
+				files = append(files, file.Name)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	if err := a.store.RemoveFiles(removeFile.Url, files); err != nil {
+		return nil, err
+	}
+
+	a.recordFiles(req, removeFile.Url, schema.AuditFilesRemoved, files)
+	return nil, nil
 }
 
-func RemoveFilesHandler(req *http.Request, removeFile RemoveFilesRequest) (*any, error) {
-	err := mongoclient.Mongo.RemoveFiles(removeFile.Url, removeFile.PasswordFiles, removeFile.Files)
-	return nil, err
+// ----------------------------------------------------------------------
+
+// needs a token with the host permission, only while the share is hosted
+type ExtendRequest struct {
+	Url string `json:"url" validate:"required"`
+	// the share expires this many seconds from now, the default lifetime if 0
+	Ttl int64 `json:"ttl"`
+}
+
+type ExtendResponse struct {
+	// unix seconds
+	ExpireAt int64 `json:"expireAt"`
+}
+
+func (a *Api) ExtendHandler(req *http.Request, extend ExtendRequest) (*ExtendResponse, error) {
+	if !handler.ClaimsFromContext(req.Context()).Allows(extend.Url, handler.PermHost) {
+		return nil, handler.NewHttpError(http.StatusForbidden, "token not valid for this url")
+	}
+
+	ttl, err := a.lifetime(extend.Ttl)
+	if err != nil {
+		return nil, err
+	}
+	expireAt := time.Now().Add(ttl)
+
+	err = a.store.UpdateTTL(extend.Url, expireAt)
+	if errors.Is(err, mongoclient.ErrNotFound) {
+		return nil, handler.NewHttpError(http.StatusNotFound, "share not hosted or already expired")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objId, _ := primitive.ObjectIDFromHex(extend.Url)
+	event := schema.NewAuditEventSchema(objId, schema.AuditShareExtended)
+	event.Detail = expireAt.UTC().Format(time.RFC3339)
+	a.audit.RecordRequest(req, event)
+
+	return &ExtendResponse{
+		ExpireAt: expireAt.Unix(),
+	}, nil
 }
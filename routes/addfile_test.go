@@ -0,0 +1,78 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"github.com/gorilla/mux"
+)
+
+func TestGetFilesHandler(t *testing.T) {
+	store := mongoclient.NewMemoryStore()
+	files := []schema.File{{Name: "a", Length: 1}, {Name: "src/b", Length: 2}, {Name: "src/lib/c", Length: 3}}
+	filesId, err := store.CreateFilesDoc(schema.NewFileSchema("user", "files", files, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewApi(store, nil, nil, nil, time.Hour, time.Minute, time.Hour, config.IceConfig{})
+
+	get := func(t *testing.T, query string, response any) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/files/"+filesId.Hex()+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"objId": filesId.Hex()})
+		w := httptest.NewRecorder()
+		a.GetFilesHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status %v: %s", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"default", ""},
+		{"not flat", "?flat=false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tree schema.DirectoryContent
+			get(t, tt.query, &tree)
+
+			if tree.Count != 3 || tree.Length != 6 || len(tree.Files) != 1 || tree.Files[0].Name != "a" {
+				t.Errorf("root %+v", tree)
+			}
+			src := tree.Dirs["src"]
+			if src.Count != 2 || src.Length != 5 || len(src.Files) != 1 || src.Files[0].Name != "b" {
+				t.Errorf("src %+v", src)
+			}
+			if lib := src.Dirs["lib"]; lib.Count != 1 || len(lib.Files) != 1 || lib.Files[0].Name != "c" {
+				t.Errorf("src/lib %+v", lib)
+			}
+		})
+	}
+
+	t.Run("flat", func(t *testing.T) {
+		var flat []schema.File
+		get(t, "?flat=true", &flat)
+
+		if len(flat) != len(files) {
+			t.Fatalf("got %+v, want %+v", flat, files)
+		}
+		for i := range files {
+			if flat[i].Name != files[i].Name || flat[i].Length != files[i].Length {
+				t.Errorf("file %v: got %+v, want %+v", i, flat[i], files[i])
+			}
+		}
+	})
+}
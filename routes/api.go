@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/audit"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+)
+
+// Api holds the dependencies shared by the http handlers
+type Api struct {
+	store   mongoclient.Store
+	tokens  *handler.Tokens
+	lockout *handler.Lockout
+	audit   *audit.Log
+	// lifetime of the files docs that don't request one, the requested ones
+	// must be between filesMinTtl and filesMaxTtl
+	filesTtl    time.Duration
+	filesMinTtl time.Duration
+	filesMaxTtl time.Duration
+	ice         config.IceConfig
+}
+
+func NewApi(store mongoclient.Store, tokens *handler.Tokens, lockout *handler.Lockout, audit *audit.Log, filesTtl time.Duration, filesMinTtl time.Duration, filesMaxTtl time.Duration, ice config.IceConfig) *Api {
+	return &Api{
+		store:       store,
+		tokens:      tokens,
+		lockout:     lockout,
+		audit:       audit,
+		filesTtl:    filesTtl,
+		filesMinTtl: filesMinTtl,
+		filesMaxTtl: filesMaxTtl,
+		ice:         ice,
+	}
+}
+
+// the lifetime of ttl (seconds), filesTtl if it's 0
+func (a *Api) lifetime(ttl int64) (time.Duration, error) {
+	if ttl == 0 {
+		return a.filesTtl, nil
+	}
+
+	lifetime := time.Duration(ttl) * time.Second
+	if ttl < 0 || lifetime < a.filesMinTtl || lifetime > a.filesMaxTtl {
+		return 0, fmt.Errorf("ttl must be between %v and %v seconds", int64(a.filesMinTtl.Seconds()), int64(a.filesMaxTtl.Seconds()))
+	}
+	return lifetime, nil
+}
+
+// checks a password of the files doc, locking the url after too many failures
+func (a *Api) checkPassword(kind string, url string, isValid func() bool) error {
+	key := kind + ":" + url
+
+	if retryAfter, locked := a.lockout.Check(key); locked {
+		return handler.NewRetryError(retryAfter)
+	}
+
+	if !isValid() {
+		a.lockout.Fail(key)
+		return fmt.Errorf("invalid %v", kind)
+	}
+
+	a.lockout.Succeed(key)
+	return nil
+}
@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/audit"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+	"github.com/gorilla/mux"
+)
+
+// needs a token with the audit permission. The events are returned as a json
+// array, or exported as json lines or csv with ?format=jsonl or ?format=csv
+func (a *Api) AuditHandler(w http.ResponseWriter, req *http.Request) {
+	filesId := mux.Vars(req)["objId"]
+
+	if !handler.ClaimsFromContext(req.Context()).Allows(filesId, handler.PermAudit) {
+		http.Error(w, "token not valid for this url", http.StatusForbidden)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = audit.FormatJson
+	}
+	contentType, ok := audit.ContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	events, err := a.audit.Events(filesId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if format != audit.FormatJson {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%v.%v"`, filesId, format))
+	}
+	if err := audit.Write(w, format, events); err != nil {
+		fmt.Printf("audit export err: %v\n", err)
+	}
+}
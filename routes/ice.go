@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+)
+
+// like the RTCIceServer of the browsers
+type IceServer struct {
+	Urls       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type IceServersResponse struct {
+	IceServers []IceServer `json:"iceServers"`
+	// unix seconds, when the TURN credentials expire (0 without TURN servers)
+	ExpireAt int64 `json:"expireAt,omitempty"`
+}
+
+// needs a token with the host permission, the TURN credentials are scoped to
+// the files id
+type HostIceServersRequest struct {
+	Url string `json:"url" validate:"required"`
+}
+
+func (a *Api) HostIceServersHandler(req *http.Request, params HostIceServersRequest) (*IceServersResponse, error) {
+	if !handler.ClaimsFromContext(req.Context()).Allows(params.Url, handler.PermHost) {
+		return nil, handler.NewHttpError(http.StatusForbidden, "token not valid for this url")
+	}
+
+	return a.iceServers(params.Url), nil
+}
+
+// the configured servers, with TURN credentials for user
+func (a *Api) iceServers(user string) *IceServersResponse {
+	res := &IceServersResponse{
+		IceServers: []IceServer{},
+	}
+	if len(a.ice.StunUrls) != 0 {
+		res.IceServers = append(res.IceServers, IceServer{Urls: a.ice.StunUrls})
+	}
+
+	if len(a.ice.TurnUrls) != 0 {
+		expireAt := time.Now().Add(a.ice.TurnTtl)
+		username, credential := handler.TurnCredentials(a.ice.TurnSecret, user, expireAt)
+
+		res.IceServers = append(res.IceServers, IceServer{
+			Urls:       a.ice.TurnUrls,
+			Username:   username,
+			Credential: credential,
+		})
+		res.ExpireAt = expireAt.Unix()
+	}
+	return res
+}
@@ -1,10 +1,11 @@
 package routes
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 
 	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
 	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -16,11 +17,20 @@ type NewSignalingRequest struct {
 
 type NewSignalingResponse struct {
 	Id string `json:"id"`
+	// sent by the websockets of the conn (?secret=), only the client that
+	// created the doc can use it
+	Secret string `json:"secret"`
+	// the TURN credentials are scoped to the id, only the conns that know
+	// the password get them
+	Ice *IceServersResponse `json:"ice"`
 }
 
-func NewSignalingHandler(req *http.Request, params NewSignalingRequest) (*NewSignalingResponse, error) {
-	if !mongoclient.Mongo.IsPasswordUserValid(params.Url, params.PasswordUser) {
-		return nil, fmt.Errorf("invalid password")
+func (a *Api) NewSignalingHandler(req *http.Request, params NewSignalingRequest) (*NewSignalingResponse, error) {
+	err := a.checkPassword("password", params.Url, func() bool {
+		return a.store.IsPasswordUserValid(params.Url, params.PasswordUser)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	objId, err := primitive.ObjectIDFromHex(params.Url)
@@ -28,14 +38,24 @@ func NewSignalingHandler(req *http.Request, params NewSignalingRequest) (*NewSig
 		return nil, err
 	}
 
+	secret, hash, err := handler.NewSecret()
+	if err != nil {
+		return nil, err
+	}
 	signalingDoc := schema.NewSignalingSchema(objId)
+	signalingDoc.Secret = hash
 
-	id, err := mongoclient.Mongo.CreateSignalingDoc(signalingDoc)
+	id, err := a.store.CreateSignalingDoc(signalingDoc)
+	if errors.Is(err, mongoclient.ErrNotFound) {
+		return nil, handler.NewHttpError(http.StatusNotFound, "share not found")
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &NewSignalingResponse{
-		Id: id.Hex(),
+		Id:     id.Hex(),
+		Secret: secret,
+		Ice:    a.iceServers(id.Hex()),
 	}, nil
 }
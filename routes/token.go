@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+)
+
+type NewTokenRequest struct {
+	Url           string `json:"url" validate:"required"`
+	PasswordFiles string `json:"passwordFiles" validate:"required"`
+}
+
+type TokenResponse struct {
+	Token    string `json:"token"`
+	ExpireAt int64  `json:"expireAt"`
+}
+
+// issues a token with every permission, for a host whose token expired
+func (a *Api) NewTokenHandler(req *http.Request, newToken NewTokenRequest) (*TokenResponse, error) {
+	err := a.checkPassword("password files", newToken.Url, func() bool {
+		return a.store.IsPasswordFilesValid(newToken.Url, newToken.PasswordFiles)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.issueToken(newToken.Url, handler.AllPermissions)
+}
+
+//----------------------------------------------------------------------
+
+// needs a token, which is revoked and replaced by a new one with the same
+// url and permissions
+func (a *Api) RefreshTokenHandler(w http.ResponseWriter, req *http.Request) {
+	claims := handler.ClaimsFromContext(req.Context())
+
+	result, err := a.issueToken(claims.FilesId, claims.Perms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tokens.Revoke(claims); err != nil {
+		http.Error(w, "error while revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	handler.SendResponse(w, result)
+}
+
+//----------------------------------------------------------------------
+
+// needs a token, which is revoked
+func (a *Api) RevokeTokenHandler(w http.ResponseWriter, req *http.Request) {
+	claims := handler.ClaimsFromContext(req.Context())
+
+	if err := a.tokens.Revoke(claims); err != nil {
+		http.Error(w, "error while revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	handler.SendResponse(w, nil)
+}
+
+func (a *Api) issueToken(filesId string, perms []handler.Permission) (*TokenResponse, error) {
+	token, claims, err := a.tokens.Issue(filesId, perms)
+	if err != nil {
+		return nil, errors.New("error while creating token")
+	}
+
+	return &TokenResponse{
+		Token:    token,
+		ExpireAt: claims.ExpireAt,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// sent by the conn with the chunks of a file (of its chunk manifest) it
+// received and verified. They are added to the checkpoint of the receiver,
+// which is kept until the share expires. The first one of a receiver that
+// didn't resume is answered with a TransferSession
+type Checkpoint struct {
+	File   string              `json:"file" validate:"required"`
+	Chunks []schema.ChunkRange `json:"chunks" validate:"required"`
+}
+
+func (cp *Checkpoint) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	t, err := s.connTransfer(c, *signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := t.lookup(s, cp.File)
+	if err != nil {
+		return nil, err
+	}
+	if file.Digest == nil || file.Digest.ChunkSize == 0 {
+		return nil, fmt.Errorf("file %q has no chunk manifest", cp.File)
+	}
+	if err := schema.CheckRanges(cp.Chunks, file.Digest.ChunkCount(file.Length)); err != nil {
+		return nil, err
+	}
+
+	// the checkpoints expire with the share, which may have been extended
+	doc, err := s.store.GetSignalingDoc(*signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.receiver == "" {
+		resumeToken, receiver, err := newResumeToken()
+		if err != nil {
+			return nil, err
+		}
+		t.receiver = receiver
+		if err := c.Send(newMessage(MsgTransferSession, TransferSession{ResumeToken: resumeToken})); err != nil {
+			return nil, err
+		}
+	}
+
+	checkpoint, ok := t.checkpoints[file.Name]
+	if !ok || checkpoint.ChunkSize != file.Digest.ChunkSize {
+		checkpoint = schema.NewCheckpointSchema(t.filesId, t.receiver, file.Name, file.Digest.ChunkSize, doc.ExpireAt)
+	}
+	checkpoint.Chunks = schema.MergeRanges(checkpoint.Chunks, cp.Chunks)
+	checkpoint.UpdatedAt = time.Now()
+	checkpoint.ExpireAt = doc.ExpireAt
+
+	if err := s.store.SetCheckpoint(checkpoint); err != nil {
+		return nil, err
+	}
+	t.checkpoints[file.Name] = checkpoint
+	return nil, nil
+}
+
+// sent to the conn after its first Checkpoint. ResumeToken is used in
+// ResumeTransfer by the next signaling sessions of the receiver (of the same
+// share)
+type TransferSession struct {
+	ResumeToken string `json:"resumeToken"`
+}
+
+// sent by a conn that reconnected (with a new signaling doc) after it was
+// approved, with the resume token of its TransferSession. The conn and the
+// host receive it without the token, with the chunks the receiver still
+// needs of every file that has a chunk manifest
+type ResumeTransfer struct {
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// filled by the server
+	Files []NeededChunks `json:"files,omitempty"`
+}
+
+// the chunks of a file not in the checkpoint of the receiver, empty if it
+// has them all
+type NeededChunks struct {
+	Name      string              `json:"name"`
+	ChunkSize uint64              `json:"chunkSize"`
+	Chunks    []schema.ChunkRange `json:"chunks"`
+}
+
+func (r *ResumeTransfer) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if r.ResumeToken == "" {
+		return nil, fmt.Errorf("the resume token is required")
+	}
+
+	t, err := s.connTransfer(c, *signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	receiver := hashResumeToken(r.ResumeToken)
+	docs, err := s.store.GetCheckpoints(t.filesId.Hex(), receiver)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("invalid resume token or the checkpoints expired")
+	}
+
+	t.receiver = receiver
+	t.checkpoints = map[string]schema.CheckpointSchema{}
+	for _, doc := range docs {
+		t.checkpoints[doc.File] = doc
+	}
+
+	// the host may have changed the files since the last session
+	if err := t.loadFiles(s); err != nil {
+		return nil, err
+	}
+
+	r.ResumeToken = ""
+	r.Files = t.neededChunks()
+
+	msg := newMessage(MsgResumeTransfer, r)
+	if err := c.Send(msg); err != nil {
+		return nil, err
+	}
+	return nil, s.signaler.SendToHost(*signalingDoc, msg)
+}
+
+func (t *transfer) neededChunks() []NeededChunks {
+	needed := []NeededChunks{}
+	for _, file := range t.files {
+		if file.Digest == nil || file.Digest.ChunkSize == 0 {
+			continue
+		}
+
+		var acknowledged []schema.ChunkRange
+		if checkpoint, ok := t.checkpoints[file.Name]; ok && checkpoint.ChunkSize == file.Digest.ChunkSize {
+			acknowledged = checkpoint.Chunks
+		}
+
+		needed = append(needed, NeededChunks{
+			Name:      file.Name,
+			ChunkSize: file.Digest.ChunkSize,
+			Chunks:    schema.MissingRanges(acknowledged, file.Digest.ChunkCount(file.Length)),
+		})
+	}
+	return needed
+}
@@ -0,0 +1,255 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// received messages waiting to be processed, when full the socket isn't
+	// read until the processor catches up
+	inQueueSize = 16
+	// messages waiting to be written, when full the client is too slow and
+	// the websocket is closed
+	outQueueSize = 128
+	// longest write of the close frame, and of the write it waits for
+	closeTimeout = time.Second
+)
+
+var (
+	errConnClosed = errors.New("websocket closed")
+	errSlowConn   = errors.New("websocket outbound queue full")
+	errListening  = errors.New("the websocket is already listening")
+)
+
+// WsConn owns a websocket: the received messages are processed in order by
+// one goroutine and the messages sent by the processors and listeners are
+// written by another one, so the socket is never written concurrently
+type WsConn struct {
+	ws        *websocket.Conn
+	keepalive config.WebsocketConfig
+	in        chan inMessage
+	out       chan outMessage
+
+	// progress reported by a conn, only used by the processor goroutine
+	transfer *transfer
+	// set once ListenOffersHost, ResumeHost or ListenOffersConn succeeded,
+	// another listen would relay every message twice. Only used by the
+	// processor goroutine
+	listening bool
+	// signaling docs already checked, only used by the processor goroutine.
+	// A doc never moves to another share and the approval of the host is
+	// final, so they aren't read for every message
+	shareDocs map[string]bool
+	approved  map[string]bool
+
+	// closed when the websocket is closed, the queued messages are dropped
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type inMessage struct {
+	data   []byte
+	binary bool
+}
+
+// like websocket.Message, but keeps whether the message is binary
+var inCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		in := v.(*inMessage)
+		in.data = data
+		in.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+type outMessage struct {
+	msg Message
+	// sent as a binary message instead of msg
+	data []byte
+	// close the websocket once msg is written
+	closeAfter bool
+}
+
+func newWsConn(ws *websocket.Conn, keepalive config.WebsocketConfig) *WsConn {
+	return &WsConn{
+		ws:        ws,
+		keepalive: keepalive,
+		in:        make(chan inMessage, inQueueSize),
+		out:       make(chan outMessage, outQueueSize),
+		done:      make(chan struct{}),
+		shareDocs: map[string]bool{},
+		approved:  map[string]bool{},
+	}
+}
+
+func (c *WsConn) Request() *http.Request {
+	return c.ws.Request()
+}
+
+// reads the websocket until it's closed or idle for the idle timeout,
+// calling process with every message in the order they were received.
+// Returns after the last process call
+func (c *WsConn) run(process func(msg []byte, binary bool)) (timedOut bool) {
+	go c.writeLoop()
+
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		for msg := range c.in {
+			if c.closed() {
+				// nobody to answer to
+				continue
+			}
+			process(msg.data, msg.binary)
+		}
+	}()
+
+	for {
+		if c.keepalive.IdleTimeout > 0 {
+			c.ws.SetReadDeadline(time.Now().Add(c.keepalive.IdleTimeout))
+		}
+
+		var msg inMessage
+		if err := inCodec.Receive(c.ws, &msg); err != nil {
+			var netErr net.Error
+			timedOut = errors.As(err, &netErr) && netErr.Timeout()
+			break
+		}
+		c.in <- msg
+	}
+
+	if timedOut {
+		// in case the client is still there. The write deadline limits the
+		// wait, without one a client that stopped reading doesn't get it and
+		// the close unblocks the writer
+		c.SendAndClose(newMessage(MsgDisconnect, Disconnect{Reason: DisconnectTimeout}))
+		wait := c.keepalive.WriteTimeout
+		if wait == 0 {
+			wait = closeTimeout
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	c.Close()
+	close(c.in)
+	<-processed
+	return timedOut
+}
+
+func (c *WsConn) writeLoop() {
+	defer c.Close()
+
+	// nil (never ticks) without ping interval
+	var heartbeat <-chan time.Time
+	if c.keepalive.PingInterval > 0 {
+		ticker := time.NewTicker(c.keepalive.PingInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case out := <-c.out:
+			if c.write(out) != nil || out.closeAfter {
+				return
+			}
+		case <-heartbeat:
+			if c.write(outMessage{msg: newMessage(MsgHeartbeat, Heartbeat{})}) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// only called by writeLoop
+func (c *WsConn) write(out outMessage) error {
+	if c.keepalive.WriteTimeout > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(c.keepalive.WriteTimeout))
+	}
+
+	if out.data != nil {
+		return websocket.Message.Send(c.ws, out.data)
+	}
+	msgBytes, _ := json.Marshal(out.msg)
+	return websocket.Message.Send(c.ws, string(msgBytes))
+}
+
+// queues msg, it doesn't wait for it to be written. If the queue is full the
+// websocket is closed, the client reconnects and gets the messages replayed
+func (c *WsConn) Send(msg Message) error {
+	return c.enqueue(outMessage{msg: msg})
+}
+
+// queues a binary message. Unlike Send it waits while the queue is full, the
+// relay window bounds what the sender can queue
+func (c *WsConn) SendBinary(data []byte) error {
+	select {
+	case c.out <- outMessage{data: data}:
+		return nil
+	case <-c.done:
+		return errConnClosed
+	}
+}
+
+func (c *WsConn) SendError(err error) {
+	c.Send(newMessage(MsgError, MessageError{
+		Msg: err.Error(),
+	}))
+}
+
+// closes the websocket after msg is written
+func (c *WsConn) SendAndClose(msg Message) {
+	if c.enqueue(outMessage{msg: msg, closeAfter: true}) != nil {
+		c.Close()
+	}
+}
+
+func (c *WsConn) enqueue(out outMessage) error {
+	if c.closed() {
+		return errConnClosed
+	}
+
+	select {
+	case c.out <- out:
+		return nil
+	default:
+		fmt.Printf("ws %v: %v, closing\n", c.ws.Request().RemoteAddr, errSlowConn)
+		c.Close()
+		return errSlowConn
+	}
+}
+
+func (c *WsConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		// the close frame waits for the write in progress, which never ends
+		// if the client stopped reading and there's no write timeout
+		c.ws.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.ws.Close()
+	})
+}
+
+func (c *WsConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+)
+
+// the messages are processed and answered in the order they were received,
+// and the socket is never written concurrently, even with the heartbeats
+func TestConnOrder(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.keepalive = config.WebsocketConfig{PingInterval: time.Millisecond}
+	})
+	c := s.dial(t, "/ws/host/"+s.newShare(t))
+
+	const n = 100
+	for i := 1; i <= n; i++ {
+		c.sendMessage(Message{Type: MessageType(-i)})
+	}
+
+	for i := 1; i <= n; i++ {
+		msg := c.receive()
+		for msg.Type == MsgHeartbeat {
+			msg = c.receive()
+		}
+
+		var msgErr MessageError
+		if msg.Type != MsgError || json.Unmarshal(msg.Data, &msgErr) != nil {
+			t.Fatalf("received %v %s, want an error", msg.Type, msg.Data)
+		}
+		if want := fmt.Sprintf("error getting message kind: unknown message type %v", -i); msgErr.Msg != want {
+			t.Fatalf("got %q, want %q", msgErr.Msg, want)
+		}
+	}
+
+	if s.listener.concurrentWrites.Load() {
+		t.Error("concurrent writes")
+	}
+}
+
+// a client that doesn't read its messages is disconnected once its queue is
+// full
+func TestConnOutQueueFull(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.dial(t, "/ws/host/"+s.newShare(t))
+	eventually(t, "websocket tracked", func() bool { return s.websockets() == 1 })
+
+	s.listener.pauseWrites()
+	// one is being written, outQueueSize wait for it and the last one doesn't fit
+	for i := 0; i < outQueueSize+2; i++ {
+		c.sendMessage(Message{Type: -1})
+	}
+
+	eventually(t, "websocket closed", func() bool { return s.websockets() == 0 })
+	s.listener.resumeWrites()
+	c.receiveClose()
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.keepalive = config.WebsocketConfig{IdleTimeout: 100 * time.Millisecond}
+	})
+	filesId := s.newShare(t)
+	host, _ := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+
+	host.keepAlive(30 * time.Millisecond)
+
+	var disconnect Disconnect
+	conn.receiveType(MsgDisconnect, &disconnect)
+	if disconnect.Reason != DisconnectTimeout {
+		t.Errorf("reason %q, want %q", disconnect.Reason, DisconnectTimeout)
+	}
+	conn.receiveClose()
+
+	if event := receivePresence(t, host, signalingId); event != PresenceTimedOut {
+		t.Errorf("presence %q, want %q", event, PresenceTimedOut)
+	}
+}
+
+// a client that stopped reading is closed without a write timeout
+func TestConnIdleTimeoutNotReading(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.keepalive = config.WebsocketConfig{IdleTimeout: 100 * time.Millisecond}
+	})
+	s.dial(t, "/ws/host/"+s.newShare(t))
+	eventually(t, "websocket tracked", func() bool { return s.websockets() == 1 })
+
+	s.listener.pauseWrites()
+	// the disconnect waits for closeTimeout, then its close frame too
+	time.Sleep(2 * closeTimeout)
+	eventually(t, "websocket closed", func() bool { return s.websockets() == 0 })
+}
+
+func TestConnHeartbeat(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.keepalive = config.WebsocketConfig{PingInterval: 50 * time.Millisecond, IdleTimeout: 150 * time.Millisecond}
+	})
+	c := s.dial(t, "/ws/host/"+s.newShare(t))
+
+	// answering the heartbeats keeps the websocket open past the idle timeout
+	for i := 0; i < 6; i++ {
+		c.receiveType(MsgHeartbeat, nil)
+		c.send(MsgHeartbeat, Heartbeat{})
+	}
+
+	// without answers it's closed
+	deadline := time.Now().Add(testReceiveTimeout)
+	for {
+		msg := c.receive()
+		if msg.Type == MsgDisconnect {
+			break
+		}
+		if msg.Type != MsgHeartbeat || time.Now().After(deadline) {
+			t.Fatalf("received %v %s, want heartbeats until the disconnect", msg.Type, msg.Data)
+		}
+	}
+	c.receiveClose()
+}
+
+// without ping interval nor idle timeout a silent websocket stays open
+func TestConnNoKeepalive(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.dial(t, "/ws/host/"+s.newShare(t))
+	c.receiveNothing()
+}
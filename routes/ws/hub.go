@@ -0,0 +1,206 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/bus"
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// Hub relays the signaling messages between the websockets through a bus,
+// without waiting for the database. With the memory bus the host and conn
+// must be connected to the same instance, other buses reach every instance.
+// The messages are still saved in the signaling doc like with the store
+// signaler, but only to replay them to a host or conn that starts listening
+// (or resumes) after they were sent
+type Hub struct {
+	store mongoclient.Store
+	bus   bus.Bus
+
+	mu sync.RWMutex
+	// signalingId -> filesId of the conns listening in this instance, so the
+	// store isn't queried for every message
+	filesIds map[string]string
+	// bus subscriptions of the listeners
+	listeners atomic.Int64
+}
+
+func NewHub(store mongoclient.Store, bus bus.Bus) *Hub {
+	return &Hub{
+		store:    store,
+		bus:      bus,
+		filesIds: map[string]string{},
+	}
+}
+
+// published to the bus, Seq is the seq of the signaling doc once msg was
+// saved in it (0 if it wasn't), the listeners skip the messages already in
+// the docs they replayed
+type hubMessage struct {
+	Msg         Message `json:"msg"`
+	SignalingId string  `json:"signalingId"`
+	Seq         int64   `json:"seq,omitempty"`
+}
+
+func hostTopic(filesId string) string {
+	return "host:" + filesId
+}
+
+func connTopic(signalingId string) string {
+	return "conn:" + signalingId
+}
+
+func (h *Hub) ListenHost(ctx context.Context, filesId string, send func(msg Message) bool) error {
+	replay := func() ([]Message, map[string]int64, error) {
+		return hostReplay(h.store, filesId)
+	}
+
+	return h.listen(ctx, hostTopic(filesId), replay, send, func() {})
+}
+
+func (h *Hub) ListenConn(ctx context.Context, signalingId string, send func(msg Message) bool) error {
+	replay := func() ([]Message, map[string]int64, error) {
+		doc, err := h.store.GetSignalingDoc(signalingId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		h.mu.Lock()
+		h.filesIds[signalingId] = doc.FilesId.Hex()
+		h.mu.Unlock()
+
+		var msgs []Message
+		if doc.Status != "" {
+			msgs = append(msgs, statusMessage(doc.Status, doc.RejectMsg))
+		}
+		if doc.Answer != "" {
+			msgs = append(msgs, newMessage(MsgNewAnswer, NewAnswer{Sdp: doc.Answer}))
+		}
+		if doc.Relay == schema.SignalingRelayAccepted {
+			msgs = append(msgs, relayMessage(doc.Relay))
+		}
+		return msgs, map[string]int64{signalingId: doc.Seq}, nil
+	}
+
+	return h.listen(ctx, connTopic(signalingId), replay, send, func() {
+		h.mu.Lock()
+		delete(h.filesIds, signalingId)
+		h.mu.Unlock()
+	})
+}
+
+func (h *Hub) SendToHost(signalingId string, msg Message) error {
+	seq, err := persistMessage(h.store, signalingId, msg)
+	if err != nil {
+		return err
+	}
+
+	filesId, err := h.filesId(signalingId)
+	if err != nil {
+		return err
+	}
+
+	msg.SignalingId = signalingId
+	msgBytes, _ := json.Marshal(hubMessage{Msg: msg, SignalingId: signalingId, Seq: seq})
+	return h.bus.Publish(hostTopic(filesId), msgBytes)
+}
+
+func (h *Hub) SendToConn(signalingId string, msg Message) error {
+	seq, err := persistMessage(h.store, signalingId, msg)
+	if err != nil {
+		return err
+	}
+
+	msgBytes, _ := json.Marshal(hubMessage{Msg: msg, SignalingId: signalingId, Seq: seq})
+	return h.bus.Publish(connTopic(signalingId), msgBytes)
+}
+
+// subscribes to the topic and sends the replayed messages before any message
+// received from the bus, skipping the ones already in the replayed docs
+// (replay returns their seq by signalingId). onClose is called when send
+// returns false or ctx is done
+func (h *Hub) listen(ctx context.Context, topic string, replay func() ([]Message, map[string]int64, error), send func(msg Message) bool, onClose func()) error {
+	var mu sync.Mutex
+	var unsubscribe func()
+	var replayed map[string]int64
+	closed := false
+
+	// mu must be held
+	stopListening := func() {
+		if closed {
+			return
+		}
+		closed = true
+		unsubscribe()
+		h.listeners.Add(-1)
+		onClose()
+	}
+
+	// mu must be held
+	deliver := func(msg Message) {
+		if !closed && !send(msg) {
+			stopListening()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var err error
+	unsubscribe, err = h.bus.Subscribe(topic, func(payload []byte) {
+		var msg hubMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if msg.Seq != 0 && msg.Seq <= replayed[msg.SignalingId] {
+			return
+		}
+		deliver(msg.Msg)
+	})
+	if err != nil {
+		return err
+	}
+	h.listeners.Add(1)
+
+	msgs, replayed, err := replay()
+	if err != nil {
+		stopListening()
+		return err
+	}
+	for _, msg := range msgs {
+		deliver(msg)
+	}
+
+	context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopListening()
+	})
+	return nil
+}
+
+func (h *Hub) ActiveListeners() int64 {
+	return h.listeners.Load()
+}
+
+func (h *Hub) filesId(signalingId string) (string, error) {
+	h.mu.RLock()
+	filesId, ok := h.filesIds[signalingId]
+	h.mu.RUnlock()
+	if ok {
+		return filesId, nil
+	}
+
+	doc, err := h.store.GetSignalingDoc(signalingId)
+	if err != nil {
+		return "", err
+	}
+	return doc.FilesId.Hex(), nil
+}
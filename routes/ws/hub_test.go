@@ -0,0 +1,345 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/bus"
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// calls beforeReplay before reading the signaling docs of a share, to change
+// them while a host listener is starting
+type replayHookStore struct {
+	mongoclient.Store
+	beforeReplay func()
+}
+
+func (s *replayHookStore) GetSignalingDocs(filesId string) ([]schema.SignalingSchema, error) {
+	if s.beforeReplay != nil {
+		s.beforeReplay()
+	}
+	return s.Store.GetSignalingDocs(filesId)
+}
+
+// a share with one signaling doc
+func newTestSignaling(t *testing.T, store mongoclient.Store) (filesId string, signalingId string) {
+	t.Helper()
+
+	filesObjId, err := store.CreateFilesDoc(schema.NewFileSchema("user", "files", nil, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signalingObjId, err := store.CreateSignalingDoc(schema.NewSignalingSchema(*filesObjId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filesObjId.Hex(), signalingObjId.Hex()
+}
+
+// a send func of a listener and the channel of the messages it receives
+func collect() (func(msg Message) bool, chan Message) {
+	msgs := make(chan Message, 100)
+	return func(msg Message) bool {
+		msgs <- msg
+		return true
+	}, msgs
+}
+
+// the types of the next n messages, then checks that no other one arrives
+func receiveTypes(t *testing.T, msgs <-chan Message, n int) []MessageType {
+	t.Helper()
+
+	var types []MessageType
+	for len(types) < n {
+		select {
+		case msg := <-msgs:
+			types = append(types, msg.Type)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v of %v messages: %v", len(types), n, types)
+		}
+	}
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message %v after %v", msg.Type, types)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return types
+}
+
+func equalTypes(a []MessageType, b ...MessageType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHubRelay(t *testing.T) {
+	store := mongoclient.NewMemoryStore()
+	hub := NewHub(store, bus.NewMemoryBus())
+	filesId, signalingId := newTestSignaling(t, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendHost, hostMsgs := collect()
+	if err := hub.ListenHost(ctx, filesId, sendHost); err != nil {
+		t.Fatal(err)
+	}
+	sendConn, connMsgs := collect()
+	if err := hub.ListenConn(ctx, signalingId, sendConn); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		toHost bool
+		msg    Message
+	}{
+		{"offer", true, newMessage(MsgNewOffer, NewOffer{Sdp: "offer"})},
+		{"offer ice", true, newMessage(MsgOfferIceCandidate, IceOfferCandidate{Ice: "ice"})},
+		{"answer", false, newMessage(MsgNewAnswer, NewAnswer{Sdp: "answer"})},
+		{"answer ice", false, newMessage(MsgAnswerIceCandidate, IceAnswerCandidate{Ice: "ice"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send, msgs := hub.SendToConn, connMsgs
+			if tt.toHost {
+				send, msgs = hub.SendToHost, hostMsgs
+			}
+			if err := send(signalingId, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case msg := <-msgs:
+				if msg.Type != tt.msg.Type || string(msg.Data) != string(tt.msg.Data) {
+					t.Errorf("got %v %s, want %v %s", msg.Type, msg.Data, tt.msg.Type, tt.msg.Data)
+				}
+				if tt.toHost && msg.SignalingId != signalingId {
+					t.Errorf("signalingId %q, want %q", msg.SignalingId, signalingId)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("not received")
+			}
+		})
+	}
+
+	// saved for the listeners that start later
+	doc, err := store.GetSignalingDoc(signalingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Offer != "offer" || doc.Answer != "answer" {
+		t.Errorf("offer or answer not saved: %+v", doc)
+	}
+	if len(doc.OfferIce) != 1 || len(doc.AnswerIce) != 1 {
+		t.Errorf("ice candidates not saved: %+v", doc)
+	}
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if n := hub.ActiveListeners(); n != 0 {
+		t.Errorf("%v listeners after cancel", n)
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent by the conn (or the host if approve) before the host listens
+		sent []Message
+		want []MessageType
+	}{
+		{"request", []Message{newMessage(MsgConnRequest, ConnRequest{Name: "bob"})}, []MessageType{MsgConnRequest}},
+		{"presence", []Message{presenceMessage(PresenceJoined)}, []MessageType{MsgPresence}},
+		{"approved offer", []Message{
+			newMessage(MsgConnApprove, ConnApprove{}),
+			newMessage(MsgNewOffer, NewOffer{Sdp: "offer"}),
+			newMessage(MsgOfferIceCandidate, IceOfferCandidate{Ice: "ice"}),
+		}, []MessageType{MsgNewOffer, MsgOfferIceCandidate}},
+		{"offer before approval", []Message{newMessage(MsgNewOffer, NewOffer{Sdp: "offer"})}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := mongoclient.NewMemoryStore()
+			hub := NewHub(store, bus.NewMemoryBus())
+			filesId, signalingId := newTestSignaling(t, store)
+
+			for _, msg := range tt.sent {
+				send := hub.SendToHost
+				if msg.Type == MsgConnApprove {
+					send = hub.SendToConn
+				}
+				if err := send(signalingId, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			send, msgs := collect()
+			if err := hub.ListenHost(ctx, filesId, send); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := receiveTypes(t, msgs, len(tt.want)); !equalTypes(got, tt.want...) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// a message saved before the replay and published after the subscription is
+// only delivered once
+func TestHubReplayDedupe(t *testing.T) {
+	store := &replayHookStore{Store: mongoclient.NewMemoryStore()}
+	hub := NewHub(store, bus.NewMemoryBus())
+	filesId, signalingId := newTestSignaling(t, store)
+
+	published := make(chan error, 1)
+	store.beforeReplay = func() {
+		store.beforeReplay = nil
+		// saved now, its publish waits for the replay
+		go func() {
+			published <- hub.SendToHost(signalingId, newMessage(MsgConnRequest, ConnRequest{Name: "bob"}))
+		}()
+		for {
+			doc, err := store.GetSignalingDoc(signalingId)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if doc.Request != "" {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	send, msgs := collect()
+	if err := hub.ListenHost(ctx, filesId, send); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+	// after the request, if it was delivered twice
+	if err := hub.SendToHost(signalingId, presenceMessage(PresenceJoined)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := receiveTypes(t, msgs, 2); !equalTypes(got, MsgConnRequest, MsgPresence) {
+		t.Errorf("received %v", got)
+	}
+}
+
+func TestStoreSignalerReplayDedupe(t *testing.T) {
+	store := &replayHookStore{Store: mongoclient.NewMemoryStore()}
+	signaler := NewStoreSignaler(store)
+	filesId, signalingId := newTestSignaling(t, store)
+
+	store.beforeReplay = func() {
+		store.beforeReplay = nil
+		// saved before the replay, its change is received after it
+		if err := signaler.SendToHost(signalingId, newMessage(MsgConnRequest, ConnRequest{Name: "bob"})); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	send, msgs := collect()
+	if err := signaler.ListenHost(ctx, filesId, send); err != nil {
+		t.Fatal(err)
+	}
+	if err := signaler.SendToHost(signalingId, presenceMessage(PresenceJoined)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := receiveTypes(t, msgs, 2); !equalTypes(got, MsgConnRequest, MsgPresence) {
+		t.Errorf("received %v", got)
+	}
+}
+
+// the ice candidates sent while the host was away are replayed when it resumes
+func TestHubResumeReplaysIce(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.signaler = NewHub(s.store, bus.NewMemoryBus())
+	})
+	filesId := s.newShare(t)
+	host, session := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+	approve(t, host, signalingId, conn)
+
+	conn.send(MsgNewOffer, NewOffer{Sdp: "offer"})
+	host.receiveType(MsgNewOffer, nil)
+
+	host.ws.Close()
+	eventually(t, "host websocket closed", func() bool { return s.websockets() == 1 })
+	conn.send(MsgOfferIceCandidate, IceOfferCandidate{Ice: "missed"})
+	conn.sync()
+
+	resumed := s.dial(t, "/ws/host/"+filesId)
+	resumed.send(MsgResumeHost, ResumeHost{Url: filesId, ResumeToken: session.ResumeToken})
+	resumed.receiveType(MsgHostSession, nil)
+	receivePresence(t, resumed, signalingId)
+	resumed.receiveType(MsgNewOffer, nil)
+
+	var ice IceOfferCandidate
+	msg := resumed.receiveType(MsgOfferIceCandidate, &ice)
+	if ice.Ice != "missed" || msg.SignalingId != signalingId {
+		t.Errorf("replayed %q of %v, want %q of %v", ice.Ice, msg.SignalingId, "missed", signalingId)
+	}
+}
+
+// the host doesn't receive its own messages back
+func TestStoreSignalerHostMessages(t *testing.T) {
+	store := mongoclient.NewMemoryStore()
+	signaler := NewStoreSignaler(store)
+	filesId, signalingId := newTestSignaling(t, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	send, msgs := collect()
+	if err := signaler.ListenHost(ctx, filesId, send); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []struct {
+		toHost bool
+		msg    Message
+	}{
+		{true, newMessage(MsgConnRequest, ConnRequest{Name: "bob"})},
+		{false, newMessage(MsgConnApprove, ConnApprove{})},
+		{true, newMessage(MsgRelayRequest, RelayRequest{})},
+		{false, newMessage(MsgRelayAccept, RelayAccept{})},
+		{false, newMessage(MsgNewAnswer, NewAnswer{Sdp: "answer"})},
+	}
+	for _, s := range sent {
+		send := signaler.SendToConn
+		if s.toHost {
+			send = signaler.SendToHost
+		}
+		if err := send(signalingId, s.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := receiveTypes(t, msgs, 2); !equalTypes(got, MsgConnRequest, MsgRelayRequest) {
+		t.Errorf("received %v", got)
+	}
+}
@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// mismatches kept in the signaling doc of a conn, the next ones are refused
+const maxMismatches = 64
+
+// a conn can report a burst of mismatches, then one per token
+var mismatchRate = config.Rate{Burst: 8, Interval: time.Second * 10}
+
+// sent by the conn when a file it received doesn't match the digest
+// registered by the host. The host receives it without the chunks that
+// were already reported
+type Mismatch struct {
+	File string `json:"file" validate:"required"`
+	// indexes of the chunks that didn't match the manifest, empty if only the
+	// hash of the whole file didn't
+	Chunks []uint64 `json:"chunks,omitempty"`
+}
+
+func (m *Mismatch) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	t, err := s.connTransfer(c, *signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := t.lookup(s, m.File)
+	if err != nil {
+		return nil, err
+	}
+	if file.Digest == nil {
+		return nil, fmt.Errorf("file %q has no digest", m.File)
+	}
+	if err := m.checkChunks(file); err != nil {
+		return nil, err
+	}
+
+	// only the chunks that weren't reported yet
+	reported, err := t.mismatches.add(*m, time.Now())
+	if err != nil || reported == nil {
+		return nil, err
+	}
+
+	event := t.auditEvent(schema.AuditIntegrityMismatch)
+	event.Files = []string{reported.File}
+	event.Detail = reported.detail()
+	s.audit.Record(event)
+
+	return nil, s.signaler.SendToHost(*signalingDoc, newMessage(MsgMismatch, reported))
+}
+
+func (m *Mismatch) checkChunks(file schema.File) error {
+	count := file.Digest.ChunkCount(file.Length)
+	if len(m.Chunks) != 0 && count == 0 {
+		return errors.New("the file has no chunk manifest")
+	}
+	if uint64(len(m.Chunks)) > count {
+		return fmt.Errorf("the file has %v chunks", count)
+	}
+	for _, chunk := range m.Chunks {
+		if chunk >= count {
+			return fmt.Errorf("the file has %v chunks, not %v", count, chunk+1)
+		}
+	}
+	return nil
+}
+
+// what didn't match, for the audit log
+func (m *Mismatch) detail() string {
+	if len(m.Chunks) == 0 {
+		return "file hash"
+	}
+
+	chunks := make([]string, 0, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		chunks = append(chunks, strconv.FormatUint(chunk, 10))
+	}
+	return "chunks " + strings.Join(chunks, ",")
+}
+
+// the mismatches relayed for a conn, so a conn can't grow its signaling doc
+// by reporting them in a loop. Only used by the processor goroutine
+type mismatchLog struct {
+	// in the signaling doc
+	count int
+	// by file name, the chunks already reported
+	chunks map[string]map[uint64]bool
+	// files whose hash mismatch was already reported
+	hashes map[string]bool
+	// of mismatchRate
+	tokens float64
+	last   time.Time
+}
+
+// the log of the mismatches already in the signaling doc
+func newMismatchLog(docMismatches []string) *mismatchLog {
+	l := &mismatchLog{
+		chunks: map[string]map[uint64]bool{},
+		hashes: map[string]bool{},
+		tokens: float64(mismatchRate.Burst),
+	}
+	for _, data := range docMismatches {
+		var m Mismatch
+		if json.Unmarshal([]byte(data), &m) == nil {
+			l.record(m)
+		}
+	}
+	l.count = len(docMismatches)
+	return l
+}
+
+// the part of m that wasn't reported yet, nil if it all was. It's refused
+// once the doc has maxMismatches or the conn ran out of tokens
+func (l *mismatchLog) add(m Mismatch, now time.Time) (*Mismatch, error) {
+	reported := Mismatch{File: m.File}
+	for _, chunk := range m.Chunks {
+		if !l.chunks[m.File][chunk] && !slices.Contains(reported.Chunks, chunk) {
+			reported.Chunks = append(reported.Chunks, chunk)
+		}
+	}
+	if len(m.Chunks) == 0 && l.hashes[m.File] || len(m.Chunks) != 0 && len(reported.Chunks) == 0 {
+		return nil, nil
+	}
+
+	if l.count >= maxMismatches {
+		return nil, fmt.Errorf("too many mismatches reported, the limit is %v", maxMismatches)
+	}
+
+	perToken := mismatchRate.PerToken()
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+float64(now.Sub(l.last))/float64(perToken), float64(mismatchRate.Burst))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		retryAfter := time.Duration((1 - l.tokens) * float64(perToken))
+		return nil, fmt.Errorf("too many mismatches, retry in %v", retryAfter.Round(time.Millisecond))
+	}
+	l.tokens--
+
+	l.record(reported)
+	l.count++
+	return &reported, nil
+}
+
+func (l *mismatchLog) record(m Mismatch) {
+	if len(m.Chunks) == 0 {
+		l.hashes[m.File] = true
+		return
+	}
+
+	chunks, ok := l.chunks[m.File]
+	if !ok {
+		chunks = map[uint64]bool{}
+		l.chunks[m.File] = chunks
+	}
+	for _, chunk := range m.Chunks {
+		chunks[chunk] = true
+	}
+}
@@ -0,0 +1,130 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+func TestMismatchCheckChunks(t *testing.T) {
+	// 3 chunks
+	chunked := schema.File{Name: "a", Length: 10, Digest: &schema.FileDigest{ChunkSize: 4}}
+	// only the file hash
+	hashed := schema.File{Name: "b", Length: 10, Digest: &schema.FileDigest{}}
+
+	tests := []struct {
+		name   string
+		file   schema.File
+		chunks []uint64
+		valid  bool
+	}{
+		{"file hash", hashed, nil, true},
+		{"file hash with chunks", chunked, nil, true},
+		{"chunks", chunked, []uint64{0, 2}, true},
+		{"all the chunks", chunked, []uint64{0, 1, 2}, true},
+		{"no manifest", hashed, []uint64{0}, false},
+		{"chunk out of range", chunked, []uint64{3}, false},
+		{"more chunks than the file", chunked, []uint64{0, 1, 2, 0}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Mismatch{File: tt.file.Name, Chunks: tt.chunks}
+			if err := m.checkChunks(tt.file); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMismatchDetail(t *testing.T) {
+	tests := []struct {
+		chunks []uint64
+		want   string
+	}{
+		{nil, "file hash"},
+		{[]uint64{3}, "chunks 3"},
+		{[]uint64{0, 12, 7}, "chunks 0,12,7"},
+	}
+
+	for _, tt := range tests {
+		m := Mismatch{File: "a", Chunks: tt.chunks}
+		if got := m.detail(); got != tt.want {
+			t.Errorf("detail of %v = %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestMismatchLog(t *testing.T) {
+	start := time.Now()
+	l := newMismatchLog(nil)
+
+	type step struct {
+		name string
+		m    Mismatch
+		at   time.Duration // since start
+		// relayed is false if nothing is, want are its chunks
+		relayed bool
+		want    []uint64
+		err     string
+	}
+	steps := []step{
+		{"file hash", Mismatch{File: "a"}, 0, true, nil, ""},
+		{"repeated file hash", Mismatch{File: "a"}, 0, false, nil, ""},
+		{"chunks", Mismatch{File: "a", Chunks: []uint64{1, 2}}, 0, true, []uint64{1, 2}, ""},
+		{"repeated chunks", Mismatch{File: "a", Chunks: []uint64{2, 1}}, 0, false, nil, ""},
+		{"new chunk with repeated ones", Mismatch{File: "a", Chunks: []uint64{1, 3, 3}}, 0, true, []uint64{3}, ""},
+		{"chunks of another file", Mismatch{File: "b", Chunks: []uint64{1}}, 0, true, []uint64{1}, ""},
+	}
+	// the rest of the burst, the steps above took 4 tokens
+	for i := range uint64(mismatchRate.Burst - 4) {
+		steps = append(steps, step{fmt.Sprint("burst ", i), Mismatch{File: "c", Chunks: []uint64{i}}, 0, true, []uint64{i}, ""})
+	}
+	steps = append(steps,
+		step{"no tokens left", Mismatch{File: "d"}, 0, false, nil, "too many mismatches, retry in"},
+		step{"refilled", Mismatch{File: "d"}, mismatchRate.PerToken(), true, nil, ""},
+	)
+
+	for _, step := range steps {
+		got, err := l.add(step.m, start.Add(step.at))
+		if step.err != "" {
+			if err == nil || !strings.Contains(err.Error(), step.err) {
+				t.Errorf("%v: err %v, want %q", step.name, err, step.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", step.name, err)
+			continue
+		}
+		if (got != nil) != step.relayed {
+			t.Errorf("%v: relayed %+v, want %v", step.name, got, step.relayed)
+			continue
+		}
+		if got != nil && !slices.Equal(got.Chunks, step.want) {
+			t.Errorf("%v: relayed chunks %v, want %v", step.name, got.Chunks, step.want)
+		}
+	}
+}
+
+// the mismatches already in the signaling doc count, and aren't relayed again
+func TestMismatchLogFromDoc(t *testing.T) {
+	var doc []string
+	for i := range maxMismatches {
+		data, _ := json.Marshal(Mismatch{File: "a", Chunks: []uint64{uint64(i)}})
+		doc = append(doc, string(data))
+	}
+	l := newMismatchLog(doc)
+
+	if got, err := l.add(Mismatch{File: "a", Chunks: []uint64{0}}, time.Now()); got != nil || err != nil {
+		t.Errorf("repeated: relayed %+v (%v)", got, err)
+	}
+	if _, err := l.add(Mismatch{File: "b"}, time.Now()); err == nil || !strings.Contains(err.Error(), "too many mismatches reported") {
+		t.Errorf("past the limit: %v", err)
+	}
+}
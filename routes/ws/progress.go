@@ -0,0 +1,215 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// minimum time between the progress messages relayed to the host, the
+// reports in between only update the totals. A report that completes a file
+// is always relayed
+const progressInterval time.Duration = time.Millisecond * 500
+
+// sent by the conn with the bytes received of each file (by name). The host
+// receives it with every file of the share, its length and the totals
+type Progress struct {
+	Files []FileProgress `json:"files" validate:"required"`
+	// filled by the server, sum of every file
+	Bytes  uint64 `json:"bytes,omitempty"`
+	Length uint64 `json:"length,omitempty"`
+}
+
+type FileProgress struct {
+	Name  string `json:"name"`
+	Bytes uint64 `json:"bytes"`
+	// filled by the server
+	Length uint64 `json:"length,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+func (p *Progress) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	t, err := s.connTransfer(c, *signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	completed, err := t.update(s, p.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range completed {
+		doc := schema.NewCompletionSchema(t.filesId, t.signalingId, t.peer.Name, file.Name, file.Length, s.retention)
+		if err := s.store.AddCompletion(doc); err != nil {
+			fmt.Printf("add completion err: %v\n", err)
+		}
+
+		event := t.auditEvent(schema.AuditTransferCompleted)
+		event.Files = []string{file.Name}
+		s.audit.Record(event)
+	}
+
+	if len(completed) == 0 && time.Since(t.lastRelay) < progressInterval {
+		return nil, nil
+	}
+	t.lastRelay = time.Now()
+
+	return nil, s.signaler.SendToHost(*signalingDoc, newMessage(MsgProgress, t.progress()))
+}
+
+// the progress of the conn of a WsConn, only used by its processor goroutine
+type transfer struct {
+	filesId     primitive.ObjectID
+	signalingId primitive.ObjectID
+	peer        schema.AuditPeer
+	// the files of the share, reloaded if the conn reports an unknown one
+	files []schema.File
+	// by file name
+	bytes     map[string]uint64
+	completed map[string]bool
+	lastRelay time.Time
+	// hash of the resume token of the receiver, empty until its first
+	// Checkpoint or ResumeTransfer
+	receiver string
+	// by file name, of the receiver
+	checkpoints map[string]schema.CheckpointSchema
+	mismatches  *mismatchLog
+}
+
+// the transfer of the conn c, created by its first message about it
+func (s *Server) connTransfer(c *WsConn, signalingId string) (*transfer, error) {
+	if c.transfer == nil {
+		t, err := s.newTransfer(signalingId)
+		if err != nil {
+			return nil, err
+		}
+		c.transfer = t
+	}
+	return c.transfer, nil
+}
+
+func (s *Server) newTransfer(signalingId string) (*transfer, error) {
+	doc, err := s.requireApproved(signalingId)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transfer{
+		filesId:     doc.FilesId,
+		signalingId: doc.ID,
+		peer:        connPeer(doc),
+		bytes:       map[string]uint64{},
+		completed:   map[string]bool{},
+		checkpoints: map[string]schema.CheckpointSchema{},
+		mismatches:  newMismatchLog(doc.Mismatches),
+	}
+	if err := t.loadFiles(s); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *transfer) loadFiles(s *Server) error {
+	files, err := s.store.GetFiles(t.filesId.Hex())
+	if err != nil {
+		return err
+	}
+	t.files = *files
+	return nil
+}
+
+func (t *transfer) file(name string) (schema.File, bool) {
+	for _, file := range t.files {
+		if file.Name == name {
+			return file, true
+		}
+	}
+	return schema.File{}, false
+}
+
+// the file of the share, reloading the files if it's unknown (the host may
+// have added it)
+func (t *transfer) lookup(s *Server, name string) (schema.File, error) {
+	if file, ok := t.file(name); ok {
+		return file, nil
+	}
+
+	if err := t.loadFiles(s); err != nil {
+		return schema.File{}, err
+	}
+	if file, ok := t.file(name); ok {
+		return file, nil
+	}
+	return schema.File{}, fmt.Errorf("unknown file %q", name)
+}
+
+// returns the files completed by this report
+func (t *transfer) update(s *Server, reported []FileProgress) ([]schema.File, error) {
+	var completed []schema.File
+
+	for _, p := range reported {
+		file, err := t.lookup(s, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if p.Bytes > file.Length {
+			return nil, fmt.Errorf("file %q has %v bytes, not %v", p.Name, file.Length, p.Bytes)
+		}
+
+		t.bytes[p.Name] = p.Bytes
+		if p.Bytes == file.Length && !t.completed[p.Name] {
+			t.completed[p.Name] = true
+			completed = append(completed, file)
+		}
+	}
+
+	return completed, nil
+}
+
+func (t *transfer) auditEvent(eventType string) schema.AuditEventSchema {
+	event := schema.NewAuditEventSchema(t.filesId, eventType)
+	event.SignalingId = t.signalingId.Hex()
+	event.Peer = t.peer
+	return event
+}
+
+// records the files started but not completed when the conn leaves, with
+// its presence event as the detail
+func (t *transfer) recordFailure(s *Server, presenceEvent string) {
+	var files []string
+	for _, file := range t.files {
+		if _, started := t.bytes[file.Name]; started && !t.completed[file.Name] {
+			files = append(files, file.Name)
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	event := t.auditEvent(schema.AuditTransferFailed)
+	event.Files = files
+	event.Detail = presenceEvent
+	s.audit.Record(event)
+}
+
+func (t *transfer) progress() Progress {
+	progress := Progress{
+		Files: make([]FileProgress, 0, len(t.files)),
+	}
+	for _, file := range t.files {
+		bytes := t.bytes[file.Name]
+		progress.Files = append(progress.Files, FileProgress{
+			Name:   file.Name,
+			Bytes:  bytes,
+			Length: file.Length,
+			Done:   t.completed[file.Name],
+		})
+		progress.Bytes += bytes
+		progress.Length += file.Length
+	}
+	return progress
+}
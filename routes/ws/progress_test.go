@@ -0,0 +1,111 @@
+package ws
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+func newTestTransfer(t *testing.T, files ...schema.File) (*Server, *transfer) {
+	t.Helper()
+
+	s := &Server{store: mongoclient.NewMemoryStore()}
+	filesId, err := s.store.CreateFilesDoc(schema.NewFileSchema("user", "files", files, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &transfer{
+		filesId:   *filesId,
+		bytes:     map[string]uint64{},
+		completed: map[string]bool{},
+	}
+	if err := tr.loadFiles(s); err != nil {
+		t.Fatal(err)
+	}
+	return s, tr
+}
+
+func TestTransferUpdate(t *testing.T) {
+	files := []schema.File{{Name: "a", Length: 10}, {Name: "b", Length: 20}}
+
+	tests := []struct {
+		name    string
+		reports [][]FileProgress
+		// completed by the last report
+		want  []string
+		valid bool
+	}{
+		{"started", [][]FileProgress{{{Name: "a", Bytes: 5}}}, nil, true},
+		{"completed", [][]FileProgress{{{Name: "a", Bytes: 5}}, {{Name: "a", Bytes: 10}}}, []string{"a"}, true},
+		{"completed once", [][]FileProgress{{{Name: "a", Bytes: 10}}, {{Name: "a", Bytes: 10}}}, nil, true},
+		{"several files", [][]FileProgress{{{Name: "a", Bytes: 10}, {Name: "b", Bytes: 20}}}, []string{"a", "b"}, true},
+		{"no bytes", [][]FileProgress{{{Name: "a", Bytes: 0}}}, nil, true},
+		{"more bytes than the file", [][]FileProgress{{{Name: "a", Bytes: 11}}}, nil, false},
+		{"unknown file", [][]FileProgress{{{Name: "c", Bytes: 1}}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, tr := newTestTransfer(t, files...)
+
+			var completed []schema.File
+			var err error
+			for _, report := range tt.reports {
+				completed, err = tr.update(s, report)
+			}
+			if (err == nil) != tt.valid {
+				t.Fatalf("got %v, want valid %v", err, tt.valid)
+			}
+
+			var names []string
+			for _, file := range completed {
+				names = append(names, file.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("completed %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferUpdateAddedFile(t *testing.T) {
+	s, tr := newTestTransfer(t, schema.File{Name: "a", Length: 10})
+
+	// added by the host after the transfer loaded the files
+	if err := s.store.AddFiles(tr.filesId.Hex(), []schema.File{{Name: "b", Length: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := tr.update(s, []FileProgress{{Name: "b", Bytes: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 1 || completed[0].Name != "b" {
+		t.Errorf("completed %v, want b", completed)
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	s, tr := newTestTransfer(t, schema.File{Name: "a", Length: 10}, schema.File{Name: "b", Length: 20})
+
+	if _, err := tr.update(s, []FileProgress{{Name: "a", Bytes: 10}, {Name: "b", Bytes: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Progress{
+		Files: []FileProgress{
+			{Name: "a", Bytes: 10, Length: 10, Done: true},
+			{Name: "b", Bytes: 5, Length: 20},
+		},
+		Bytes:  15,
+		Length: 30,
+	}
+	got := tr.progress()
+	if !slices.Equal(got.Files, want.Files) || got.Bytes != want.Bytes || got.Length != want.Length {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
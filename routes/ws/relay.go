@@ -0,0 +1,424 @@
+package ws
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/websocket"
+)
+
+// The relay streams a transfer through the backend when the p2p connection
+// of an approved conn fails. The conn asks for it with RelayRequest and the
+// host accepts it with RelayAccept, then each one opens its relay websocket
+// (/ws/relay/conn/<signalingId> and /ws/relay/host/<signalingId>) in the
+// same instance. Once both are open they receive RelayReady, the binary
+// messages of the host are forwarded as is to the conn, and the conn
+// acknowledges them with RelayAck once it processed them. The host can't
+// have more than the window unacknowledged
+
+// sent by an approved conn whose p2p connection failed
+type RelayRequest struct{}
+
+func (r *RelayRequest) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if !s.fileRelay.Enabled {
+		return nil, errRelayDisabled
+	}
+
+	doc, err := s.requireApproved(*signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Relay != "" {
+		return nil, fmt.Errorf("relay already %v", doc.Relay)
+	}
+
+	return nil, s.signaler.SendToHost(*signalingDoc, newMessage(MsgRelayRequest, r))
+}
+
+// sent by the host, both sides can open their relay websocket after it
+type RelayAccept struct{}
+
+func (a *RelayAccept) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	doc, err := s.requireApproved(*signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Relay != schema.SignalingRelayRequested {
+		return nil, fmt.Errorf("relay not requested")
+	}
+
+	return nil, s.signaler.SendToConn(*signalingDoc, newMessage(MsgRelayAccept, a))
+}
+
+// the first message of the host relay websocket, with the credentials of its
+// signaling websocket
+type RelayHost struct {
+	Token string `json:"token" validate:"required"` // with the host permission
+	// of the last HostSession, the host must be listening
+	ResumeToken string `json:"resumeToken" validate:"required"`
+}
+
+// sent to both relay websockets once both are open
+type RelayReady struct {
+	Window   int64 `json:"window"`
+	MaxFrame int64 `json:"maxFrame"`
+	// bytes per second shared by the relays of the share, 0 if unlimited
+	Bandwidth int64 `json:"bandwidth"`
+}
+
+// sent by the conn with the bytes it processed, the host receives it and can
+// send them again
+type RelayAck struct {
+	Bytes int64 `json:"bytes" validate:"required"`
+}
+
+var errRelayDisabled = errors.New("the relay is disabled")
+
+type relaySession struct {
+	signalingId string
+	filesId     primitive.ObjectID
+	// of the audit event, the signaling doc may be gone when the relay ends
+	peer schema.AuditPeer
+	// nil until their websocket joins, set with Server.mu held
+	host atomic.Pointer[WsConn]
+	conn atomic.Pointer[WsConn]
+
+	window    int64
+	bandwidth *bandwidth
+	// bytes sent by the host that the conn didn't acknowledge
+	unacked atomic.Int64
+	relayed atomic.Int64
+}
+
+func (s *Server) RelayHandler(role WsRole) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		wsServer := websocket.Server{Handler: websocket.Handler(func(ws *websocket.Conn) {
+			// the text messages are way smaller
+			ws.MaxPayloadBytes = int(s.fileRelay.MaxFrame)
+			s.handleRelay(ws, vars["objId"], role)
+		})}
+
+		wsServer.ServeHTTP(w, req)
+	}
+}
+
+func (s *Server) handleRelay(ws *websocket.Conn, signalingId string, role WsRole) {
+	c := newWsConn(ws, s.keepalive)
+
+	if !s.track(c) {
+		c.SendAndClose(goingAwayMessage())
+		c.writeLoop()
+		return
+	}
+	defer s.untrack(c)
+
+	doc, err := s.relayDoc(signalingId)
+	if err == nil && role == WsRoleConn {
+		err = authorizeConn(ws.Request(), doc)
+	}
+	if err != nil {
+		c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+		c.writeLoop()
+		return
+	}
+
+	// the host joins after its RelayHost
+	var r *relaySession
+	if role == WsRoleConn {
+		if r, err = s.joinRelay(doc, role, c); err != nil {
+			c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+			c.writeLoop()
+			return
+		}
+	}
+	defer func() {
+		if r != nil {
+			s.leaveRelay(r, c)
+		}
+	}()
+
+	c.run(func(msg []byte, binary bool) {
+		if binary {
+			if role != WsRoleHost {
+				c.SendError(errors.New("only the host sends binary messages"))
+				return
+			}
+			if r == nil {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: "the host must send RelayHost first"}))
+				return
+			}
+			if err := r.forward(msg, c); err != nil {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+			}
+			return
+		}
+
+		var message Message
+		if err := json.Unmarshal(msg, &message); err != nil {
+			c.SendError(fmt.Errorf("error decoding message: %v", err.Error()))
+			return
+		}
+
+		switch {
+		case message.Type == MsgHeartbeat:
+			// receiving it already reset the idle timeout
+
+		case role == WsRoleHost && r == nil:
+			// closed on anything else, and on invalid credentials
+			if message.Type != MsgRelayHost {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: "the host must send RelayHost first"}))
+				return
+			}
+			var relayHost RelayHost
+			if err := json.Unmarshal(message.Data, &relayHost); err != nil {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: fmt.Sprintf("error decoding message data: %v", err.Error())}))
+				return
+			}
+			if err := s.authorizeRelayHost(&relayHost, doc); err != nil {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+				return
+			}
+			if r, err = s.joinRelay(doc, role, c); err != nil {
+				c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+			}
+
+		case message.Type == MsgRelayAck && role == WsRoleConn:
+			var ack RelayAck
+			if err := json.Unmarshal(message.Data, &ack); err != nil {
+				c.SendError(fmt.Errorf("error decoding message data: %v", err.Error()))
+				return
+			}
+			if err := r.ack(ack.Bytes); err != nil {
+				c.SendError(err)
+			}
+
+		default:
+			c.SendError(fmt.Errorf("unexpected message type %v", message.Type))
+		}
+	})
+}
+
+// the host relay websocket is authenticated like its signaling websocket, and
+// only while that one holds the session of the resume token
+func (s *Server) authorizeRelayHost(relayHost *RelayHost, doc *schema.SignalingSchema) error {
+	filesId := doc.FilesId.Hex()
+	if err := s.verifyHostToken(relayHost.Token, filesId); err != nil {
+		return err
+	}
+
+	session, err := s.store.HostSession(filesId)
+	if err != nil && !errors.Is(err, mongoclient.ErrNotFound) {
+		return err
+	}
+	resumeSession := hashResumeToken(relayHost.ResumeToken)
+	if err != nil || session == "" || subtle.ConstantTimeCompare([]byte(session), []byte(resumeSession)) != 1 {
+		return errors.New("invalid resume token or the share was deleted")
+	}
+	return nil
+}
+
+// the relay websockets can only be opened after the host accepted the relay
+func (s *Server) relayDoc(signalingId string) (*schema.SignalingSchema, error) {
+	if !s.fileRelay.Enabled {
+		return nil, errRelayDisabled
+	}
+
+	doc, err := s.requireApproved(signalingId)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Relay != schema.SignalingRelayAccepted {
+		return nil, fmt.Errorf("relay not accepted by the host")
+	}
+	return doc, nil
+}
+
+// adds the websocket to the relay of doc, sending RelayReady to both if the
+// other one already joined
+func (s *Server) joinRelay(doc *schema.SignalingSchema, role WsRole, c *WsConn) (*relaySession, error) {
+	signalingId := doc.ID.Hex()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.relays[signalingId]
+	if !ok {
+		filesId := doc.FilesId.Hex()
+		b, ok := s.bandwidths[filesId]
+		if !ok {
+			b = newBandwidth(s.fileRelay.Bandwidth)
+			s.bandwidths[filesId] = b
+		}
+		b.refs++
+
+		r = &relaySession{
+			signalingId: signalingId,
+			filesId:     doc.FilesId,
+			peer:        connPeer(doc),
+			window:      s.fileRelay.Window,
+			bandwidth:   b,
+		}
+		s.relays[signalingId] = r
+	}
+
+	peer := &r.conn
+	if role == WsRoleHost {
+		peer = &r.host
+	}
+	if peer.Load() != nil {
+		return nil, errors.New("already connected to the relay")
+	}
+	peer.Store(c)
+
+	if host, conn := r.host.Load(), r.conn.Load(); host != nil && conn != nil {
+		ready := newMessage(MsgRelayReady, RelayReady{
+			Window:    s.fileRelay.Window,
+			MaxFrame:  s.fileRelay.MaxFrame,
+			Bandwidth: s.fileRelay.Bandwidth,
+		})
+		host.Send(ready)
+		conn.Send(ready)
+	}
+	return r, nil
+}
+
+// the relay ends with either websocket, the other one is closed and both
+// have to open a new one to continue
+func (s *Server) leaveRelay(r *relaySession, c *WsConn) {
+	s.mu.Lock()
+	other := r.host.Swap(nil)
+	if other == c {
+		other = r.conn.Swap(nil)
+	} else {
+		r.conn.Store(nil)
+	}
+	if s.relays[r.signalingId] == r {
+		delete(s.relays, r.signalingId)
+		r.bandwidth.refs--
+		if r.bandwidth.refs == 0 {
+			delete(s.bandwidths, r.filesId.Hex())
+		}
+	}
+	s.mu.Unlock()
+
+	if other != nil {
+		other.SendAndClose(newMessage(MsgDisconnect, Disconnect{Reason: DisconnectPeerLeft}))
+	}
+
+	// only recorded once, by the first websocket that leaves
+	relayed := r.relayed.Swap(0)
+	if relayed == 0 {
+		return
+	}
+	event := schema.NewAuditEventSchema(r.filesId, schema.AuditTransferRelayed)
+	event.SignalingId = r.signalingId
+	event.Peer = r.peer
+	event.Detail = fmt.Sprintf("%v bytes", relayed)
+	s.audit.Record(event)
+}
+
+// sends data of the host (c) to the conn, within the window and the
+// bandwidth of the share
+func (r *relaySession) forward(data []byte, c *WsConn) error {
+	conn := r.conn.Load()
+	if conn == nil {
+		return errors.New("the conn isn't connected to the relay")
+	}
+
+	// only the host processor adds to unacked, the acks can only lower it
+	// meanwhile. The bytes are added once they are sent, so the refused ones
+	// don't take window space
+	n := int64(len(data))
+	if r.unacked.Load()+n > r.window {
+		return fmt.Errorf("window of %v bytes exceeded, wait for RelayAck", r.window)
+	}
+	if err := r.bandwidth.wait(n, c.done); err != nil {
+		return err
+	}
+
+	// before the send, the conn may ack them right after
+	r.unacked.Add(n)
+	if err := conn.SendBinary(data); err != nil {
+		r.unacked.Add(-n)
+		return err
+	}
+	r.relayed.Add(n)
+	return nil
+}
+
+// gives the bytes back to the window of the host
+func (r *relaySession) ack(bytes int64) error {
+	// only the conn processor acknowledges, unacked can only grow meanwhile
+	if bytes <= 0 || bytes > r.unacked.Load() {
+		return fmt.Errorf("acknowledged %v bytes, only %v weren't", bytes, r.unacked.Load())
+	}
+	r.unacked.Add(-bytes)
+
+	host := r.host.Load()
+	if host == nil {
+		return errors.New("the host isn't connected to the relay")
+	}
+	return host.Send(newMessage(MsgRelayAck, RelayAck{Bytes: bytes}))
+}
+
+// token bucket of the relayed bytes of a share, it holds up to one second
+// of its rate
+type bandwidth struct {
+	rate int64 // bytes per second, 0 doesn't limit them
+	// relays using it, guarded by Server.mu
+	refs int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidth(rate int64) *bandwidth {
+	return &bandwidth{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// takes n bytes, waiting until they are available or done is closed. They
+// are taken right away, so the next callers wait for them too
+func (b *bandwidth) wait(n int64, done <-chan struct{}) error {
+	if b.rate == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(b.rate), float64(b.rate))
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return errConnClosed
+	}
+}
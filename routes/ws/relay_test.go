@@ -0,0 +1,297 @@
+package ws
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a share whose host accepted the relay of one of its conns
+func (s *testServer) acceptRelay(t *testing.T) (filesId string, session HostSession, signalingId string) {
+	t.Helper()
+
+	filesId = s.newShare(t)
+	host, session := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+	approve(t, host, signalingId, conn)
+
+	conn.send(MsgRelayRequest, RelayRequest{})
+	host.receiveType(MsgRelayRequest, nil)
+	host.sendTo(signalingId, MsgRelayAccept, RelayAccept{})
+	conn.receiveType(MsgRelayAccept, nil)
+	return filesId, session, signalingId
+}
+
+// both relay websockets of an accepted relay, once they received RelayReady
+func (s *testServer) openRelay(t *testing.T) (relayHost *testClient, relayConn *testClient) {
+	t.Helper()
+
+	filesId, session, signalingId := s.acceptRelay(t)
+	relayConn = s.dial(t, s.connPath("/ws/relay/conn/", signalingId))
+	relayHost = s.dial(t, "/ws/relay/host/"+signalingId)
+	relayHost.send(MsgRelayHost, RelayHost{Token: s.hostToken(t, filesId), ResumeToken: session.ResumeToken})
+
+	relayHost.receiveType(MsgRelayReady, nil)
+	relayConn.receiveType(MsgRelayReady, nil)
+	return relayHost, relayConn
+}
+
+// the next message must be binary
+func (c *testClient) receiveBinary() []byte {
+	c.t.Helper()
+
+	msg, data, err := c.receiveFrame()
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	if data == nil {
+		c.t.Fatalf("received %v %s, want binary", msg.Type, msg.Data)
+	}
+	return data
+}
+
+func TestRelayForward(t *testing.T) {
+	s := newTestServer(t, nil)
+	relayHost, relayConn := s.openRelay(t)
+
+	relayHost.sendBinary([]byte("chunk"))
+	if got := relayConn.receiveBinary(); !bytes.Equal(got, []byte("chunk")) {
+		t.Errorf("relayed %q", got)
+	}
+
+	relayConn.send(MsgRelayAck, RelayAck{Bytes: 5})
+	var ack RelayAck
+	relayHost.receiveType(MsgRelayAck, &ack)
+	if ack.Bytes != 5 {
+		t.Errorf("acknowledged %v bytes, want 5", ack.Bytes)
+	}
+}
+
+func TestRelayWindowExceeded(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.fileRelay.Window = 10
+	})
+	relayHost, relayConn := s.openRelay(t)
+
+	relayHost.sendBinary(make([]byte, 6))
+	relayConn.receiveBinary()
+	relayHost.sendBinary(make([]byte, 6))
+
+	if got := relayHost.receiveError(); !strings.Contains(got, "window of 10 bytes exceeded") {
+		t.Errorf("got %q", got)
+	}
+	relayHost.receiveClose()
+}
+
+func TestRelayInvalidAck(t *testing.T) {
+	s := newTestServer(t, nil)
+	relayHost, relayConn := s.openRelay(t)
+
+	relayHost.sendBinary(make([]byte, 6))
+	relayConn.receiveBinary()
+
+	tests := []struct {
+		name  string
+		bytes int64
+	}{
+		{"zero", 0},
+		{"negative", -1},
+		{"more than unacked", 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayConn.send(MsgRelayAck, RelayAck{Bytes: tt.bytes})
+			if got := relayConn.receiveError(); !strings.Contains(got, "only 6 weren't") {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+
+	// the invalid acks didn't change the unacked bytes
+	relayConn.send(MsgRelayAck, RelayAck{Bytes: 6})
+	relayHost.receiveType(MsgRelayAck, nil)
+}
+
+func TestRelayPeerLeft(t *testing.T) {
+	tests := []struct {
+		name       string
+		hostLeaves bool
+	}{
+		{"conn leaves", false},
+		{"host leaves", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			relayHost, relayConn := s.openRelay(t)
+
+			leaving, other := relayConn, relayHost
+			if tt.hostLeaves {
+				leaving, other = relayHost, relayConn
+			}
+			leaving.ws.Close()
+
+			var disconnect Disconnect
+			other.receiveType(MsgDisconnect, &disconnect)
+			if disconnect.Reason != DisconnectPeerLeft {
+				t.Errorf("reason %q, want %q", disconnect.Reason, DisconnectPeerLeft)
+			}
+			other.receiveClose()
+		})
+	}
+}
+
+func TestRelayHostRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		// of the accepted relay
+		relayHost func(t *testing.T, s *testServer, filesId string, session HostSession) RelayHost
+		want      string
+	}{
+		{"bad token", func(t *testing.T, s *testServer, filesId string, session HostSession) RelayHost {
+			return RelayHost{Token: "bad", ResumeToken: session.ResumeToken}
+		}, "token"},
+		{"token of another share", func(t *testing.T, s *testServer, filesId string, session HostSession) RelayHost {
+			return RelayHost{Token: s.hostToken(t, s.newShare(t)), ResumeToken: session.ResumeToken}
+		}, "token not valid for this url"},
+		{"bad session", func(t *testing.T, s *testServer, filesId string, session HostSession) RelayHost {
+			return RelayHost{Token: s.hostToken(t, filesId), ResumeToken: "bad"}
+		}, "invalid resume token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			filesId, session, signalingId := s.acceptRelay(t)
+
+			relayHost := s.dial(t, "/ws/relay/host/"+signalingId)
+			relayHost.send(MsgRelayHost, tt.relayHost(t, s, filesId, session))
+			if got := relayHost.receiveError(); !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want it to contain %q", got, tt.want)
+			}
+			relayHost.receiveClose()
+		})
+	}
+}
+
+func TestRelayConnSecret(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, _, signalingId := s.acceptRelay(t)
+
+	relayConn := s.dial(t, "/ws/relay/conn/"+signalingId+"?secret=bad")
+	if got := relayConn.receiveError(); !strings.Contains(got, "invalid secret") {
+		t.Errorf("got %q", got)
+	}
+	relayConn.receiveClose()
+}
+
+// a conn of a relay session, its sent binary messages are queued in out
+func testRelayConn(out chan outMessage) *WsConn {
+	return &WsConn{out: out, done: make(chan struct{})}
+}
+
+func TestRelaySessionWindow(t *testing.T) {
+	host := testRelayConn(nil)
+	r := &relaySession{window: 10, bandwidth: newBandwidth(0)}
+	r.conn.Store(testRelayConn(make(chan outMessage, 10)))
+	r.host.Store(testRelayConn(make(chan outMessage, 10)))
+
+	steps := []struct {
+		name    string
+		forward int64 // or ack if negative
+		wantErr bool
+		unacked int64
+	}{
+		{"within the window", 6, false, 6},
+		{"exceeds the window", 6, true, 6},
+		{"ack", -4, false, 2},
+		{"fills the window", 8, false, 10},
+		{"full window", 1, true, 10},
+		{"ack all", -10, false, 0},
+	}
+
+	for _, step := range steps {
+		var err error
+		if step.forward >= 0 {
+			err = r.forward(make([]byte, step.forward), host)
+		} else {
+			err = r.ack(-step.forward)
+		}
+		if (err != nil) != step.wantErr {
+			t.Errorf("%v: err %v, want error %v", step.name, err, step.wantErr)
+		}
+		if got := r.unacked.Load(); got != step.unacked {
+			t.Errorf("%v: %v unacked bytes, want %v", step.name, got, step.unacked)
+		}
+	}
+}
+
+// the bytes that weren't sent don't take window space
+func TestRelaySessionForwardFailed(t *testing.T) {
+	t.Run("bandwidth wait", func(t *testing.T) {
+		host := testRelayConn(nil)
+		close(host.done)
+		// no tokens left, it would wait
+		r := &relaySession{window: 10, bandwidth: newBandwidth(1)}
+		r.conn.Store(testRelayConn(make(chan outMessage, 1)))
+
+		if err := r.forward(make([]byte, 5), host); err != errConnClosed {
+			t.Errorf("err %v, want %v", err, errConnClosed)
+		}
+		if got := r.unacked.Load(); got != 0 {
+			t.Errorf("%v unacked bytes", got)
+		}
+	})
+
+	t.Run("conn closed", func(t *testing.T) {
+		conn := testRelayConn(nil)
+		close(conn.done)
+		r := &relaySession{window: 10, bandwidth: newBandwidth(0)}
+		r.conn.Store(conn)
+
+		if err := r.forward(make([]byte, 5), testRelayConn(nil)); err != errConnClosed {
+			t.Errorf("err %v, want %v", err, errConnClosed)
+		}
+		if got := r.unacked.Load(); got != 0 {
+			t.Errorf("%v unacked bytes", got)
+		}
+	})
+}
+
+func TestBandwidthWait(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int64
+		// taken before the measured wait
+		taken int64
+		n     int64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"unlimited", 0, 1000, 1000, 0, 20 * time.Millisecond},
+		{"within the burst", 1000, 0, 1000, 0, 20 * time.Millisecond},
+		{"throttled", 1000, 1000, 100, 80 * time.Millisecond, 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBandwidth(tt.rate)
+			done := make(chan struct{})
+			if err := b.wait(tt.taken, done); err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			if err := b.wait(tt.n, done); err != nil {
+				t.Fatal(err)
+			}
+			if waited := time.Since(start); waited < tt.min || waited > tt.max {
+				t.Errorf("waited %v, want between %v and %v", waited, tt.min, tt.max)
+			}
+		})
+	}
+}
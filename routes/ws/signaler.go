@@ -0,0 +1,357 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+)
+
+// Signaler delivers the signaling messages between a host and its conns
+type Signaler interface {
+	// calls send with every message for the host of filesId until it returns
+	// false or ctx is done
+	ListenHost(ctx context.Context, filesId string, send func(msg Message) bool) error
+	// calls send with every message for the conn of signalingId until it
+	// returns false or ctx is done
+	ListenConn(ctx context.Context, signalingId string, send func(msg Message) bool) error
+	// from the conn of signalingId to its host
+	SendToHost(signalingId string, msg Message) error
+	// from the host to the conn of signalingId
+	SendToConn(signalingId string, msg Message) error
+	// number of ListenHost and ListenConn listeners that didn't stop yet
+	ActiveListeners() int64
+}
+
+// delivers the messages through the store change streams: the messages are
+// saved in the signaling doc and the listeners receive the update
+type storeSignaler struct {
+	store mongoclient.Store
+}
+
+func NewStoreSignaler(store mongoclient.Store) Signaler {
+	return &storeSignaler{
+		store: store,
+	}
+}
+
+func (s *storeSignaler) ListenHost(ctx context.Context, filesId string, send func(msg Message) bool) error {
+	// the changes wait until the replay is sent, the ones already in the
+	// replayed docs are skipped
+	var mu sync.Mutex
+	var replayed map[string]int64
+	closed := false
+
+	// mu must be held
+	deliver := func(msg Message) bool {
+		if !closed && !send(msg) {
+			closed = true
+		}
+		return !closed
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	err := s.store.ListenNewConns(ctx, filesId, func(changes mongoclient.ListenNewConnsEvent) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		signalingId := changes.Id.Hex()
+		if changeSeq(changes.U) <= replayed[signalingId] {
+			return !closed
+		}
+		for _, msg := range parseUpdatedFields(changes.U) {
+			// the host receives the changes of its own messages too
+			if !isForHost(msg.Type) {
+				continue
+			}
+			msg.SignalingId = signalingId
+			if !deliver(msg) {
+				return false
+			}
+		}
+		return !closed
+	}, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		deliver(listenErrorMessage(err))
+	})
+	if err != nil {
+		return err
+	}
+
+	msgs, replayed, err := hostReplay(s.store, filesId)
+	if err != nil {
+		closed = true
+		return err
+	}
+	for _, msg := range msgs {
+		if !deliver(msg) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *storeSignaler) ListenConn(ctx context.Context, signalingId string, send func(msg Message) bool) error {
+	return s.store.ListenSignaling(ctx, signalingId, func(changes mongoclient.ListenSignalingEvent) bool {
+		for _, msg := range parseUpdatedFields(changes.U) {
+			if isForHost(msg.Type) {
+				continue
+			}
+			if !send(msg) {
+				return false
+			}
+		}
+		return true
+	}, func(err error) {
+		send(listenErrorMessage(err))
+	})
+}
+
+func (s *storeSignaler) SendToHost(signalingId string, msg Message) error {
+	_, err := persistMessage(s.store, signalingId, msg)
+	return err
+}
+
+func (s *storeSignaler) SendToConn(signalingId string, msg Message) error {
+	_, err := persistMessage(s.store, signalingId, msg)
+	return err
+}
+
+func (s *storeSignaler) ActiveListeners() int64 {
+	return mongoclient.ActiveListeners()
+}
+
+// the presence of the conns of filesId, their pending connection requests
+// and the offers, ice candidates, progress, resumed transfers, mismatches and
+// relay requests of the approved ones, for a host that starts listening (or resumes) after
+// they were sent. seqs has the seq of every replayed doc, by signalingId
+func hostReplay(store mongoclient.Store, filesId string) (msgs []Message, seqs map[string]int64, err error) {
+	docs, err := store.GetSignalingDocs(filesId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seqs = map[string]int64{}
+	for _, doc := range docs {
+		seqs[doc.ID.Hex()] = doc.Seq
+
+		var docMsgs []Message
+		if doc.Presence != "" {
+			docMsgs = append(docMsgs, presenceMessage(doc.Presence))
+		}
+		switch doc.Status {
+		case "":
+			// still waiting for the approval
+			if doc.Request != "" {
+				docMsgs = append(docMsgs, Message{Type: MsgConnRequest, Data: json.RawMessage(doc.Request)})
+			}
+		case schema.SignalingApproved:
+			if doc.Offer != "" {
+				docMsgs = append(docMsgs, newMessage(MsgNewOffer, NewOffer{Sdp: doc.Offer}))
+			}
+			for _, ice := range doc.OfferIce {
+				docMsgs = append(docMsgs, newMessage(MsgOfferIceCandidate, IceOfferCandidate{Ice: ice}))
+			}
+			if doc.Progress != "" {
+				docMsgs = append(docMsgs, Message{Type: MsgProgress, Data: json.RawMessage(doc.Progress)})
+			}
+			if doc.Resume != "" {
+				docMsgs = append(docMsgs, Message{Type: MsgResumeTransfer, Data: json.RawMessage(doc.Resume)})
+			}
+			for _, mismatch := range doc.Mismatches {
+				docMsgs = append(docMsgs, Message{Type: MsgMismatch, Data: json.RawMessage(mismatch)})
+			}
+			if doc.Relay == schema.SignalingRelayRequested {
+				docMsgs = append(docMsgs, relayMessage(doc.Relay))
+			}
+		}
+
+		for _, msg := range docMsgs {
+			msg.SignalingId = doc.ID.Hex()
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, seqs, nil
+}
+
+// saves the offer, answer or ice candidate of the message in the signaling doc,
+// returns the new seq of the doc
+func persistMessage(store mongoclient.Store, signalingId string, msg Message) (int64, error) {
+	switch msg.Type {
+	case MsgNewOffer:
+		var offer NewOffer
+		if err := json.Unmarshal(msg.Data, &offer); err != nil {
+			return 0, err
+		}
+		return store.SetSignalingField(signalingId, mongoclient.SignalingOffer, offer.Sdp)
+
+	case MsgNewAnswer:
+		var answer NewAnswer
+		if err := json.Unmarshal(msg.Data, &answer); err != nil {
+			return 0, err
+		}
+		return store.SetSignalingField(signalingId, mongoclient.SignalingAnswer, answer.Sdp)
+
+	case MsgOfferIceCandidate:
+		var ice IceOfferCandidate
+		if err := json.Unmarshal(msg.Data, &ice); err != nil {
+			return 0, err
+		}
+		return store.PushSignalingField(signalingId, mongoclient.SignalingOfferIce, ice.Ice)
+
+	case MsgAnswerIceCandidate:
+		var ice IceAnswerCandidate
+		if err := json.Unmarshal(msg.Data, &ice); err != nil {
+			return 0, err
+		}
+		return store.PushSignalingField(signalingId, mongoclient.SignalingAnswerIce, ice.Ice)
+
+	case MsgConnRequest:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingRequest, string(msg.Data))
+
+	case MsgConnApprove:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingStatus, schema.SignalingApproved)
+
+	case MsgConnReject:
+		var reject ConnReject
+		if err := json.Unmarshal(msg.Data, &reject); err != nil {
+			return 0, err
+		}
+		// the status first, so the request can't be answered again
+		if _, err := store.SetSignalingField(signalingId, mongoclient.SignalingStatus, schema.SignalingRejected); err != nil {
+			return 0, err
+		}
+		return store.SetSignalingField(signalingId, mongoclient.SignalingRejectMsg, reject.Msg)
+
+	case MsgDisconnect:
+		var disconnect Disconnect
+		if err := json.Unmarshal(msg.Data, &disconnect); err != nil {
+			return 0, err
+		}
+		return store.SetSignalingField(signalingId, mongoclient.SignalingDisconnect, disconnect.Reason)
+
+	case MsgPresence:
+		var presence Presence
+		if err := json.Unmarshal(msg.Data, &presence); err != nil {
+			return 0, err
+		}
+		return store.SetSignalingField(signalingId, mongoclient.SignalingPresence, presence.Event)
+
+	case MsgProgress:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingProgress, string(msg.Data))
+
+	case MsgMismatch:
+		return store.PushSignalingField(signalingId, mongoclient.SignalingMismatches, string(msg.Data))
+
+	case MsgResumeTransfer:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingResume, string(msg.Data))
+
+	case MsgRelayRequest:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingRelay, schema.SignalingRelayRequested)
+
+	case MsgRelayAccept:
+		return store.SetSignalingField(signalingId, mongoclient.SignalingRelay, schema.SignalingRelayAccepted)
+
+	default:
+		return 0, fmt.Errorf("message type %v can't be persisted", msg.Type)
+	}
+}
+
+// the listener of the store stopped, the client has to reconnect to
+// receive the next messages
+func listenErrorMessage(err error) Message {
+	return newMessage(MsgError, MessageError{
+		Msg: fmt.Sprintf("signaling updates stopped, reconnect: %v", err),
+	})
+}
+
+// sent by the conn to the host
+func isForHost(msgType MessageType) bool {
+	return msgType == MsgNewOffer || msgType == MsgOfferIceCandidate || msgType == MsgConnRequest || msgType == MsgPresence || msgType == MsgProgress || msgType == MsgMismatch || msgType == MsgResumeTransfer || msgType == MsgRelayRequest
+}
+
+// the message that sets the status of the signaling doc, with the message of
+// the host if it was rejected
+func statusMessage(status string, rejectMsg string) Message {
+	if status == schema.SignalingApproved {
+		return newMessage(MsgConnApprove, ConnApprove{})
+	}
+	if rejectMsg == "" {
+		rejectMsg = connRejectedMsg
+	}
+	return newMessage(MsgConnReject, ConnReject{Msg: rejectMsg})
+}
+
+// the message that sets the relay state of the signaling doc
+func relayMessage(relay string) Message {
+	if relay == schema.SignalingRelayAccepted {
+		return newMessage(MsgRelayAccept, RelayAccept{})
+	}
+	return newMessage(MsgRelayRequest, RelayRequest{})
+}
+
+// the seq of the doc after the change, 0 if it has none. Its type depends on
+// the store
+func changeSeq(u map[string]interface{}) int64 {
+	switch seq := u["seq"].(type) {
+	case int64:
+		return seq
+	case int32:
+		return int64(seq)
+	case float64:
+		return int64(seq)
+	}
+	return 0
+}
+
+// the messages of the fields of u, its seq is ignored
+func parseUpdatedFields(u map[string]interface{}) []Message {
+	var msgs []Message = []Message{}
+
+	for k, v := range u {
+		switch k {
+		case "offer":
+			msgs = append(msgs, newMessage(MsgNewOffer, NewOffer{Sdp: v.(string)}))
+		case "answer":
+			msgs = append(msgs, newMessage(MsgNewAnswer, NewAnswer{Sdp: v.(string)}))
+		case "request":
+			msgs = append(msgs, Message{Type: MsgConnRequest, Data: json.RawMessage(v.(string))})
+		case "status":
+			// a rejection is sent by the change of its message
+			if v.(string) == schema.SignalingApproved {
+				msgs = append(msgs, statusMessage(v.(string), ""))
+			}
+		case "rejectMsg":
+			msgs = append(msgs, statusMessage(schema.SignalingRejected, v.(string)))
+		case "disconnect":
+			msgs = append(msgs, newMessage(MsgDisconnect, Disconnect{Reason: v.(string)}))
+		case "presence":
+			msgs = append(msgs, presenceMessage(v.(string)))
+		case "progress":
+			msgs = append(msgs, Message{Type: MsgProgress, Data: json.RawMessage(v.(string))})
+		case "resume":
+			msgs = append(msgs, Message{Type: MsgResumeTransfer, Data: json.RawMessage(v.(string))})
+		case "relay":
+			msgs = append(msgs, relayMessage(v.(string)))
+		default:
+			if strings.HasPrefix(k, "offerIce.") {
+				msgs = append(msgs, newMessage(MsgOfferIceCandidate, IceOfferCandidate{Ice: v.(string)}))
+			}
+			if strings.HasPrefix(k, "answerIce.") {
+				msgs = append(msgs, newMessage(MsgAnswerIceCandidate, IceAnswerCandidate{Ice: v.(string)}))
+			}
+			if strings.HasPrefix(k, "mismatches.") {
+				msgs = append(msgs, Message{Type: MsgMismatch, Data: json.RawMessage(v.(string))})
+			}
+		}
+	}
+
+	return msgs
+}
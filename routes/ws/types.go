@@ -1,17 +1,18 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 
 	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
-	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/net/websocket"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
 )
 
 type MessageProcessor interface {
-	Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error)
+	Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error)
 }
 
 type MessageType int
@@ -24,8 +25,38 @@ const (
 	MsgNewAnswer
 	MsgNewOffer
 	MsgError
+	MsgConnRequest
+	MsgConnApprove
+	MsgConnReject
+	MsgGoingAway
+	MsgHostSession
+	MsgResumeHost
+	MsgHeartbeat
+	MsgDisconnect
+	MsgPresence
+	MsgConnected
+	MsgProgress
+	MsgMismatch
+	MsgCheckpoint
+	MsgTransferSession
+	MsgResumeTransfer
+	MsgRelayRequest
+	MsgRelayAccept
+	MsgRelayHost
+	MsgRelayReady
+	MsgRelayAck
 )
 
+// the messages a host sends, the conns send the others (but Heartbeat,
+// sent by both)
+func sentByHost(msgType MessageType) bool {
+	switch msgType {
+	case MsgListenOffersHost, MsgResumeHost, MsgAnswerIceCandidate, MsgNewAnswer, MsgConnApprove, MsgConnReject, MsgRelayAccept:
+		return true
+	}
+	return false
+}
+
 type Message struct {
 	Type        MessageType     `json:"type" validate:"required"`
 	SignalingId string          `json:"signalingId,omitempty"`
@@ -58,6 +89,54 @@ func (m *Message) GetDataType() (MessageProcessor, error) {
 		var msg NewOffer
 		return &msg, nil
 
+	case MsgConnRequest:
+		var msg ConnRequest
+		return &msg, nil
+
+	case MsgConnApprove:
+		var msg ConnApprove
+		return &msg, nil
+
+	case MsgConnReject:
+		var msg ConnReject
+		return &msg, nil
+
+	case MsgResumeHost:
+		var msg ResumeHost
+		return &msg, nil
+
+	case MsgHeartbeat:
+		var msg Heartbeat
+		return &msg, nil
+
+	case MsgConnected:
+		var msg Connected
+		return &msg, nil
+
+	case MsgProgress:
+		var msg Progress
+		return &msg, nil
+
+	case MsgMismatch:
+		var msg Mismatch
+		return &msg, nil
+
+	case MsgCheckpoint:
+		var msg Checkpoint
+		return &msg, nil
+
+	case MsgResumeTransfer:
+		var msg ResumeTransfer
+		return &msg, nil
+
+	case MsgRelayRequest:
+		var msg RelayRequest
+		return &msg, nil
+
+	case MsgRelayAccept:
+		var msg RelayAccept
+		return &msg, nil
+
 	default:
 		return nil, fmt.Errorf("unknown message type %v", m.Type)
 	}
@@ -67,12 +146,12 @@ type IceOfferCandidate struct {
 	Ice string `json:"ice" validate:"required"`
 }
 
-func (ice *IceOfferCandidate) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	err := mongoclient.Mongo.UpdateSignalingDoc(*signalingDoc, bson.M{
-		"$push": bson.M{
-			"offerIce": ice.Ice,
-		},
-	})
+func (ice *IceOfferCandidate) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.checkApproved(c, *signalingDoc); err != nil {
+		return nil, err
+	}
+
+	err := s.signaler.SendToHost(*signalingDoc, newMessage(MsgOfferIceCandidate, ice))
 	return nil, err
 }
 
@@ -80,12 +159,12 @@ type IceAnswerCandidate struct {
 	Ice string `json:"ice" validate:"required"`
 }
 
-func (ice *IceAnswerCandidate) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	err := mongoclient.Mongo.UpdateSignalingDoc(*signalingDoc, bson.M{
-		"$push": bson.M{
-			"answerIce": ice.Ice,
-		},
-	})
+func (ice *IceAnswerCandidate) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.checkApproved(c, *signalingDoc); err != nil {
+		return nil, err
+	}
+
+	err := s.signaler.SendToConn(*signalingDoc, newMessage(MsgAnswerIceCandidate, ice))
 	return nil, err
 }
 
@@ -93,12 +172,12 @@ type NewOffer struct {
 	Sdp string `json:"sdp" validate:"required"`
 }
 
-func (offer *NewOffer) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	err := mongoclient.Mongo.UpdateSignalingDoc(*signalingDoc, bson.M{
-		"$set": bson.M{
-			"offer": offer.Sdp,
-		},
-	})
+func (offer *NewOffer) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.checkApproved(c, *signalingDoc); err != nil {
+		return nil, err
+	}
+
+	err := s.signaler.SendToHost(*signalingDoc, newMessage(MsgNewOffer, offer))
 	return nil, err
 }
 
@@ -106,101 +185,264 @@ type NewAnswer struct {
 	Sdp string `json:"sdp" validate:"required"`
 }
 
-func (answer *NewAnswer) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	err := mongoclient.Mongo.UpdateSignalingDoc(*signalingDoc, bson.M{
-		"$set": bson.M{
-			"answer": answer.Sdp,
-		},
-	})
+func (answer *NewAnswer) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.checkApproved(c, *signalingDoc); err != nil {
+		return nil, err
+	}
+
+	err := s.signaler.SendToConn(*signalingDoc, newMessage(MsgNewAnswer, answer))
 	return nil, err
 }
 
 type ListenOffersHost struct {
-	Url           string `json:"url" validate:"required"`
-	PasswordFiles string `json:"passwordFiles" validate:"required"`
+	Url   string `json:"url" validate:"required"`
+	Token string `json:"token" validate:"required"` // with the host permission
 }
 
-func (l *ListenOffersHost) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	if !mongoclient.Mongo.IsPasswordFilesValid(l.Url, l.PasswordFiles) {
-		return nil, fmt.Errorf("invalid password files")
+func (l *ListenOffersHost) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if c.listening {
+		return nil, errListening
+	}
+	if err := s.verifyHostToken(l.Token, l.Url); err != nil {
+		return nil, err
 	}
 
-	mongoclient.Mongo.ListenNewConns(l.Url, func(changes mongoclient.ListenNewConnsEvent) bool {
-		for _, msg := range parseUpdatedFields(changes.U) {
-			msg.SignalingId = changes.Id.Hex()
-			msgBytes, _ := json.Marshal(msg)
+	resumeToken, session, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.SetHostSession(l.Url, session); err != nil {
+		return nil, err
+	}
+	c.listening = true
 
-			if err := websocket.Message.Send(ws, string(msgBytes)); err != nil {
-				fmt.Printf("send msg err4: %v\n", err)
-				return false
-			}
-		}
-		return true
-	})
+	return nil, s.listenHost(ctx, c, l.Url, resumeToken, session)
+}
 
-	return nil, nil
+// sent by a host that lost its websocket, with the resume token of its last
+// MsgHostSession. It receives a new resume token and the offers and ice
+// candidates sent while it was offline
+type ResumeHost struct {
+	Url         string `json:"url" validate:"required"`
+	ResumeToken string `json:"resumeToken" validate:"required"`
 }
 
-type ListenOffersConn struct{}
+func (r *ResumeHost) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if c.listening {
+		return nil, errListening
+	}
+
+	resumeToken, session, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
 
-func (l ListenOffersConn) Process(ws *websocket.Conn, signalingDoc *string) (interface{}, error) {
-	mongoclient.Mongo.ListenSignaling(*signalingDoc, func(changes mongoclient.ListenSignalingEvent) bool {
-		for _, msg := range parseUpdatedFields(changes.U) {
-			if msg.Type == MsgNewOffer || msg.Type == MsgOfferIceCandidate {
-				continue
-			}
+	err = s.store.SwapHostSession(r.Url, hashResumeToken(r.ResumeToken), session)
+	if errors.Is(err, mongoclient.ErrNotFound) {
+		return nil, fmt.Errorf("invalid resume token or the share was deleted")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.listening = true
 
-			msgBytes, _ := json.Marshal(msg)
+	return nil, s.listenHost(ctx, c, r.Url, resumeToken, session)
+}
 
-			if err := websocket.Message.Send(ws, string(msgBytes)); err != nil {
-				fmt.Printf("send msg err5: %v\n", err)
-				return false
-			}
+// sent to the host when it starts listening, ResumeToken is used in
+// ResumeHost if the websocket is lost, within Grace
+type HostSession struct {
+	ResumeToken string `json:"resumeToken"`
+	Grace       int64  `json:"grace"` // ms
+}
+
+type ListenOffersConn struct{}
+
+func (l ListenOffersConn) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if c.listening {
+		return nil, errListening
+	}
+	c.listening = true
+
+	err := s.signaler.ListenConn(ctx, *signalingDoc, func(msg Message) bool {
+		if err := c.Send(msg); err != nil {
+			fmt.Printf("send msg err5: %v\n", err)
+			return false
 		}
 		return true
 	})
 
+	return nil, err
+}
+
+// sent by the conn before the offer, the host receives it with the ip info
+// and must answer with ConnApprove or ConnReject
+type ConnRequest struct {
+	Name string `json:"name" validate:"required"`
+	// filled by the server
+	Network string `json:"network,omitempty"` // the ip masked to /24 (ipv4) or /48 (ipv6)
+	Local   bool   `json:"local,omitempty"`   // private or loopback ip
+}
+
+func (r *ConnRequest) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("the name is required")
+	}
+
+	doc, err := s.store.GetSignalingDoc(*signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Request != "" {
+		return nil, fmt.Errorf("connection already requested")
+	}
+
+	r.Network, r.Local = handler.IpInfo(handler.ClientIp(c.Request(), s.trustProxy))
+
+	err = s.signaler.SendToHost(*signalingDoc, newMessage(MsgConnRequest, r))
+	return nil, err
+}
+
+// the peer of the audit events of the conn of doc
+func connPeer(doc *schema.SignalingSchema) schema.AuditPeer {
+	var request ConnRequest
+	json.Unmarshal([]byte(doc.Request), &request)
+
+	return schema.AuditPeer{
+		Name:    request.Name,
+		Network: request.Network,
+		Local:   request.Local,
+	}
+}
+
+// sent by the host, the conn can send its offer after receiving it
+type ConnApprove struct{}
+
+func (a *ConnApprove) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.requirePending(*signalingDoc); err != nil {
+		return nil, err
+	}
+
+	err := s.signaler.SendToConn(*signalingDoc, newMessage(MsgConnApprove, a))
+	return nil, err
+}
+
+const connRejectedMsg string = "the host rejected the connection"
+
+// sent by the host, the conn receives it with Msg and its signaling doc is deleted
+type ConnReject struct {
+	Msg string `json:"msg,omitempty"`
+}
+
+func (r *ConnReject) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	if err := s.requirePending(*signalingDoc); err != nil {
+		return nil, err
+	}
+
+	if r.Msg == "" {
+		r.Msg = connRejectedMsg
+	}
+	if err := s.signaler.SendToConn(*signalingDoc, newMessage(MsgConnReject, r)); err != nil {
+		return nil, err
+	}
+
+	return nil, s.store.DeleteSignalingDoc(*signalingDoc)
+}
+
+// sent by the server before it shuts down, the client should reconnect
+// (to another instance) after ReconnectAfter
+type GoingAway struct {
+	Msg            string `json:"msg"`
+	ReconnectAfter int64  `json:"reconnectAfter"` // ms
+}
+
+// sent by the server every ping interval, the client answers with another
+// Heartbeat so its websocket isn't closed by the idle timeout
+type Heartbeat struct{}
+
+func (h *Heartbeat) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	// receiving it already reset the idle timeout
 	return nil, nil
 }
 
+// reason of a Disconnect
+const (
+	DisconnectTimeout string = "timeout"
+	// the other websocket of the relay was closed
+	DisconnectPeerLeft string = "peerLeft"
+)
+
+// sent to a client whose websocket timed out, and to the conns of a host
+// that timed out
+type Disconnect struct {
+	Reason string `json:"reason"`
+}
+
+// events of Presence
+const (
+	PresenceJoined    string = "joined"    // the conn opened its websocket
+	PresenceConnected string = "connected" // the conn sent Connected
+	PresenceLeft      string = "left"      // the conn closed its websocket
+	PresenceTimedOut  string = "timedOut"  // the websocket of the conn timed out
+)
+
+// sent to the host (with the signalingId of the conn) when a conn joins,
+// connects or leaves, and replayed when the host starts listening
+type Presence struct {
+	Event string `json:"event"`
+}
+
+func presenceMessage(event string) Message {
+	return newMessage(MsgPresence, Presence{Event: event})
+}
+
+// sent by the conn once the p2p connection with the host is established
+type Connected struct{}
+
+func (m *Connected) Process(ctx context.Context, s *Server, c *WsConn, signalingDoc *string) (interface{}, error) {
+	doc, err := s.requireApproved(*signalingDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	event := schema.NewAuditEventSchema(doc.FilesId, schema.AuditReceiverConnected)
+	event.SignalingId = doc.ID.Hex()
+	event.Peer = connPeer(doc)
+	s.audit.Record(event)
+
+	return nil, s.signaler.SendToHost(*signalingDoc, presenceMessage(PresenceConnected))
+}
+
 type MessageError struct {
 	Msg string `json:"msg"`
 }
 
-func parseUpdatedFields(u map[string]interface{}) []Message {
-	var msgs []Message = []Message{}
-
-	for k, v := range u {
-		switch k {
-		case "offer":
-			data, _ := json.Marshal(NewOffer{Sdp: v.(string)})
-			msgs = append(msgs, Message{
-				Type: MsgNewOffer,
-				Data: data,
-			})
-		case "answer":
-			data, _ := json.Marshal(NewAnswer{Sdp: v.(string)})
-			msgs = append(msgs, Message{
-				Type: MsgNewAnswer,
-				Data: data,
-			})
-		default:
-			if strings.HasPrefix(k, "offerIce.") {
-				data, _ := json.Marshal(IceOfferCandidate{Ice: v.(string)})
-				msgs = append(msgs, Message{
-					Type: MsgOfferIceCandidate,
-					Data: data,
-				})
-			}
-			if strings.HasPrefix(k, "answerIce.") {
-				data, _ := json.Marshal(IceOfferCandidate{Ice: v.(string)})
-				msgs = append(msgs, Message{
-					Type: MsgAnswerIceCandidate,
-					Data: data,
-				})
-			}
-		}
+func newMessage(msgType MessageType, data any) Message {
+	dataBytes, _ := json.Marshal(data)
+	return Message{
+		Type: msgType,
+		Data: dataBytes,
 	}
+}
+
+// the resume token is only given to the host (or receiver), the store keeps
+// its hash
+func newResumeToken() (resumeToken string, hash string, err error) {
+	return handler.NewSecret()
+}
+
+// the token must have the host permission of the share
+func (s *Server) verifyHostToken(token string, filesId string) error {
+	claims, err := s.tokens.Verify(token)
+	if err != nil {
+		return err
+	}
+	if !claims.Allows(filesId, handler.PermHost) {
+		return fmt.Errorf("token not valid for this url")
+	}
+	return nil
+}
 
-	return msgs
+func hashResumeToken(resumeToken string) string {
+	return handler.HashSecret(resumeToken)
 }
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+)
+
+func TestListenTwice(t *testing.T) {
+	s := newTestServer(t, nil)
+	filesId := s.newShare(t)
+
+	host, session := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+
+	tests := []struct {
+		name   string
+		client *testClient
+		msg    Message
+	}{
+		{"host", host, newMessage(MsgListenOffersHost, ListenOffersHost{Url: filesId, Token: s.hostToken(t, filesId)})},
+		{"resume", host, newMessage(MsgResumeHost, ResumeHost{Url: filesId, ResumeToken: session.ResumeToken})},
+		{"conn", conn, newMessage(MsgListenOffersConn, ListenOffersConn{})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.sendMessage(tt.msg)
+			if got, want := tt.client.receiveError(), "error processing message: "+errListening.Error(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	// the refused resume didn't replace the session
+	host.send(MsgListenOffersHost, ListenOffersHost{Url: filesId, Token: s.hostToken(t, filesId)})
+	host.receiveError()
+	if got, err := s.store.HostSession(filesId); err != nil || got != hashResumeToken(session.ResumeToken) {
+		t.Errorf("session %q (%v), want the one of the first listen", got, err)
+	}
+}
+
+func TestConnReject(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"with message", "too many receivers", "too many receivers"},
+		{"without message", "", connRejectedMsg},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			filesId := s.newShare(t)
+			host, _ := s.listenHost(t, filesId)
+			signalingId, conn := s.listenConn(t, filesId)
+			receivePresence(t, host, signalingId)
+
+			conn.send(MsgConnRequest, ConnRequest{Name: "bob"})
+			host.receiveType(MsgConnRequest, nil)
+			host.sendTo(signalingId, MsgConnReject, ConnReject{Msg: tt.msg})
+
+			var reject ConnReject
+			conn.receiveType(MsgConnReject, &reject)
+			if reject.Msg != tt.want {
+				t.Errorf("got %q, want %q", reject.Msg, tt.want)
+			}
+
+			eventually(t, "signaling doc deleted", func() bool {
+				_, err := s.store.GetSignalingDoc(signalingId)
+				return errors.Is(err, mongoclient.ErrNotFound)
+			})
+		})
+	}
+}
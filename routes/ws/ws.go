@@ -1,12 +1,22 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/audit"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
 	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/net/websocket"
 )
 
@@ -17,78 +27,487 @@ const (
 	WsRoleConn
 )
 
-func WsHandler(role WsRole) func(w http.ResponseWriter, r *http.Request) {
+// Server holds the dependencies shared by the websocket handlers
+type Server struct {
+	store    mongoclient.Store
+	signaler Signaler
+	tokens   *handler.Tokens
+	// use the client ip of X-Forwarded-For in the connection requests
+	trustProxy bool
+	// how long the files doc is kept after the host websocket is lost
+	hostGrace time.Duration
+	keepalive config.WebsocketConfig
+	fileRelay config.FileRelayConfig
+	// how long the completions are kept
+	retention time.Duration
+	audit     *audit.Log
+
+	mu sync.Mutex
+	// open websockets, told to reconnect by Shutdown
+	conns        map[*WsConn]struct{}
+	shuttingDown bool
+	// host websocket -> its session
+	hostSessions map[*WsConn]hostSession
+	// by signalingId
+	relays map[string]*relaySession
+	// by filesId, shared by the relays of a share
+	bandwidths map[string]*bandwidth
+	// of releaseHost, stopped by Shutdown (the store is closed after it)
+	graceTimers map[*time.Timer]struct{}
+	// grace timers that already fired and are still running
+	graceWg sync.WaitGroup
+	// handleWs calls
+	wg sync.WaitGroup
+}
+
+type hostSession struct {
+	filesId string
+	session string
+}
+
+func NewServer(store mongoclient.Store, signaler Signaler, tokens *handler.Tokens, trustProxy bool, hostGrace time.Duration, keepalive config.WebsocketConfig, fileRelay config.FileRelayConfig, retention time.Duration, audit *audit.Log) *Server {
+	return &Server{
+		store:        store,
+		signaler:     signaler,
+		tokens:       tokens,
+		trustProxy:   trustProxy,
+		hostGrace:    hostGrace,
+		keepalive:    keepalive,
+		fileRelay:    fileRelay,
+		retention:    retention,
+		audit:        audit,
+		conns:        map[*WsConn]struct{}{},
+		hostSessions: map[*WsConn]hostSession{},
+		relays:       map[string]*relaySession{},
+		bandwidths:   map[string]*bandwidth{},
+		graceTimers:  map[*time.Timer]struct{}{},
+	}
+}
+
+func (s *Server) WsHandler(role WsRole) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 
-		s := websocket.Server{Handler: websocket.Handler(func(c *websocket.Conn) {
-			handleWs(c, vars["objId"], role)
+		wsServer := websocket.Server{Handler: websocket.Handler(func(c *websocket.Conn) {
+			s.handleWs(c, vars["objId"], role)
 		})}
 
-		s.ServeHTTP(w, req)
+		wsServer.ServeHTTP(w, req)
 	}
 }
 
 // if role is WsRoleHost, objId == filesId, else objId == signalingId
-func handleWs(ws *websocket.Conn, objId string, role WsRole) {
+func (s *Server) handleWs(ws *websocket.Conn, objId string, role WsRole) {
+	c := newWsConn(ws, s.keepalive)
+
+	if !s.track(c) {
+		c.SendAndClose(goingAwayMessage())
+		c.writeLoop()
+		return
+	}
+
+	// before anything is done (or deleted) for the signaling doc
+	if role == WsRoleConn {
+		doc, err := s.store.GetSignalingDoc(objId)
+		if err == nil {
+			err = authorizeConn(ws.Request(), doc)
+		}
+		if err != nil {
+			c.SendAndClose(newMessage(MsgError, MessageError{Msg: err.Error()}))
+			c.writeLoop()
+			s.untrack(c)
+			return
+		}
+	}
+
+	// the listeners started by the messages stop with the websocket
+	ctx, cancel := context.WithCancel(context.Background())
+	timedOut := false
 	defer func() {
-		ws.Close()
+		cancel()
 		if role == WsRoleHost {
-			mongoclient.Mongo.DeleteFilesDoc(objId)
-		} else {
-			mongoclient.Mongo.DeleteSignalingDoc(objId)
+			s.releaseHost(c, timedOut)
+		} else if !s.isShuttingDown() {
+			// on shutdown the conn reconnects to another instance, its
+			// signaling doc and transfer are kept for it
+			event := PresenceLeft
+			if timedOut {
+				event = PresenceTimedOut
+			}
+			s.sendPresence(objId, event)
+			if c.transfer != nil {
+				c.transfer.recordFailure(s, event)
+			}
+			s.store.DeleteSignalingDoc(objId)
 		}
+		s.untrack(c)
 	}()
 
-	for {
-		var msg []byte
-		if err := websocket.Message.Receive(ws, &msg); err != nil {
-			break
+	if role == WsRoleConn {
+		s.sendPresence(objId, PresenceJoined)
+	}
+
+	timedOut = c.run(func(msg []byte, binary bool) {
+		if binary {
+			c.SendError(errors.New("binary messages are only accepted by the relay"))
+			return
 		}
 
-		go func() {
-			var message Message
-			if err := json.Unmarshal(msg, &message); err != nil {
-				SendError(ws, fmt.Errorf("error decoding message: %v", err.Error()))
-				return
-			}
+		var message Message
+		if err := json.Unmarshal(msg, &message); err != nil {
+			c.SendError(fmt.Errorf("error decoding message: %v", err.Error()))
+			return
+		}
 
-			msgData, err := message.GetDataType()
-			if err != nil {
-				SendError(ws, fmt.Errorf("error getting message kind: %v", err.Error()))
-				return
-			}
+		msgData, err := message.GetDataType()
+		if err != nil {
+			c.SendError(fmt.Errorf("error getting message kind: %v", err.Error()))
+			return
+		}
 
-			if err := json.Unmarshal(message.Data, msgData); err != nil {
-				SendError(ws, fmt.Errorf("error decoding message data: %v", err.Error()))
-				return
-			}
+		if err := json.Unmarshal(message.Data, msgData); err != nil {
+			c.SendError(fmt.Errorf("error decoding message data: %v", err.Error()))
+			return
+		}
 
-			var signalingDoc *string
-			if role == WsRoleHost {
-				signalingDoc = &message.SignalingId
-			} else {
-				signalingDoc = &objId
-			}
+		if err := s.authorize(c, role, objId, &message); err != nil {
+			c.SendError(err)
+			return
+		}
 
-			if _, err := msgData.Process(ws, signalingDoc); err != nil {
-				SendError(ws, fmt.Errorf("error processing message: %v", err.Error()))
-				return
-			}
-		}()
+		var signalingDoc *string
+		if role == WsRoleHost {
+			signalingDoc = &message.SignalingId
+		} else {
+			signalingDoc = &objId
+		}
+
+		if _, err := msgData.Process(ctx, s, c, signalingDoc); err != nil {
+			c.SendError(fmt.Errorf("error processing message: %v", err.Error()))
+			return
+		}
+	})
+}
+
+// the conn websockets (signaling and relay) send the secret of their
+// signaling doc, the signalingId alone would let anyone act as the conn
+func authorizeConn(req *http.Request, doc *schema.SignalingSchema) error {
+	if !handler.IsSecretValid(req.URL.Query().Get("secret"), doc.Secret) {
+		return errors.New("invalid secret for this signaling doc")
 	}
+	return nil
 }
 
-func SendError(ws *websocket.Conn, err error) {
-	msgError, _ := json.Marshal(MessageError{
-		Msg: err.Error(),
+// every message can only be sent by one of the roles. The host must listen
+// (ListenOffersHost or ResumeHost) for the files doc of its websocket before
+// sending other messages, and only for the signaling docs of that files doc
+func (s *Server) authorize(c *WsConn, role WsRole, objId string, message *Message) error {
+	if message.Type == MsgHeartbeat {
+		return nil
+	}
+	if sentByHost(message.Type) != (role == WsRoleHost) {
+		return fmt.Errorf("message type %v can't be sent by this websocket", message.Type)
+	}
+	if role == WsRoleConn {
+		return nil
+	}
+
+	if message.Type == MsgListenOffersHost || message.Type == MsgResumeHost {
+		var listen struct {
+			Url string `json:"url"`
+		}
+		json.Unmarshal(message.Data, &listen)
+		if listen.Url != objId {
+			return fmt.Errorf("url not valid for this websocket")
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	session, ok := s.hostSessions[c]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("the host must listen before sending messages")
+	}
+	if c.shareDocs[message.SignalingId] {
+		return nil
+	}
+
+	doc, err := s.store.GetSignalingDoc(message.SignalingId)
+	if err != nil {
+		return err
+	}
+	if doc.FilesId.Hex() != session.filesId {
+		return fmt.Errorf("signaling doc of another share")
+	}
+	c.shareDocs[message.SignalingId] = true
+	return nil
+}
+
+// tells the conns of a host that its websocket timed out and it didn't
+// resume its session
+func (s *Server) notifyHostTimeout(filesId string) {
+	msg := newMessage(MsgDisconnect, Disconnect{Reason: DisconnectTimeout})
+
+	docs, err := s.store.GetSignalingDocs(filesId)
+	if err != nil {
+		fmt.Printf("notify timeout err: %v\n", err)
+		return
+	}
+	for _, doc := range docs {
+		if err := s.signaler.SendToConn(doc.ID.Hex(), msg); err != nil {
+			fmt.Printf("notify timeout err: %v\n", err)
+		}
+	}
+}
+
+// the signaling doc is already gone if the host rejected the conn
+func (s *Server) sendPresence(signalingId string, event string) {
+	err := s.signaler.SendToHost(signalingId, presenceMessage(event))
+	if err != nil && !errors.Is(err, mongoclient.ErrNotFound) {
+		fmt.Printf("send presence err: %v\n", err)
+	}
+}
+
+// sends the resume token to the host and starts listening
+func (s *Server) listenHost(ctx context.Context, c *WsConn, filesId string, resumeToken string, session string) error {
+	s.mu.Lock()
+	s.hostSessions[c] = hostSession{
+		filesId: filesId,
+		session: session,
+	}
+	s.mu.Unlock()
+
+	err := c.Send(newMessage(MsgHostSession, HostSession{
+		ResumeToken: resumeToken,
+		Grace:       s.hostGrace.Milliseconds(),
+	}))
+	if err != nil {
+		return err
+	}
+
+	return s.signaler.ListenHost(ctx, filesId, func(msg Message) bool {
+		if err := c.Send(msg); err != nil {
+			fmt.Printf("send msg err4: %v\n", err)
+			return false
+		}
+		return true
 	})
+}
+
+// the files doc of a host that got its session is kept for hostGrace, and
+// only deleted if no other websocket resumed the session in the meantime.
+// The conns of a host that timed out are only told then. A websocket that
+// never listened can't delete the share, and the shares are kept on shutdown
+func (s *Server) releaseHost(c *WsConn, timedOut bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	msg := Message{
-		Type: MsgError,
-		Data: json.RawMessage(msgError),
+	session, ok := s.hostSessions[c]
+	delete(s.hostSessions, c)
+	if !ok || s.shuttingDown {
+		return
 	}
-	msgBytes, _ := json.Marshal(msg)
 
-	websocket.Message.Send(ws, string(msgBytes))
+	if s.hostGrace == 0 {
+		s.graceWg.Add(1)
+		go s.deleteHostSession(session, timedOut, "host left")
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(s.hostGrace, func() {
+		s.mu.Lock()
+		_, ok := s.graceTimers[timer]
+		delete(s.graceTimers, timer)
+		if ok {
+			s.graceWg.Add(1)
+		}
+		s.mu.Unlock()
+
+		// else stopped by Shutdown
+		if ok {
+			s.deleteHostSession(session, timedOut, "host didn't resume")
+		}
+	})
+	s.graceTimers[timer] = struct{}{}
+}
+
+// calls graceWg.Done
+func (s *Server) deleteHostSession(session hostSession, timedOut bool, detail string) {
+	defer s.graceWg.Done()
+
+	if err := s.store.DeleteFilesDocOfSession(session.filesId, session.session); err != nil {
+		fmt.Printf("delete files doc err: %v\n", err)
+		return
+	}
+	// else another websocket resumed the session
+	if _, err := s.store.HostSession(session.filesId); !errors.Is(err, mongoclient.ErrNotFound) {
+		return
+	}
+
+	if timedOut {
+		s.notifyHostTimeout(session.filesId)
+	}
+	s.recordShareDeleted(session.filesId, detail)
+}
+
+// the shares of the stopped timers are kept, their hosts can resume in
+// another instance until they expire
+func (s *Server) stopGraceTimers() {
+	s.mu.Lock()
+	for timer := range s.graceTimers {
+		timer.Stop()
+	}
+	clear(s.graceTimers)
+	s.mu.Unlock()
+
+	s.graceWg.Wait()
+}
+
+func (s *Server) recordShareDeleted(filesId string, detail string) {
+	objId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		return
+	}
+
+	event := schema.NewAuditEventSchema(objId, schema.AuditShareDeleted)
+	event.Detail = detail
+	s.audit.Record(event)
+}
+
+// false if the server is shutting down
+func (s *Server) track(c *WsConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) untrack(c *WsConn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+
+	s.wg.Done()
+}
+
+// Shutdown sends MsgGoingAway to every websocket, closes them and waits for
+// their handlers to finish or ctx to be done, then stops the host grace
+// timers. The docs of the websockets closed by it are kept for their peers to
+// reconnect to another instance. New websockets are closed right away
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := make([]*WsConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.SendAndClose(goingAwayMessage())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.stopGraceTimers()
+		return nil
+	case <-ctx.Done():
+		s.stopGraceTimers()
+		return ctx.Err()
+	}
+}
+
+type Stats struct {
+	Websockets int `json:"websockets"`
+	// signaling listeners still open, they stop with their websocket so a
+	// number higher than websockets means a leak
+	Listeners int64 `json:"listeners"`
+	// relays with both websockets connected
+	Relays int `json:"relays"`
+}
+
+func (s *Server) StatsHandler(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	websockets := len(s.conns)
+	relays := 0
+	for _, r := range s.relays {
+		if r.host.Load() != nil && r.conn.Load() != nil {
+			relays++
+		}
+	}
+	s.mu.Unlock()
+
+	handler.SendResponse(w, Stats{
+		Websockets: websockets,
+		Listeners:  s.signaler.ActiveListeners(),
+		Relays:     relays,
+	})
+}
+
+// the reconnect delay is random, so the clients of an instance don't all
+// reconnect at the same time
+func goingAwayMessage() Message {
+	return newMessage(MsgGoingAway, GoingAway{
+		Msg:            "server going away",
+		ReconnectAfter: (time.Second + rand.N(4*time.Second)).Milliseconds(),
+	})
+}
+
+// the offers and answers are only relayed after the host approves the conn
+func (s *Server) requireApproved(signalingId string) (*schema.SignalingSchema, error) {
+	doc, err := s.store.GetSignalingDoc(signalingId)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Status != schema.SignalingApproved {
+		return nil, fmt.Errorf("connection not approved by the host")
+	}
+	return doc, nil
+}
+
+// requireApproved for the messages that don't use the doc, it's only read
+// until the websocket sees the approval
+func (s *Server) checkApproved(c *WsConn, signalingId string) error {
+	if c.approved[signalingId] {
+		return nil
+	}
+	if _, err := s.requireApproved(signalingId); err != nil {
+		return err
+	}
+	c.approved[signalingId] = true
+	return nil
+}
+
+// the host can only answer requests that weren't answered yet
+func (s *Server) requirePending(signalingId string) error {
+	doc, err := s.store.GetSignalingDoc(signalingId)
+	if err != nil {
+		return err
+	}
+	if doc.Request == "" {
+		return fmt.Errorf("connection not requested")
+	}
+	if doc.Status != "" {
+		return fmt.Errorf("connection already %v", doc.Status)
+	}
+	return nil
 }
@@ -0,0 +1,614 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/audit"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/config"
+	mongoclient "github.com/4jairo/webrtc-filetransfer-backendBackend/db"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/handler"
+	"github.com/4jairo/webrtc-filetransfer-backendBackend/schema"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/websocket"
+)
+
+// how long a test client waits for a message
+const testReceiveTimeout = 2 * time.Second
+
+// accepts the connections of the test server. Their writes can be paused,
+// like a client that stops reading, and a write that runs while another one
+// of the same connection didn't return is recorded
+type testListener struct {
+	net.Listener
+	concurrentWrites atomic.Bool
+
+	mu sync.Mutex
+	// closed by resumeWrites, nil while the writes aren't paused
+	paused chan struct{}
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &testConn{Conn: conn, l: l, closed: make(chan struct{})}, nil
+}
+
+func (l *testListener) pauseWrites() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused == nil {
+		l.paused = make(chan struct{})
+	}
+}
+
+func (l *testListener) resumeWrites() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused != nil {
+		close(l.paused)
+		l.paused = nil
+	}
+}
+
+type testConn struct {
+	net.Conn
+	l       *testListener
+	writers atomic.Int32
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+	closeOnce     sync.Once
+	closed        chan struct{}
+}
+
+func (c *testConn) SetDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *testConn) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *testConn) setWriteDeadline(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+}
+
+// waits while the writes are paused, until the deadline or the connection
+// is closed. Like with a net.Conn, a deadline set during the write applies
+// to it
+func (c *testConn) Write(b []byte) (int, error) {
+	if c.writers.Add(1) > 1 {
+		c.l.concurrentWrites.Store(true)
+	}
+	defer c.writers.Add(-1)
+
+	c.l.mu.Lock()
+	paused := c.l.paused
+	c.l.mu.Unlock()
+	for paused != nil {
+		c.mu.Lock()
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		select {
+		case <-paused:
+			paused = nil
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *testConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+type testServer struct {
+	*Server
+	listener *testListener
+	http     *httptest.Server
+	// secret of the signaling docs created by newConnDoc
+	secrets map[string]string
+}
+
+// a server with the memory store and the store signaler, without keepalive
+// and with the relay enabled. configure changes it before it starts
+func newTestServer(t *testing.T, configure func(s *Server)) *testServer {
+	t.Helper()
+
+	store := mongoclient.NewMemoryStore()
+	tokens := handler.NewTokens([]byte("key"), time.Hour, time.Hour, store)
+	fileRelay := config.FileRelayConfig{Enabled: true, Window: 1 << 20, MaxFrame: 64 << 10}
+	s := NewServer(store, NewStoreSignaler(store), tokens, false, time.Minute, config.WebsocketConfig{}, fileRelay, time.Hour, audit.NewLog(store, false, time.Hour))
+	if configure != nil {
+		configure(s)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/conn/{objId}", s.WsHandler(WsRoleConn))
+	router.HandleFunc("/ws/host/{objId}", s.WsHandler(WsRoleHost))
+	router.HandleFunc("/ws/relay/conn/{objId}", s.RelayHandler(WsRoleConn))
+	router.HandleFunc("/ws/relay/host/{objId}", s.RelayHandler(WsRoleHost))
+
+	ts := &testServer{Server: s, http: httptest.NewUnstartedServer(router), secrets: map[string]string{}}
+	ts.listener = &testListener{Listener: ts.http.Listener}
+	ts.http.Listener = ts.listener
+	ts.http.Start()
+
+	t.Cleanup(func() {
+		ts.listener.resumeWrites()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		ts.http.Close()
+	})
+	return ts
+}
+
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func (s *testServer) dial(t *testing.T, path string) *testClient {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(s.http.URL, "http") + path
+	ws, err := websocket.Dial(url, "", s.http.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return &testClient{t: t, ws: ws}
+}
+
+func (c *testClient) send(msgType MessageType, data any) {
+	c.t.Helper()
+	c.sendMessage(newMessage(msgType, data))
+}
+
+// the host messages of the conn of signalingId
+func (c *testClient) sendTo(signalingId string, msgType MessageType, data any) {
+	c.t.Helper()
+	msg := newMessage(msgType, data)
+	msg.SignalingId = signalingId
+	c.sendMessage(msg)
+}
+
+func (c *testClient) sendMessage(msg Message) {
+	c.t.Helper()
+	if err := websocket.JSON.Send(c.ws, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) sendBinary(data []byte) {
+	c.t.Helper()
+	if err := websocket.Message.Send(c.ws, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// the next message, binary ones are returned in data
+func (c *testClient) receiveFrame() (msg Message, data []byte, err error) {
+	c.ws.SetReadDeadline(time.Now().Add(testReceiveTimeout))
+
+	var in inMessage
+	if err := inCodec.Receive(c.ws, &in); err != nil {
+		return msg, nil, err
+	}
+	if in.binary {
+		return msg, in.data, nil
+	}
+	return msg, nil, json.Unmarshal(in.data, &msg)
+}
+
+func (c *testClient) receive() Message {
+	c.t.Helper()
+
+	msg, data, err := c.receiveFrame()
+	if err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	if data != nil {
+		c.t.Fatalf("received %v binary bytes", len(data))
+	}
+	return msg
+}
+
+// the next message must be of type want, its data is decoded into data (if
+// not nil)
+func (c *testClient) receiveType(want MessageType, data any) Message {
+	c.t.Helper()
+
+	msg := c.receive()
+	if msg.Type != want {
+		c.t.Fatalf("received %v %s, want %v", msg.Type, msg.Data, want)
+	}
+	if data != nil {
+		if err := json.Unmarshal(msg.Data, data); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return msg
+}
+
+// the message of the next MsgError
+func (c *testClient) receiveError() string {
+	c.t.Helper()
+
+	var msgErr MessageError
+	c.receiveType(MsgError, &msgErr)
+	return msgErr.Msg
+}
+
+// waits until the server closes the websocket, failing if it sends anything
+// else before
+func (c *testClient) receiveClose() {
+	c.t.Helper()
+
+	msg, data, err := c.receiveFrame()
+	if err == nil {
+		c.t.Fatalf("received %v %s (%v binary bytes) instead of the close", msg.Type, msg.Data, len(data))
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.t.Fatal("not closed")
+	}
+}
+
+// nothing is received for a while
+func (c *testClient) receiveNothing() {
+	c.t.Helper()
+
+	c.ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var in inMessage
+	err := inCodec.Receive(c.ws, &in)
+	if err == nil {
+		c.t.Fatalf("received %s", in.data)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		c.t.Fatalf("closed: %v", err)
+	}
+}
+
+// sends a heartbeat every interval until the test ends, so the websocket
+// doesn't reach the idle timeout
+func (c *testClient) keepAlive(interval time.Duration) {
+	stop := make(chan struct{})
+	c.t.Cleanup(func() { close(stop) })
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				websocket.JSON.Send(c.ws, newMessage(MsgHeartbeat, Heartbeat{}))
+			}
+		}
+	}()
+}
+
+// every message sent before was processed once the error of an unknown
+// message type is received
+func (c *testClient) sync() {
+	c.t.Helper()
+	c.sendMessage(Message{Type: -1})
+	c.receiveError()
+}
+
+func (s *testServer) newShare(t *testing.T) string {
+	t.Helper()
+
+	filesId, err := s.store.CreateFilesDoc(schema.NewFileSchema("user", "files", []schema.File{{Name: "a", Length: 10}}, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filesId.Hex()
+}
+
+func (s *testServer) hostToken(t *testing.T, filesId string) string {
+	t.Helper()
+
+	token, _, err := s.tokens.Issue(filesId, handler.AllPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// a host websocket listening for filesId
+func (s *testServer) listenHost(t *testing.T, filesId string) (*testClient, HostSession) {
+	t.Helper()
+
+	host := s.dial(t, "/ws/host/"+filesId)
+	host.send(MsgListenOffersHost, ListenOffersHost{Url: filesId, Token: s.hostToken(t, filesId)})
+
+	var session HostSession
+	host.receiveType(MsgHostSession, &session)
+	return host, session
+}
+
+// a conn of filesId listening on its websocket, the host receives its
+// Presence joined
+// a signaling doc of the share, like /signaling/new
+func (s *testServer) newConnDoc(t *testing.T, filesId string) string {
+	t.Helper()
+
+	fileObjId, err := primitive.ObjectIDFromHex(filesId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, hash, err := handler.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := schema.NewSignalingSchema(fileObjId)
+	doc.Secret = hash
+	signalingObjId, err := s.store.CreateSignalingDoc(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.secrets[signalingObjId.Hex()] = secret
+	return signalingObjId.Hex()
+}
+
+// the path of a conn websocket (route + signalingId) with its secret
+func (s *testServer) connPath(route string, signalingId string) string {
+	return route + signalingId + "?secret=" + s.secrets[signalingId]
+}
+
+func (s *testServer) listenConn(t *testing.T, filesId string) (string, *testClient) {
+	t.Helper()
+
+	signalingId := s.newConnDoc(t, filesId)
+	conn := s.dial(t, s.connPath("/ws/conn/", signalingId))
+	conn.send(MsgListenOffersConn, ListenOffersConn{})
+	conn.sync()
+	return signalingId, conn
+}
+
+// the conn requests the connection and the host approves it
+func approve(t *testing.T, host *testClient, signalingId string, conn *testClient) {
+	t.Helper()
+
+	conn.send(MsgConnRequest, ConnRequest{Name: "bob"})
+	msg := host.receiveType(MsgConnRequest, nil)
+	if msg.SignalingId != signalingId {
+		t.Fatalf("request of %v, want %v", msg.SignalingId, signalingId)
+	}
+	host.sendTo(signalingId, MsgConnApprove, ConnApprove{})
+	conn.receiveType(MsgConnApprove, nil)
+}
+
+// the event of the next Presence of the host, of the conn of signalingId
+func receivePresence(t *testing.T, host *testClient, signalingId string) string {
+	t.Helper()
+
+	var presence Presence
+	msg := host.receiveType(MsgPresence, &presence)
+	if msg.SignalingId != signalingId {
+		t.Fatalf("presence of %v, want %v", msg.SignalingId, signalingId)
+	}
+	return presence.Event
+}
+
+// waits until cond is true
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testReceiveTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: timed out", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *testServer) websockets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// a host that times out and resumes within the grace keeps its conns
+func TestHostTimeoutResume(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.keepalive = config.WebsocketConfig{IdleTimeout: 100 * time.Millisecond}
+	})
+	filesId := s.newShare(t)
+	host, session := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	conn.keepAlive(30 * time.Millisecond)
+	receivePresence(t, host, signalingId)
+
+	var disconnect Disconnect
+	host.receiveType(MsgDisconnect, &disconnect)
+	if disconnect.Reason != DisconnectTimeout {
+		t.Errorf("reason %q, want %q", disconnect.Reason, DisconnectTimeout)
+	}
+	host.receiveClose()
+
+	resumed := s.dial(t, "/ws/host/"+filesId)
+	resumed.keepAlive(30 * time.Millisecond)
+	resumed.send(MsgResumeHost, ResumeHost{Url: filesId, ResumeToken: session.ResumeToken})
+	resumed.receiveType(MsgHostSession, nil)
+	receivePresence(t, resumed, signalingId)
+
+	conn.receiveNothing()
+	if _, err := s.store.GetSignalingDoc(signalingId); err != nil {
+		t.Errorf("signaling doc: %v", err)
+	}
+	if _, err := s.store.GetFiles(filesId); err != nil {
+		t.Errorf("files doc: %v", err)
+	}
+}
+
+// the share of a host that doesn't resume is deleted after the grace, and
+// the conns of a host that timed out are told then
+func TestHostGraceExpired(t *testing.T) {
+	tests := []struct {
+		name     string
+		timedOut bool
+	}{
+		{"timed out", true},
+		{"left", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(s *Server) {
+				s.hostGrace = 300 * time.Millisecond
+				s.keepalive = config.WebsocketConfig{IdleTimeout: 100 * time.Millisecond}
+			})
+			filesId := s.newShare(t)
+			host, _ := s.listenHost(t, filesId)
+			signalingId, conn := s.listenConn(t, filesId)
+			conn.keepAlive(30 * time.Millisecond)
+			receivePresence(t, host, signalingId)
+
+			if tt.timedOut {
+				host.receiveType(MsgDisconnect, nil)
+			} else {
+				host.ws.Close()
+			}
+			// within the grace
+			conn.receiveNothing()
+
+			if tt.timedOut {
+				var disconnect Disconnect
+				conn.receiveType(MsgDisconnect, &disconnect)
+				if disconnect.Reason != DisconnectTimeout {
+					t.Errorf("reason %q, want %q", disconnect.Reason, DisconnectTimeout)
+				}
+			}
+			eventually(t, "files doc deleted", func() bool {
+				_, err := s.store.GetFiles(filesId)
+				return errors.Is(err, mongoclient.ErrNotFound)
+			})
+			if !tt.timedOut {
+				conn.receiveNothing()
+			}
+		})
+	}
+}
+
+// the docs of the websockets closed by the shutdown are kept, for their
+// clients to reconnect to another instance
+func TestShutdown(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.hostGrace = 100 * time.Millisecond
+	})
+	filesId := s.newShare(t)
+	host, _ := s.listenHost(t, filesId)
+	signalingId, conn := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+
+	// a share waiting for its host to resume
+	leftId := s.newShare(t)
+	left, _ := s.listenHost(t, leftId)
+	left.ws.Close()
+	eventually(t, "host websocket closed", func() bool { return s.websockets() == 2 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*testClient{host, conn} {
+		var goingAway GoingAway
+		c.receiveType(MsgGoingAway, &goingAway)
+		if goingAway.ReconnectAfter <= 0 {
+			t.Errorf("reconnect after %v", goingAway.ReconnectAfter)
+		}
+		c.receiveClose()
+	}
+	if n := s.websockets(); n != 0 {
+		t.Errorf("%v websockets after the shutdown", n)
+	}
+
+	// past the grace of the host that left
+	time.Sleep(2 * s.hostGrace)
+	if _, err := s.store.GetSignalingDoc(signalingId); err != nil {
+		t.Errorf("signaling doc: %v", err)
+	}
+	for _, id := range []string{filesId, leftId} {
+		if _, err := s.store.GetFiles(id); err != nil {
+			t.Errorf("files doc %v: %v", id, err)
+		}
+	}
+
+	// new websockets are closed right away
+	late := s.dial(t, s.connPath("/ws/conn/", signalingId))
+	late.receiveType(MsgGoingAway, nil)
+	late.receiveClose()
+}
+
+// a websocket with the signalingId of another conn, but not its secret, is
+// closed without touching the doc
+func TestConnSecret(t *testing.T) {
+	s := newTestServer(t, nil)
+	filesId := s.newShare(t)
+	host, _ := s.listenHost(t, filesId)
+	signalingId, _ := s.listenConn(t, filesId)
+	receivePresence(t, host, signalingId)
+	other := s.newConnDoc(t, filesId)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"without secret", "/ws/conn/" + signalingId},
+		{"wrong secret", "/ws/conn/" + signalingId + "?secret=bad"},
+		{"secret of another conn", "/ws/conn/" + signalingId + "?secret=" + s.secrets[other]},
+		{"unknown signaling doc", s.connPath("/ws/conn/", primitive.NewObjectID().Hex())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := s.dial(t, tt.path)
+			if got := c.receiveError(); got == "" {
+				t.Error("no error")
+			}
+			c.receiveClose()
+		})
+	}
+
+	// the conn is still there, and the host wasn't told anything
+	host.receiveNothing()
+	if _, err := s.store.GetSignalingDoc(signalingId); err != nil {
+		t.Errorf("signaling doc: %v", err)
+	}
+}
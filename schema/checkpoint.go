@@ -0,0 +1,103 @@
+package schema
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const CheckpointsCollection string = "checkpoints"
+
+// ChunkRange is the chunks [Start, End) of the chunk manifest of a file
+type ChunkRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// CheckpointSchema is the chunks of a file acknowledged by a receiver. It's
+// kept across the signaling docs of the receiver until the share expires
+type CheckpointSchema struct {
+	// filesId/receiver/file
+	ID      string             `bson:"_id"`
+	FilesId primitive.ObjectID `bson:"filesId"`
+	// hash of the resume token of the receiver
+	Receiver string `bson:"receiver"`
+	File     string `bson:"file"`
+	// of the manifest the chunks refer to, the checkpoint is ignored if it
+	// changes
+	ChunkSize uint64       `bson:"chunkSize"`
+	Chunks    []ChunkRange `bson:"chunks"`
+	UpdatedAt time.Time    `bson:"updatedAt"`
+	ExpireAt  time.Time    `bson:"expireAt"`
+}
+
+func NewCheckpointSchema(filesId primitive.ObjectID, receiver string, file string, chunkSize uint64, expireAt time.Time) CheckpointSchema {
+	return CheckpointSchema{
+		ID:        filesId.Hex() + "/" + receiver + "/" + file,
+		FilesId:   filesId,
+		Receiver:  receiver,
+		File:      file,
+		ChunkSize: chunkSize,
+		Chunks:    []ChunkRange{},
+		UpdatedAt: time.Now(),
+		ExpireAt:  expireAt,
+	}
+}
+
+// CheckRanges returns an error if a range is empty or past the last of count
+// chunks
+func CheckRanges(ranges []ChunkRange, count uint64) error {
+	for _, r := range ranges {
+		if r.Start >= r.End || r.End > count {
+			return fmt.Errorf("invalid chunk range [%v, %v) of %v chunks", r.Start, r.End, count)
+		}
+	}
+	return nil
+}
+
+// MergeRanges returns the ranges of both, sorted and without overlaps
+func MergeRanges(ranges []ChunkRange, add []ChunkRange) []ChunkRange {
+	all := append(slices.Clone(ranges), add...)
+	slices.SortFunc(all, func(a, b ChunkRange) int {
+		switch {
+		case a.Start < b.Start:
+			return -1
+		case a.Start > b.Start:
+			return 1
+		}
+		return 0
+	})
+
+	merged := []ChunkRange{}
+	for _, r := range all {
+		last := len(merged) - 1
+		if last >= 0 && r.Start <= merged[last].End {
+			merged[last].End = max(merged[last].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// MissingRanges returns the chunks of count that aren't in ranges (sorted
+// and without overlaps, like MergeRanges returns them)
+func MissingRanges(ranges []ChunkRange, count uint64) []ChunkRange {
+	missing := []ChunkRange{}
+	var next uint64
+	for _, r := range ranges {
+		if r.Start > next {
+			missing = append(missing, ChunkRange{Start: next, End: min(r.Start, count)})
+		}
+		next = max(next, r.End)
+		if next >= count {
+			return missing
+		}
+	}
+	if next < count {
+		missing = append(missing, ChunkRange{Start: next, End: count})
+	}
+	return missing
+}
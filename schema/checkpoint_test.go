@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []ChunkRange
+		count  uint64
+		valid  bool
+	}{
+		{"none", nil, 10, true},
+		{"every chunk", []ChunkRange{{0, 10}}, 10, true},
+		{"several", []ChunkRange{{0, 2}, {5, 6}}, 10, true},
+		{"empty", []ChunkRange{{3, 3}}, 10, false},
+		{"reversed", []ChunkRange{{4, 3}}, 10, false},
+		{"past the last chunk", []ChunkRange{{8, 11}}, 10, false},
+		{"no chunks", []ChunkRange{{0, 1}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRanges(tt.ranges, tt.count)
+			if (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []ChunkRange
+		add    []ChunkRange
+		want   []ChunkRange
+	}{
+		{"none", nil, nil, []ChunkRange{}},
+		{"first", nil, []ChunkRange{{2, 4}}, []ChunkRange{{2, 4}}},
+		{"apart", []ChunkRange{{0, 2}}, []ChunkRange{{5, 6}}, []ChunkRange{{0, 2}, {5, 6}}},
+		{"sorted", []ChunkRange{{5, 6}}, []ChunkRange{{0, 2}}, []ChunkRange{{0, 2}, {5, 6}}},
+		{"adjacent", []ChunkRange{{0, 2}}, []ChunkRange{{2, 4}}, []ChunkRange{{0, 4}}},
+		{"overlapping", []ChunkRange{{0, 3}}, []ChunkRange{{2, 5}}, []ChunkRange{{0, 5}}},
+		{"contained", []ChunkRange{{0, 10}}, []ChunkRange{{2, 5}}, []ChunkRange{{0, 10}}},
+		{"fills a gap", []ChunkRange{{0, 2}, {4, 6}}, []ChunkRange{{2, 4}}, []ChunkRange{{0, 6}}},
+		{"repeated", []ChunkRange{{1, 2}}, []ChunkRange{{1, 2}, {1, 2}}, []ChunkRange{{1, 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := slices.Clone(tt.ranges)
+
+			got := MergeRanges(ranges, tt.add)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(ranges, tt.ranges) {
+				t.Errorf("ranges modified: %v", ranges)
+			}
+		})
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []ChunkRange
+		count  uint64
+		want   []ChunkRange
+	}{
+		{"none received", nil, 10, []ChunkRange{{0, 10}}},
+		{"every chunk", []ChunkRange{{0, 10}}, 10, []ChunkRange{}},
+		{"start", []ChunkRange{{0, 4}}, 10, []ChunkRange{{4, 10}}},
+		{"end", []ChunkRange{{6, 10}}, 10, []ChunkRange{{0, 6}}},
+		{"gaps", []ChunkRange{{1, 3}, {5, 7}}, 10, []ChunkRange{{0, 1}, {3, 5}, {7, 10}}},
+		{"no chunks", nil, 0, []ChunkRange{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MissingRanges(tt.ranges, tt.count)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
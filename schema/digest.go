@@ -0,0 +1,118 @@
+package schema
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// hash algorithms of a FileDigest, both have 32 byte hashes
+const (
+	DigestSha256 string = "sha256"
+	DigestBlake3 string = "blake3"
+)
+
+// most chunk hashes of a file, so a manifest can't make the files doc too
+// big. A bigger file needs bigger chunks
+const MaxDigestChunks int = 1 << 14
+
+// most chunk hashes of all the files of a share, each one is 64 bytes of hex
+// so the files doc stays under the 16MB of a mongo document
+const MaxShareDigestChunks int = 1 << 16
+
+// FileDigest is the hash of a file and, optionally, of every ChunkSize bytes
+// of it (the last chunk can be shorter). The server only checks its shape,
+// the receivers check the data they get against it
+type FileDigest struct {
+	Algorithm string `json:"algorithm"`
+	// hex
+	Hash      string   `json:"hash"`
+	ChunkSize uint64   `json:"chunkSize,omitempty"`
+	Chunks    []string `json:"chunks,omitempty"`
+}
+
+// Check returns an error if the digest isn't valid for a file of length bytes
+func (d *FileDigest) Check(length uint64) error {
+	if d.Algorithm != DigestSha256 && d.Algorithm != DigestBlake3 {
+		return fmt.Errorf("algorithm must be %v or %v, got %q", DigestSha256, DigestBlake3, d.Algorithm)
+	}
+	if err := checkHash(d.Hash); err != nil {
+		return err
+	}
+
+	if d.ChunkSize == 0 {
+		if len(d.Chunks) != 0 {
+			return errors.New("chunks without chunkSize")
+		}
+		return nil
+	}
+
+	chunks := d.ChunkCount(length)
+	if chunks > uint64(MaxDigestChunks) {
+		return fmt.Errorf("%v chunks, at most %v are allowed, use a bigger chunkSize", chunks, MaxDigestChunks)
+	}
+	if uint64(len(d.Chunks)) != chunks {
+		return fmt.Errorf("%v chunks of %v bytes, expected %v", len(d.Chunks), d.ChunkSize, chunks)
+	}
+	for i, chunk := range d.Chunks {
+		if err := checkHash(chunk); err != nil {
+			return fmt.Errorf("chunk %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// ChunkCount is the number of chunks of a file of length bytes, 0 without
+// chunk manifest
+func (d *FileDigest) ChunkCount(length uint64) uint64 {
+	if d.ChunkSize == 0 {
+		return 0
+	}
+	chunks := length / d.ChunkSize
+	if length%d.ChunkSize != 0 {
+		chunks++
+	}
+	return chunks
+}
+
+func checkHash(hash string) error {
+	bytes, err := hex.DecodeString(hash)
+	if err != nil || len(bytes) != 32 {
+		return fmt.Errorf("hash %q isn't 32 bytes of hex", hash)
+	}
+	return nil
+}
+
+// CheckDigests checks the digest of every file that has one and that all of
+// them have at most MaxShareDigestChunks chunks
+func CheckDigests(files []File) error {
+	for _, file := range files {
+		if file.Digest == nil {
+			continue
+		}
+		if err := file.Digest.Check(file.Length); err != nil {
+			return fmt.Errorf("digest of %q: %v", file.Name, err)
+		}
+	}
+	return CheckShareChunks(files)
+}
+
+// CheckShareChunks returns an error if the files have more than
+// MaxShareDigestChunks chunk hashes
+func CheckShareChunks(files []File) error {
+	if chunks := DigestChunks(files); chunks > MaxShareDigestChunks {
+		return fmt.Errorf("%v chunks, at most %v are allowed in a share", chunks, MaxShareDigestChunks)
+	}
+	return nil
+}
+
+// DigestChunks is the number of chunk hashes of the digests of files
+func DigestChunks(files []File) int {
+	chunks := 0
+	for _, file := range files {
+		if file.Digest != nil {
+			chunks += len(file.Digest.Chunks)
+		}
+	}
+	return chunks
+}
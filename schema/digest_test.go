@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+var testHash = strings.Repeat("ab", 32)
+
+func hashes(n int) []string {
+	chunks := make([]string, n)
+	for i := range chunks {
+		chunks[i] = testHash
+	}
+	return chunks
+}
+
+func TestFileDigestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		digest FileDigest
+		length uint64
+		valid  bool
+	}{
+		{"sha256", FileDigest{Algorithm: DigestSha256, Hash: testHash}, 10, true},
+		{"blake3", FileDigest{Algorithm: DigestBlake3, Hash: testHash}, 10, true},
+		{"unknown algorithm", FileDigest{Algorithm: "md5", Hash: testHash}, 10, false},
+		{"short hash", FileDigest{Algorithm: DigestSha256, Hash: "abcd"}, 10, false},
+		{"not hex", FileDigest{Algorithm: DigestSha256, Hash: strings.Repeat("zz", 32)}, 10, false},
+		{"chunks", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 4, Chunks: hashes(3)}, 10, true},
+		{"chunks without chunkSize", FileDigest{Algorithm: DigestSha256, Hash: testHash, Chunks: hashes(1)}, 10, false},
+		{"missing chunk", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 4, Chunks: hashes(2)}, 10, false},
+		{"extra chunk", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 5, Chunks: hashes(3)}, 10, false},
+		{"invalid chunk", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 10, Chunks: []string{"ab"}}, 10, false},
+		{"most chunks", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 1, Chunks: hashes(MaxDigestChunks)}, uint64(MaxDigestChunks), true},
+		{"too many chunks", FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 1, Chunks: hashes(MaxDigestChunks + 1)}, uint64(MaxDigestChunks + 1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.digest.Check(tt.length); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestFileDigestChunkCount(t *testing.T) {
+	tests := []struct {
+		chunkSize uint64
+		length    uint64
+		want      uint64
+	}{
+		{0, 10, 0},
+		{5, 10, 2},
+		{4, 10, 3},
+		{20, 10, 1},
+		{4, 0, 0},
+	}
+
+	for _, tt := range tests {
+		d := FileDigest{ChunkSize: tt.chunkSize}
+		if got := d.ChunkCount(tt.length); got != tt.want {
+			t.Errorf("ChunkCount(%v) with chunkSize %v = %v, want %v", tt.length, tt.chunkSize, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDigests(t *testing.T) {
+	// the most chunks of a file
+	file := func(name string) File {
+		return File{
+			Name:   name,
+			Length: uint64(MaxDigestChunks),
+			Digest: &FileDigest{Algorithm: DigestSha256, Hash: testHash, ChunkSize: 1, Chunks: hashes(MaxDigestChunks)},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		files []File
+		// with MaxShareDigestChunks chunks before files
+		full  bool
+		valid bool
+	}{
+		{"no digest", []File{{Name: "a", Length: 10}}, false, true},
+		{"invalid digest", []File{{Name: "a", Length: 10, Digest: &FileDigest{Algorithm: "md5"}}}, false, false},
+		{"most chunks of a share", nil, true, true},
+		{"without chunks in a full share", []File{{Name: "last", Length: 10}}, true, true},
+		{"too many chunks in a share", []File{file("last")}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []File
+			if tt.full {
+				for i := range MaxShareDigestChunks / MaxDigestChunks {
+					files = append(files, file(string(rune('a'+i))))
+				}
+			}
+			files = append(files, tt.files...)
+
+			if err := CheckDigests(files); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
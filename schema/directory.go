@@ -1,8 +1,179 @@
 package schema
 
-// type DirectoryContent struct {
-// 	Files []File    `json:"files"`
-// 	Dirs  Directory `json:"dirs"`
-// }
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
 
-// type Directory map[string]DirectoryContent
+// The files of a share are stored as a flat list, the Name of each one is
+// its path relative to the share ("src/main.go"). The directory tree is built
+// from it, and the trees sent by the clients are flattened before they are
+// stored
+
+type DirectoryContent struct {
+	// only the last element of the path as the Name
+	Files []File    `json:"files"`
+	Dirs  Directory `json:"dirs"`
+	// of every file of the subtree, filled by NewDirectoryContent
+	Length uint64 `json:"length"`
+	Count  int    `json:"count"`
+}
+
+// by directory name
+type Directory map[string]DirectoryContent
+
+// NewDirectoryContent returns the tree of the files (by path)
+func NewDirectoryContent(files []File) DirectoryContent {
+	root := newDirectoryContent()
+	for _, file := range files {
+		root.add(strings.Split(file.Name, "/"), file)
+	}
+	return root
+}
+
+func newDirectoryContent() DirectoryContent {
+	return DirectoryContent{
+		Files: []File{},
+		Dirs:  Directory{},
+	}
+}
+
+func (d *DirectoryContent) add(elems []string, file File) {
+	d.Length += file.Length
+	d.Count++
+
+	if len(elems) == 1 {
+		file.Name = elems[0]
+		d.Files = append(d.Files, file)
+		return
+	}
+
+	dir, ok := d.Dirs[elems[0]]
+	if !ok {
+		dir = newDirectoryContent()
+	}
+	dir.add(elems[1:], file)
+	d.Dirs[elems[0]] = dir
+}
+
+// Flatten returns the files of the tree with their path as the Name, the
+// files of a directory before the ones of its subdirectories (by name).
+// The paths are checked with CheckPath
+func (d DirectoryContent) Flatten() ([]File, error) {
+	files := []File{}
+	if err := d.flatten("", &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (d DirectoryContent) flatten(prefix string, files *[]File) error {
+	for _, file := range d.Files {
+		file.Name = prefix + file.Name
+		if err := CheckPath(file.Name); err != nil {
+			return err
+		}
+		*files = append(*files, file)
+	}
+
+	names := make([]string, 0, len(d.Dirs))
+	for name := range d.Dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := CheckPath(prefix + name); err != nil {
+			return err
+		}
+		if err := d.Dirs[name].flatten(prefix+name+"/", files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckPath returns an error if name isn't a clean relative path, like
+// "a.txt" or "src/main.go" (not "/a.txt", "../a.txt", "src//main.go" or
+// "src\main.go")
+func CheckPath(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty file name")
+	case strings.ContainsRune(name, '\\'):
+		return fmt.Errorf("file %q: use / as the path separator", name)
+	case path.IsAbs(name) || path.Clean(name) != name || name == ".":
+		return fmt.Errorf("file %q: not a clean relative path", name)
+	case name == ".." || strings.HasPrefix(name, "../"):
+		return fmt.Errorf("file %q: outside of the share", name)
+	}
+	return nil
+}
+
+// CheckPaths checks every path of files, and that none is repeated or is
+// also a directory of another one ("a" and "a/b")
+func CheckPaths(files []File) error {
+	for _, file := range files {
+		if err := CheckPath(file.Name); err != nil {
+			return err
+		}
+	}
+	if name := PathConflict(nil, files); name != "" {
+		return fmt.Errorf("file %q is repeated or conflicts with a directory", name)
+	}
+	return nil
+}
+
+// PathConflict returns the first path of added that is already in current or
+// added, or that is a file and a directory of another file ("a" and "a/b"),
+// "" if there's none. The paths of current aren't checked against each other
+func PathConflict(current []File, added []File) string {
+	names := map[string]bool{}
+	dirs := map[string]bool{}
+	add := func(name string) {
+		names[name] = true
+		for _, dir := range ParentDirs(name) {
+			dirs[dir] = true
+		}
+	}
+
+	for _, file := range current {
+		add(file.Name)
+	}
+	for _, file := range added {
+		if names[file.Name] || dirs[file.Name] {
+			return file.Name
+		}
+		for _, dir := range ParentDirs(file.Name) {
+			if names[dir] {
+				return file.Name
+			}
+		}
+		add(file.Name)
+	}
+	return ""
+}
+
+// ParentDirs returns the directories of the path, "a/b/c" -> "a", "a/b"
+func ParentDirs(name string) []string {
+	var dirs []string
+	for i := range len(name) {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	return dirs
+}
+
+// InDirs is true if the file (by path) is inside one of the dirs
+func InDirs(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
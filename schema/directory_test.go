@@ -0,0 +1,226 @@
+package schema
+
+import (
+	"slices"
+	"testing"
+)
+
+func fileNames(files []File) []string {
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestNewDirectoryContent(t *testing.T) {
+	root := NewDirectoryContent([]File{
+		{Name: "a.txt", Length: 1},
+		{Name: "src/main.go", Length: 2},
+		{Name: "src/lib/lib.go", Length: 3},
+		{Name: "src/lib/util.go", Length: 4},
+	})
+
+	tests := []struct {
+		name   string
+		dir    DirectoryContent
+		files  []string
+		dirs   []string
+		length uint64
+		count  int
+	}{
+		{"root", root, []string{"a.txt"}, []string{"src"}, 10, 4},
+		{"src", root.Dirs["src"], []string{"main.go"}, []string{"lib"}, 9, 3},
+		{"src/lib", root.Dirs["src"].Dirs["lib"], []string{"lib.go", "util.go"}, []string{}, 7, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fileNames(tt.dir.Files); !slices.Equal(got, tt.files) {
+				t.Errorf("files %v, want %v", got, tt.files)
+			}
+			dirs := []string{}
+			for name := range tt.dir.Dirs {
+				dirs = append(dirs, name)
+			}
+			if !slices.Equal(dirs, tt.dirs) {
+				t.Errorf("dirs %v, want %v", dirs, tt.dirs)
+			}
+			if tt.dir.Length != tt.length || tt.dir.Count != tt.count {
+				t.Errorf("length %v count %v, want %v %v", tt.dir.Length, tt.dir.Count, tt.length, tt.count)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   DirectoryContent
+		want  []string
+		valid bool
+	}{
+		{"empty", DirectoryContent{}, []string{}, true},
+		{"files before dirs", DirectoryContent{
+			Files: []File{{Name: "z.txt"}},
+			Dirs: Directory{
+				"b": {Files: []File{{Name: "b.txt"}}},
+				"a": {Dirs: Directory{"c": {Files: []File{{Name: "c.txt"}}}}},
+			},
+		}, []string{"z.txt", "a/c/c.txt", "b/b.txt"}, true},
+		{"invalid file name", DirectoryContent{Files: []File{{Name: ".."}}}, nil, false},
+		{"invalid dir name", DirectoryContent{Dirs: Directory{"a/../..": {Files: []File{{Name: "a.txt"}}}}}, nil, false},
+		{"separator in a name", DirectoryContent{Dirs: Directory{"a": {Files: []File{{Name: "b\\c"}}}}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := tt.dir.Flatten()
+			if (err == nil) != tt.valid {
+				t.Fatalf("got %v, want valid %v", err, tt.valid)
+			}
+			if tt.valid && !slices.Equal(fileNames(files), tt.want) {
+				t.Errorf("got %v, want %v", fileNames(files), tt.want)
+			}
+		})
+	}
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	files := []File{{Name: "a.txt", Length: 1}, {Name: "src/lib/lib.go", Length: 3}, {Name: "src/main.go", Length: 2}}
+
+	flat, err := NewDirectoryContent(files).Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.txt", "src/main.go", "src/lib/lib.go"}
+	if !slices.Equal(fileNames(flat), want) {
+		t.Errorf("got %v, want %v", fileNames(flat), want)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"a.txt", true},
+		{"src/main.go", true},
+		{"..a", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../a.txt", false},
+		{"/a.txt", false},
+		{"src//main.go", false},
+		{"src/./main.go", false},
+		{"src/../main.go", false},
+		{"src/", false},
+		{"src\\main.go", false},
+	}
+
+	for _, tt := range tests {
+		if err := CheckPath(tt.name); (err == nil) != tt.valid {
+			t.Errorf("CheckPath(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		valid bool
+	}{
+		{"none", nil, true},
+		{"several", []string{"a", "b/c", "b/d"}, true},
+		{"same prefix", []string{"a", "ab/c"}, true},
+		{"invalid path", []string{"a", "../b"}, false},
+		{"repeated", []string{"a", "b", "a"}, false},
+		{"file and dir", []string{"a", "a/b"}, false},
+		{"dir and file", []string{"a/b/c", "a/b"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []File
+			for _, name := range tt.files {
+				files = append(files, File{Name: name})
+			}
+			if err := CheckPaths(files); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestPathConflict(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []string
+		added   []string
+		want    string
+	}{
+		{"none", []string{"a", "b/c"}, []string{"d", "b/e"}, ""},
+		{"shared", []string{"a"}, []string{"d", "a"}, "a"},
+		{"in a shared file", []string{"a"}, []string{"a/b"}, "a/b"},
+		{"a shared dir", []string{"a/b/c"}, []string{"a/b"}, "a/b"},
+		{"within added", nil, []string{"a/b", "a"}, "a"},
+		// only the added paths are checked
+		{"within current", []string{"a", "a/b"}, []string{"c"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var current, added []File
+			for _, name := range tt.current {
+				current = append(current, File{Name: name})
+			}
+			for _, name := range tt.added {
+				added = append(added, File{Name: name})
+			}
+			if got := PathConflict(current, added); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParentDirs(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"a", nil},
+		{"a/b", []string{"a"}},
+		{"a/b/c.txt", []string{"a", "a/b"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParentDirs(tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("ParentDirs(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInDirs(t *testing.T) {
+	tests := []struct {
+		name string
+		dirs []string
+		want bool
+	}{
+		{"src/main.go", []string{"src"}, true},
+		{"src/lib/lib.go", []string{"src"}, true},
+		{"src/main.go", []string{"src/"}, true},
+		{"src/main.go", []string{"lib", "src"}, true},
+		{"src", []string{"src"}, false},
+		{"srcs/main.go", []string{"src"}, false},
+		{"src/main.go", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := InDirs(tt.name, tt.dirs); got != tt.want {
+			t.Errorf("InDirs(%q, %v) = %v, want %v", tt.name, tt.dirs, got, tt.want)
+		}
+	}
+}
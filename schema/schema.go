@@ -12,6 +12,8 @@ type File struct {
 	Name         string `json:"name"`
 	Length       uint64 `json:"length"`
 	LastModified uint64 `json:"lastModified"`
+	// registered by the host, so the receivers can verify the file
+	Digest *FileDigest `json:"digest,omitempty" bson:"digest,omitempty"`
 }
 
 type FilesSchema struct {
@@ -20,6 +22,8 @@ type FilesSchema struct {
 	PasswordFiles string             `bson:"passwordFiles" validate:"required"`
 	Files         []File             `bson:"files"`
 	ExpireAt      time.Time          `bson:"expireAt"`
+	// hash of the resume token of the last host websocket
+	HostSession string `bson:"hostSession,omitempty"`
 }
 
 func NewFileSchema(passwordUser string, passwordFiles string, files []File, ttl time.Duration) FilesSchema {
@@ -37,6 +41,18 @@ type Candidate struct {
 	Sdp string `bson:"sdp, omitempty"`
 }
 
+// status of the connection request of a signaling doc
+const (
+	SignalingApproved string = "approved"
+	SignalingRejected string = "rejected"
+)
+
+// relay state of a signaling doc
+const (
+	SignalingRelayRequested string = "requested"
+	SignalingRelayAccepted  string = "accepted"
+)
+
 type SignalingSchema struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty"`
 	FilesId   primitive.ObjectID `bson:"filesId,omitempty"`
@@ -44,6 +60,36 @@ type SignalingSchema struct {
 	OfferIce  []string           `bson:"offerIce,omitempty"`
 	Answer    string             `bson:"answer,omitempty"`
 	AnswerIce []string           `bson:"answerIce,omitempty"`
+	// json of the connection request sent by the conn, empty until it's sent
+	Request string `bson:"request,omitempty"`
+	// empty while the request is pending, then SignalingApproved or SignalingRejected
+	Status string `bson:"status,omitempty"`
+	// message of the host that rejected the request, set after the status
+	RejectMsg string `bson:"rejectMsg,omitempty"`
+	// why the other side left (the conn or host timed out), set before it's
+	// deleted so the listeners of the other side receive it
+	Disconnect string `bson:"disconnect,omitempty"`
+	// last presence event of the conn, replayed to the host
+	Presence string `bson:"presence,omitempty"`
+	// json of the last transfer progress of the conn, replayed to the host
+	Progress string `bson:"progress,omitempty"`
+	// json of every integrity mismatch reported by the conn, replayed to the host
+	Mismatches []string `bson:"mismatches,omitempty"`
+	// json of the last ResumeTransfer of the conn (without its token),
+	// replayed to the host
+	Resume string `bson:"resume,omitempty"`
+	// empty until the conn requests the relay, then SignalingRelayRequested
+	// or SignalingRelayAccepted once the host accepts it
+	Relay string `bson:"relay,omitempty"`
+	// hash of the secret returned to the conn that created the doc. Its
+	// websockets send the secret, the signalingId alone isn't enough
+	Secret string `bson:"secret,omitempty"`
+	// bumped by every update of the fields above, so the listeners can skip
+	// the updates already in the doc they replayed
+	Seq int64 `bson:"seq,omitempty"`
+	// copied from the files doc by the store, so a doc of a conn that never
+	// connected doesn't outlive the share
+	ExpireAt time.Time `bson:"expireAt"`
 }
 
 func NewSignalingSchema(filesId primitive.ObjectID) SignalingSchema {
@@ -53,3 +99,88 @@ func NewSignalingSchema(filesId primitive.ObjectID) SignalingSchema {
 		// AnswerIce: []string{},
 	}
 }
+
+const RevokedTokensCollection string = "revokedTokens"
+
+type RevokedTokenSchema struct {
+	ID       string    `bson:"_id"`
+	ExpireAt time.Time `bson:"expireAt"`
+}
+
+const CompletionsCollection string = "completions"
+
+// a file fully received by a conn, only recorded once
+type CompletionSchema struct {
+	ID          string             `bson:"_id"` // signalingId/file
+	FilesId     primitive.ObjectID `bson:"filesId"`
+	SignalingId primitive.ObjectID `bson:"signalingId"`
+	// name of the connection request
+	Receiver    string    `bson:"receiver"`
+	File        string    `bson:"file"`
+	Length      uint64    `bson:"length"`
+	CompletedAt time.Time `bson:"completedAt"`
+	ExpireAt    time.Time `bson:"expireAt"`
+}
+
+// kept for retention, even after the share is deleted
+func NewCompletionSchema(filesId primitive.ObjectID, signalingId primitive.ObjectID, receiver string, file string, length uint64, retention time.Duration) CompletionSchema {
+	now := time.Now()
+	return CompletionSchema{
+		ID:          signalingId.Hex() + "/" + file,
+		FilesId:     filesId,
+		SignalingId: signalingId,
+		Receiver:    receiver,
+		File:        file,
+		Length:      length,
+		CompletedAt: now,
+		ExpireAt:    now.Add(retention),
+	}
+}
+
+const AuditCollection string = "audit"
+
+// type of an audit event
+const (
+	AuditShareCreated      string = "shareCreated"
+	AuditFilesAdded        string = "filesAdded"
+	AuditFilesRemoved      string = "filesRemoved"
+	AuditReceiverConnected string = "receiverConnected"
+	AuditTransferCompleted string = "transferCompleted"
+	AuditTransferFailed    string = "transferFailed"
+	AuditIntegrityMismatch string = "integrityMismatch"
+	AuditTransferRelayed   string = "transferRelayed"
+	AuditShareExtended     string = "shareExtended"
+	AuditShareDeleted      string = "shareDeleted"
+)
+
+// the client of an audit event: the receiver (with the name of its
+// connection request) or the client of the http request
+type AuditPeer struct {
+	Name    string `bson:"name,omitempty" json:"name,omitempty"`
+	Network string `bson:"network,omitempty" json:"network,omitempty"` // the ip masked to /24 (ipv4) or /48 (ipv6)
+	Local   bool   `bson:"local,omitempty" json:"local,omitempty"`
+}
+
+// kept after the files doc is deleted, until ExpireAt (set by the audit log)
+type AuditEventSchema struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FilesId primitive.ObjectID `bson:"filesId" json:"filesId"`
+	Type    string             `bson:"type" json:"type"`
+	At      time.Time          `bson:"at" json:"at"`
+	// the conn of the receiver events
+	SignalingId string    `bson:"signalingId,omitempty" json:"signalingId,omitempty"`
+	Peer        AuditPeer `bson:"peer" json:"peer"`
+	// names of the files of the event
+	Files  []string `bson:"files,omitempty" json:"files,omitempty"`
+	Detail string   `bson:"detail,omitempty" json:"detail,omitempty"`
+	// not exported, it's the retention of the server
+	ExpireAt time.Time `bson:"expireAt" json:"-"`
+}
+
+func NewAuditEventSchema(filesId primitive.ObjectID, eventType string) AuditEventSchema {
+	return AuditEventSchema{
+		FilesId: filesId,
+		Type:    eventType,
+		At:      time.Now(),
+	}
+}